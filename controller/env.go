@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// caDir holds the CA bundles TCP shells over TLS may trust
+	caDir = getEnvCADir()
+	// how long a logged in SSH client lives without a websocket
+	sshIdleTimeout = time.Duration(getEnvInt(sshIdleTimeoutName, 10)) * time.Minute
+)
+
+const (
+	snippetFileName    = "WEBSHELL_SNIPPET_FILE"
+	caDirName          = "WEBSHELL_TLS_CA_DIR"
+	sshIdleTimeoutName = "WEBSHELL_SSH_IDLE_TIMEOUT"
+	trustedProxiesName = "WEBSHELL_TRUSTED_PROXIES"
+)
+
+func getEnvInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value == "" {
+		log.Printf("$%s not set, default to %d", name, defaultValue)
+	} else {
+		n, err := strconv.Atoi(value)
+		if err == nil && n > 0 {
+			return n
+		}
+		log.Printf("$%s (%v) is not a valid positive integer, default to %d", name, value, defaultValue)
+	}
+
+	return defaultValue
+}
+
+func getEnvSnippetFile() string {
+	if path := os.Getenv(snippetFileName); path != "" {
+		return path
+	}
+	log.Printf("$%s not set, default to snippets.json", snippetFileName)
+	return "snippets.json"
+}
+
+// getEnvCADir returns the directory holding the CA bundles TCP shells may
+// name, empty when custom CAs are disabled.
+func getEnvCADir() string {
+	dir := os.Getenv(caDirName)
+	if dir == "" {
+		log.Printf("$%s not set, custom CA bundles are disabled", caDirName)
+	}
+	return dir
+}
+
+// getEnvTrustedProxies returns the comma separated proxies whose forwarded
+// headers name the client IP, nil when no proxy is trusted.
+func getEnvTrustedProxies() []string {
+	value := os.Getenv(trustedProxiesName)
+	if value == "" {
+		log.Printf("$%s not set, forwarded headers are ignored", trustedProxiesName)
+		return nil
+	}
+	var proxies []string
+	for _, proxy := range strings.Split(value, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
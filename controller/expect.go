@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"webshell/service/limits"
+	"webshell/websocket/service/shell"
+)
+
+// RunLocalScript runs an expect script in a new local shell.
+func RunLocalScript(c *gin.Context) {
+	sp := &shell.LocalShellProvider{
+		Logger: log.New(log.Writer(), "[expect] ", log.LstdFlags),
+	}
+	runScript(c, sp)
+}
+
+// RunSSHScript runs an expect script in a new shell of a logged in SSH
+// client.
+func (sc *SSHController) RunSSHScript(c *gin.Context) {
+	id := c.Param("id")
+	sshClient, exists := sc.attach(id)
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SSH client ID"})
+		return
+	}
+	defer sc.detach(id)
+
+	sp := &shell.SSHShellProvider{
+		Client: sshClient,
+		Logger: log.New(log.Writer(), "[expect] ", log.LstdFlags),
+	}
+	runScript(c, sp)
+}
+
+// runScript streams the events of the script in the request body as
+// newline delimited JSON.
+func runScript(c *gin.Context, sp shell.ShellProvider) {
+	var script shell.Script
+	if err := c.ShouldBindJSON(&script); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// a script holds a connection and a shell as a websocket would
+	release, ok := acquireConnection(c)
+	if !ok {
+		return
+	}
+	defer release()
+	releaseShell, err := limits.Shells.Acquire(uuid.NewString())
+	if err != nil {
+		abortWithLimit(c, err)
+		return
+	}
+	defer releaseShell()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	shell.RunScriptWith(c.Request.Context(), sp, c.Query("cwd"), &script, func(ev *shell.ScriptEvent) {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+		c.Writer.Flush()
+	})
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"webshell/service/limits"
+)
+
+// acquireConnection takes a websocket connection slot for the user of c, or
+// its IP when there is no user. It answers the request itself on failure.
+func acquireConnection(c *gin.Context) (func(), bool) {
+	// the user header comes from the auth proxy, as for snippets
+	key := c.GetHeader(userHeader)
+	if key == "" {
+		key = c.ClientIP()
+	}
+
+	release, err := limits.Connections.Acquire(key)
+	if err != nil {
+		abortWithLimit(c, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// abortWithLimit answers 429 with the details of a cap that was hit.
+func abortWithLimit(c *gin.Context, err error) {
+	var limitErr *limits.LimitError
+	if !errors.As(err, &limitErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": err.Error(),
+		"code":  limitErr.Code,
+		"limit": limitErr.Limit,
+		"max":   limitErr.Max,
+	})
+}
@@ -1,19 +1,54 @@
 package controller
 
 import (
+	"log"
+
 	"github.com/gin-gonic/gin"
+
+	"webshell/service/snippet"
 )
 
+// 供 shell 服务执行片段时查找, 存储不可用时为 nil
+var snippetController *SnippetController
+
 func SetupRoutes(r *gin.Engine) {
+	// per-client caps key on the client IP, which must not come from
+	// headers anyone can send
+	if err := r.SetTrustedProxies(getEnvTrustedProxies()); err != nil {
+		log.Printf("invalid $%s: %v, forwarded headers are ignored", trustedProxiesName, err)
+		r.SetTrustedProxies(nil)
+	}
+
+	store, err := snippet.NewFileStore(getEnvSnippetFile())
+	if err != nil {
+		log.Printf("snippets disabled: %v", err)
+	} else {
+		snippetController = NewSnippetController(store)
+
+		snippets := r.Group("/snippets")
+		snippets.GET("", snippetController.List)
+		snippets.POST("", snippetController.Create)
+		snippets.GET("/:id", snippetController.Get)
+		snippets.PUT("/:id", snippetController.Update)
+		snippets.DELETE("/:id", snippetController.Delete)
+	}
+
 	shell := r.Group("/shell")
 	{
 		shell.GET("/local", StartLocalShell)
+		shell.POST("/local/expect", RunLocalScript)
 		shell.GET("/tcp", StartTCPShell)
+		shell.GET("/serial", StartSerialShell)
+		// rz/sz 传输中收到的文件
+		shell.GET("/zmodem/:token/download", DownloadZmodem)
 
 		sshController := NewSSHController()
 		shell.POST("/ssh", sshController.LoginSSH)
 		shell.GET("/ssh/:id", sshController.StartSSHShell)
+		shell.DELETE("/ssh/:id", sshController.LogoutSSH)
+		shell.POST("/ssh/:id/expect", sshController.RunSSHScript)
 		// 添加文件下载路由
 		shell.GET("/ssh/:id/download", sshController.Download)
+		shell.GET("/ssh/:id/download-zip", sshController.DownloadZip)
 	}
 }
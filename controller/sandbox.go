@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"webshell/service/sandbox"
+)
+
+// abortWithPathError answers 403 for paths outside the roots and 500 for
+// other failures.
+func abortWithPathError(c *gin.Context, err error) {
+	var outsideErr *sandbox.OutsideRootError
+	if !errors.As(err, &outsideErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": err.Error(),
+		"code":  outsideErr.Code,
+	})
+}
@@ -1,16 +1,27 @@
 package controller
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 
 	"webshell/service/downloader"
+	"webshell/service/limits"
+	"webshell/service/sandbox"
 	"webshell/websocket"
 	"webshell/websocket/service/fs"
 	"webshell/websocket/service/heartbeat"
@@ -28,6 +39,12 @@ func StartLocalShell(c *gin.Context) {
 		return
 	}
 
+	release, ok := acquireConnection(c)
+	if !ok {
+		return
+	}
+	defer release()
+
 	wsServer, err := websocket.NewServer(c.Writer, c.Request)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -38,6 +55,8 @@ func StartLocalShell(c *gin.Context) {
 	shellService := shell.NewLocalService()
 	fsService := fs.NewLocalService()
 	heartbeatService := heartbeat.NewService()
+	withLatency(shellService, heartbeatService)
+	withSnippets(shellService, c)
 	uploadService := upload.NewLocalService()
 
 	wsServer.Register(shellService)
@@ -53,12 +72,22 @@ type SSHController struct {
 	Clients map[string]*ssh.Client
 	*sync.RWMutex
 	downloaders map[string]downloader.Downloader
+	// websockets and scripts using each client, keyed like Clients
+	logins map[string]*sshLogin
+}
+
+// sshLogin tracks the users of a logged in client, which is closed once it
+// has none for sshIdleTimeout.
+type sshLogin struct {
+	attached int
+	idle     *time.Timer
 }
 
 func NewSSHController() *SSHController {
 	return &SSHController{
 		Clients: make(map[string]*ssh.Client),
 		RWMutex: &sync.RWMutex{},
+		logins:  make(map[string]*sshLogin),
 	}
 }
 
@@ -93,8 +122,15 @@ func (sc *SSHController) LoginSSH(c *gin.Context) {
 		return
 	}
 
+	release, err := limits.SSHClients.Acquire(sshInfo.Host)
+	if err != nil {
+		abortWithLimit(c, err)
+		return
+	}
+
 	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", sshInfo.Host, sshInfo.Port), config)
 	if err != nil {
+		release()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -102,11 +138,74 @@ func (sc *SSHController) LoginSSH(c *gin.Context) {
 	id := uuid.NewString()
 	sc.Lock()
 	sc.Clients[id] = client
+	// a login nobody connects to is closed too
+	sc.logins[id] = &sshLogin{idle: time.AfterFunc(sshIdleTimeout, func() { sc.logout(id, true) })}
 	sc.Unlock()
 
+	go func() {
+		client.Wait()
+		release()
+		sc.logout(id, false)
+	}()
+
 	c.JSON(http.StatusOK, gin.H{"id": id})
 }
 
+// LogoutSSH closes a logged in client, ending its shells.
+func (sc *SSHController) LogoutSSH(c *gin.Context) {
+	if !sc.logout(c.Param("id"), false) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SSH client ID"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// logout forgets and closes the client id, unless idle is set and it is in
+// use again. It reports whether the client was closed.
+func (sc *SSHController) logout(id string, idle bool) bool {
+	sc.Lock()
+	client, ok := sc.Clients[id]
+	login := sc.logins[id]
+	if !ok || (idle && login.attached > 0) {
+		sc.Unlock()
+		return false
+	}
+	delete(sc.Clients, id)
+	delete(sc.downloaders, id)
+	delete(sc.logins, id)
+	login.idle.Stop()
+	sc.Unlock()
+
+	client.Close()
+	return true
+}
+
+// attach returns the client id and keeps it open until detach is called.
+func (sc *SSHController) attach(id string) (*ssh.Client, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+	client, ok := sc.Clients[id]
+	if !ok {
+		return nil, false
+	}
+	login := sc.logins[id]
+	login.attached++
+	login.idle.Stop()
+	return client, true
+}
+
+func (sc *SSHController) detach(id string) {
+	sc.Lock()
+	defer sc.Unlock()
+	login, ok := sc.logins[id]
+	if !ok {
+		return
+	}
+	if login.attached--; login.attached == 0 {
+		login.idle.Reset(sshIdleTimeout)
+	}
+}
+
 func (sc *SSHController) StartSSHShell(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -114,14 +213,18 @@ func (sc *SSHController) StartSSHShell(c *gin.Context) {
 		return
 	}
 
-	sc.RLock()
-	sshClient, exists := sc.Clients[id]
-	sc.RUnlock()
-
+	sshClient, exists := sc.attach(id)
 	if !exists {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SSH client ID"})
 		return
 	}
+	defer sc.detach(id)
+
+	release, ok := acquireConnection(c)
+	if !ok {
+		return
+	}
+	defer release()
 
 	// Create websocket server
 	wsServer, err := websocket.NewServer(c.Writer, c.Request)
@@ -131,17 +234,27 @@ func (sc *SSHController) StartSSHShell(c *gin.Context) {
 	}
 
 	// Create SFTP service using the SSH connection
-	fsService, err := fs.NewSFTPService(sshClient)
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to create sftp client: %v", err)})
+		return
+	}
+	jail, err := sandbox.NewSFTP(sftpClient)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	fsService, err := fs.NewSFTPService(sshClient, sftpClient, jail, c.Query("encoding"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	fsSvc := fsService.(*fs.FSService)
-	sftpClient := fsSvc.FS.(*fs.SFTPFileSystem).Client
 
-	uploadService := upload.NewSFTPService(sftpClient)
+	uploadService := upload.NewSFTPService(sftpClient, jail)
 	shellService := shell.NewSSHService(sshClient)
 	heartbeatService := heartbeat.NewService()
+	withLatency(shellService, heartbeatService)
+	withSnippets(shellService, c)
 
 	// 在创建 SFTP 服务的同时创建下载器
 	sftpDl, err := downloader.NewSFTPDownloader(sshClient)
@@ -154,7 +267,10 @@ func (sc *SSHController) StartSSHShell(c *gin.Context) {
 	if sc.downloaders == nil {
 		sc.downloaders = make(map[string]downloader.Downloader)
 	}
-	sc.downloaders[id] = sftpDl
+	// a logout may have raced with setting up the services
+	if _, ok := sc.Clients[id]; ok {
+		sc.downloaders[id] = downloader.NewJailDownloader(sftpDl, jail)
+	}
 	sc.Unlock()
 
 	// Register all services
@@ -189,10 +305,86 @@ func (sc *SSHController) Download(c *gin.Context) {
 		return
 	}
 
+	serveDownload(c, dl, path)
+}
+
+// DownloadZip serves every path of the query as one zip archive. When some
+// of them cannot be read, nothing is sent but an error for each of those.
+func (sc *SSHController) DownloadZip(c *gin.Context) {
+	id := c.Param("id")
+	sc.RLock()
+	dl, exists := sc.downloaders[id]
+	sc.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SSH client ID"})
+		return
+	}
+
+	paths := c.QueryArray("path")
+	if len(paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
+		return
+	}
+
+	status := http.StatusOK
+	var failed []gin.H
+	for _, path := range paths {
+		if _, err := dl.Stat(path); err != nil {
+			item := gin.H{"path": path, "error": err.Error()}
+			var outsideErr *sandbox.OutsideRootError
+			if errors.As(err, &outsideErr) {
+				item["code"] = outsideErr.Code
+				status = http.StatusForbidden
+			} else if status == http.StatusOK {
+				status = http.StatusInternalServerError
+			}
+			failed = append(failed, item)
+		}
+	}
+	if len(failed) > 0 {
+		c.JSON(status, gin.H{"error": "Some paths cannot be downloaded", "items": failed})
+		return
+	}
+
+	reader, err := dl.DownloadZip(paths)
+	if err != nil {
+		abortWithPathError(c, err)
+		return
+	}
+	defer reader.Close()
+
+	c.Header("Content-Disposition", "attachment; filename=download.zip")
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	buffer := make([]byte, 32*1024)
+	_, _ = io.CopyBuffer(c.Writer, reader, buffer)
+}
+
+// DownloadZmodem serves the files a shell received from `sz`.
+func DownloadZmodem(c *gin.Context) {
+	dl, exists := shell.ZmodemDownloader(c.Param("token"))
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer token"})
+		return
+	}
+
+	name := c.Query("path")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
+		return
+	}
+
+	// received files are flat in the staging directory
+	serveDownload(c, dl, filepath.Base(name))
+}
+
+func serveDownload(c *gin.Context, dl downloader.Downloader, path string) {
 	// Get file info first
 	info, err := dl.Stat(path)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithPathError(c, err)
 		return
 	}
 
@@ -207,7 +399,7 @@ func (sc *SSHController) Download(c *gin.Context) {
 	}
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithPathError(c, err)
 		return
 	}
 	defer reader.Close()
@@ -222,8 +414,15 @@ func (sc *SSHController) Download(c *gin.Context) {
 
 func StartTCPShell(c *gin.Context) {
 	var req struct {
-		Host string `form:"host" binding:"required"`
-		Port int    `form:"port"`
+		Host       string `form:"host" binding:"required"`
+		Port       int    `form:"port"`
+		Mode       string `form:"mode" binding:"omitempty,oneof=raw telnet"`
+		LineEnding string `form:"lineEnding" binding:"omitempty,oneof=raw lf crlf"`
+		// TLS options
+		TLS      bool   `form:"tls"`
+		SNI      string `form:"sni"`
+		CA       string `form:"ca"` // name of a PEM CA bundle in $WEBSHELL_TLS_CA_DIR
+		Insecure bool   `form:"insecure"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -235,6 +434,26 @@ func StartTCPShell(c *gin.Context) {
 		req.Port = 23 // Default to telnet port
 	}
 
+	opts := shell.TCPOptions{
+		Mode:       req.Mode,
+		LineEnding: req.LineEnding,
+	}
+
+	if req.TLS {
+		tlsConfig, err := newTLSConfig(req.Host, req.SNI, req.CA, req.Insecure)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.TLS = tlsConfig
+	}
+
+	release, ok := acquireConnection(c)
+	if !ok {
+		return
+	}
+	defer release()
+
 	wsServer, err := websocket.NewServer(c.Writer, c.Request)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -242,11 +461,114 @@ func StartTCPShell(c *gin.Context) {
 	}
 
 	// Register services
-	shellService := shell.NewTCPService(req.Host, req.Port)
+	shellService := shell.NewTCPService(req.Host, req.Port, opts)
 	heartbeatService := heartbeat.NewService()
+	withLatency(shellService, heartbeatService)
+	withSnippets(shellService, c)
 
 	wsServer.Register(shellService)
 	wsServer.RegisterPassive(heartbeatService)
 
 	wsServer.Start()
 }
+
+func StartSerialShell(c *gin.Context) {
+	var req struct {
+		Host       string `form:"host" binding:"required"`
+		Port       int    `form:"port" binding:"required"`
+		LineEnding string `form:"lineEnding" binding:"omitempty,oneof=raw lf crlf"`
+		// Default line settings, each shell may override them on start
+		BaudRate int    `form:"baudRate"`
+		DataBits int    `form:"dataBits"`
+		Parity   string `form:"parity"`
+		StopBits string `form:"stopBits"`
+	}
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	serial := shell.SerialConfig{
+		BaudRate: req.BaudRate,
+		DataBits: req.DataBits,
+		Parity:   req.Parity,
+		StopBits: req.StopBits,
+	}
+	if err := serial.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	release, ok := acquireConnection(c)
+	if !ok {
+		return
+	}
+	defer release()
+
+	wsServer, err := websocket.NewServer(c.Writer, c.Request)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Register services
+	shellService := shell.NewRFC2217Service(req.Host, req.Port, shell.TCPOptions{LineEnding: req.LineEnding}, serial)
+	heartbeatService := heartbeat.NewService()
+	withLatency(shellService, heartbeatService)
+	withSnippets(shellService, c)
+
+	wsServer.Register(shellService)
+	wsServer.RegisterPassive(heartbeatService)
+
+	wsServer.Start()
+}
+
+func newTLSConfig(host, sni, caName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+	}
+
+	if sni != "" {
+		config.ServerName = sni
+	}
+
+	if caName != "" {
+		pool, err := loadCABundle(caName)
+		if err != nil {
+			// the details would tell clients about the server's files
+			log.Printf("error loading CA bundle %q: %v", caName, err)
+			return nil, errors.New("invalid CA bundle")
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// loadCABundle reads the bundle name from caDir. Names are plain file
+// names, they cannot leave the directory.
+func loadCABundle(name string) (*x509.CertPool, error) {
+	if caDir == "" {
+		return nil, errors.New("custom CA bundles are disabled")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, errors.New("not a plain file name")
+	}
+	pem, err := os.ReadFile(filepath.Join(caDir, name))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found")
+	}
+	return pool, nil
+}
+
+// withLatency lets the shell service read the round trip measured by the
+// heartbeat service.
+func withLatency(shellService, heartbeatService websocket.Service) {
+	shellService.(*shell.ShellService).Latency = heartbeatService.(*heartbeat.HeartbeatService).RTT
+}
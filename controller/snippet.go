@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"webshell/service/snippet"
+	"webshell/websocket"
+	"webshell/websocket/service/shell"
+)
+
+// 用户和团队由前置的认证代理通过请求头传入
+const (
+	userHeader = "X-Webshell-User"
+	teamHeader = "X-Webshell-Team"
+)
+
+type SnippetController struct {
+	Store snippet.Store
+}
+
+func NewSnippetController(store snippet.Store) *SnippetController {
+	return &SnippetController{Store: store}
+}
+
+type snippetRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Content     string `json:"content" binding:"required"`
+	// Shared snippets belong to the team of the user instead of the user.
+	Shared bool `json:"shared"`
+}
+
+func identity(c *gin.Context) (user, team string) {
+	return c.GetHeader(userHeader), c.GetHeader(teamHeader)
+}
+
+func (sc *SnippetController) List(c *gin.Context) {
+	user, team := identity(c)
+
+	list, err := sc.Store.List(user, team)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (sc *SnippetController) Get(c *gin.Context) {
+	sn, ok := sc.visible(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sn)
+}
+
+func (sc *SnippetController) Create(c *gin.Context) {
+	var req snippetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sn := &snippet.Snippet{}
+	if !applySnippetRequest(c, sn, &req) {
+		return
+	}
+	if err := sc.Store.Create(sn); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sn)
+}
+
+func (sc *SnippetController) Update(c *gin.Context) {
+	var req snippetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sn, ok := sc.visible(c)
+	if !ok {
+		return
+	}
+	if !applySnippetRequest(c, sn, &req) {
+		return
+	}
+	if err := sc.Store.Update(sn); err != nil {
+		c.JSON(snippetStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sn)
+}
+
+func (sc *SnippetController) Delete(c *gin.Context) {
+	sn, ok := sc.visible(c)
+	if !ok {
+		return
+	}
+	if err := sc.Store.Delete(sn.Id); err != nil {
+		c.JSON(snippetStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// visible loads the snippet of the request, answering with an error when
+// it does not exist or belongs to someone else.
+func (sc *SnippetController) visible(c *gin.Context) (*snippet.Snippet, bool) {
+	user, team := identity(c)
+
+	sn, err := sc.Store.Get(c.Param("id"))
+	if err == nil && !sn.Visible(user, team) {
+		err = snippet.ErrForbidden
+	}
+	if err != nil {
+		c.JSON(snippetStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return sn, true
+}
+
+// lookup returns a function finding the snippets the user of c may run.
+func (sc *SnippetController) lookup(c *gin.Context) func(id string) (*snippet.Snippet, error) {
+	user, team := identity(c)
+
+	return func(id string) (*snippet.Snippet, error) {
+		sn, err := sc.Store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if !sn.Visible(user, team) {
+			return nil, snippet.ErrForbidden
+		}
+		return sn, nil
+	}
+}
+
+func applySnippetRequest(c *gin.Context, sn *snippet.Snippet, req *snippetRequest) bool {
+	user, team := identity(c)
+
+	sn.Name = req.Name
+	sn.Description = req.Description
+	sn.Content = req.Content
+	sn.Owner, sn.Team = "", ""
+
+	if req.Shared {
+		if team == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Shared snippets require a team"})
+			return false
+		}
+		sn.Team = team
+	} else {
+		if user == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Personal snippets require a user"})
+			return false
+		}
+		sn.Owner = user
+	}
+	return true
+}
+
+func snippetStatus(err error) int {
+	switch {
+	case errors.Is(err, snippet.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, snippet.ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// withSnippets lets the shell service run the snippets of the user of c.
+func withSnippets(shellService websocket.Service, c *gin.Context) {
+	if snippetController == nil {
+		return
+	}
+	shellService.(*shell.ShellService).Snippets = snippetController.lookup(c)
+}
@@ -22,6 +22,9 @@ type Downloader interface {
 	// DownloadDir streams a directory as a zip archive
 	DownloadDir(path string) (io.ReadCloser, *FileInfo, error)
 
+	// DownloadZip streams several files and directories as one zip archive
+	DownloadZip(paths []string) (io.ReadCloser, error)
+
 	// Stat returns file information without downloading
 	Stat(path string) (*FileInfo, error)
 }
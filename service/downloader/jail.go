@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"io"
+
+	"webshell/service/sandbox"
+)
+
+// jailDownloader checks every path given to a Downloader against a jail.
+type jailDownloader struct {
+	dl   Downloader
+	jail *sandbox.Jail
+}
+
+// NewJailDownloader restricts dl to the roots of jail.
+func NewJailDownloader(dl Downloader, jail *sandbox.Jail) Downloader {
+	return &jailDownloader{dl: dl, jail: jail}
+}
+
+func (j *jailDownloader) Download(path string) (io.ReadCloser, *FileInfo, error) {
+	if err := j.jail.Check(path); err != nil {
+		return nil, nil, err
+	}
+	return j.dl.Download(path)
+}
+
+func (j *jailDownloader) DownloadDir(path string) (io.ReadCloser, *FileInfo, error) {
+	if err := j.jail.Check(path); err != nil {
+		return nil, nil, err
+	}
+	return j.dl.DownloadDir(path)
+}
+
+func (j *jailDownloader) DownloadZip(paths []string) (io.ReadCloser, error) {
+	for _, path := range paths {
+		if err := j.jail.Check(path); err != nil {
+			return nil, err
+		}
+	}
+	return j.dl.DownloadZip(paths)
+}
+
+func (j *jailDownloader) Stat(path string) (*FileInfo, error) {
+	if err := j.jail.Check(path); err != nil {
+		return nil, err
+	}
+	return j.dl.Stat(path)
+}
@@ -5,19 +5,38 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+
+	"webshell/service/sandbox"
 )
 
+// LocalDownloader serves paths relative to rootDir, which they cannot leave.
 type LocalDownloader struct {
 	rootDir string
+	jail    *sandbox.Jail
 }
 
 func NewLocalDownloader(rootDir string) *LocalDownloader {
-	return &LocalDownloader{rootDir: rootDir}
+	return &LocalDownloader{rootDir: rootDir, jail: sandbox.NewLocal(rootDir)}
+}
+
+func (l *LocalDownloader) fullPath(path string) (string, error) {
+	fullPath, err := filepath.Abs(filepath.Join(l.rootDir, path))
+	if err != nil {
+		return "", err
+	}
+	if err := l.jail.Check(fullPath); err != nil {
+		return "", err
+	}
+	return fullPath, nil
 }
 
 func (l *LocalDownloader) Download(path string) (io.ReadCloser, *FileInfo, error) {
-	fullPath := filepath.Join(l.rootDir, path)
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
 	file, err := os.Open(fullPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open file: %w", err)
@@ -38,7 +57,10 @@ func (l *LocalDownloader) Download(path string) (io.ReadCloser, *FileInfo, error
 }
 
 func (l *LocalDownloader) DownloadDir(path string) (io.ReadCloser, *FileInfo, error) {
-	fullPath := filepath.Join(l.rootDir, path)
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get directory info: %w", err)
@@ -48,74 +70,68 @@ func (l *LocalDownloader) DownloadDir(path string) (io.ReadCloser, *FileInfo, er
 		return nil, nil, fmt.Errorf("path is not a directory")
 	}
 
-	// Create pipes for streaming zip content
-	pr, pw := io.Pipe()
+	pr := zipStream(func(zw *zip.Writer) error {
+		return l.zipTree(zw, fullPath, "")
+	})
+	return pr, toFileInfo(info), nil
+}
 
-	// Create zip writer in a goroutine
-	go func() {
-		zw := zip.NewWriter(pw)
-		defer func() {
-			zw.Close()
-			pw.Close()
-		}()
+// DownloadZip streams the given files and directories as one zip archive,
+// each at its top level.
+func (l *LocalDownloader) DownloadZip(paths []string) (io.ReadCloser, error) {
+	fullPaths := make([]string, len(paths))
+	for i, path := range paths {
+		fullPath, err := l.fullPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(fullPath); err != nil {
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+		fullPaths[i] = fullPath
+	}
 
-		err := filepath.Walk(fullPath, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
+	names := zipNames(fullPaths)
+	return zipStream(func(zw *zip.Writer) error {
+		for i, fullPath := range fullPaths {
+			if err := l.zipTree(zw, fullPath, names[i]); err != nil {
 				return err
 			}
+		}
+		return nil
+	}), nil
+}
 
-			// Create zip header
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return fmt.Errorf("failed to create zip header: %w", err)
-			}
-
-			// Update header name with relative path
-			relPath, err := filepath.Rel(fullPath, filePath)
-			if err != nil {
-				return fmt.Errorf("failed to get relative path: %w", err)
-			}
-			header.Name = relPath
-
-			if info.IsDir() {
-				header.Name += "/"
-			}
-
-			// Create file in zip
-			writer, err := zw.CreateHeader(header)
-			if err != nil {
-				return fmt.Errorf("failed to create file in zip: %w", err)
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			// Copy file content
-			file, err := os.Open(filePath)
-			if err != nil {
-				return fmt.Errorf("failed to open file: %w", err)
-			}
-			defer file.Close()
-
-			_, err = io.Copy(writer, file)
-			if err != nil {
-				return fmt.Errorf("failed to copy file content: %w", err)
-			}
-
+// zipTree adds root and everything under it to zw, below prefix.
+func (l *LocalDownloader) zipTree(zw *zip.Writer, root, prefix string) error {
+	return filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// links could point anywhere, they are left out
+		if info.Mode()&os.ModeSymlink != 0 {
 			return nil
-		})
+		}
 
+		relPath, err := filepath.Rel(root, filePath)
 		if err != nil {
-			pw.CloseWithError(err)
+			return fmt.Errorf("failed to get relative path: %w", err)
 		}
-	}()
-
-	return pr, toFileInfo(info), nil
+		name := filepath.ToSlash(relPath)
+		if prefix != "" {
+			name = path.Join(prefix, name)
+		}
+		return zipEntry(zw, name, info, func() (io.ReadCloser, error) {
+			return os.Open(filePath)
+		})
+	})
 }
 
 func (l *LocalDownloader) Stat(path string) (*FileInfo, error) {
-	fullPath := filepath.Join(l.rootDir, path)
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file info: %w", err)
@@ -4,6 +4,8 @@ import (
 	"archive/zip"
 	"fmt"
 	"io"
+	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/pkg/sftp"
@@ -57,74 +59,63 @@ func (s *SFTPDownloader) DownloadDir(path string) (io.ReadCloser, *FileInfo, err
 		return nil, nil, fmt.Errorf("path is not a directory")
 	}
 
-	// Create pipes for streaming zip content
-	pr, pw := io.Pipe()
-
-	// Create zip writer in a goroutine
-	go func() {
-		zw := zip.NewWriter(pw)
-		defer func() {
-			zw.Close()
-			pw.Close()
-		}()
-
-		walker := s.client.Walk(path)
-		for walker.Step() {
-			if err := walker.Err(); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
-
-			filePath := walker.Path()
-			info := walker.Stat()
-
-			// Create zip header
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				pw.CloseWithError(fmt.Errorf("failed to create zip header: %w", err))
-				return
-			}
-
-			// Update header name with relative path
-			relPath, err := filepath.Rel(path, filePath)
-			if err != nil {
-				pw.CloseWithError(fmt.Errorf("failed to get relative path: %w", err))
-				return
-			}
-			header.Name = relPath
-
-			if info.IsDir() {
-				header.Name += "/"
-			}
+	pr := zipStream(func(zw *zip.Writer) error {
+		return s.zipTree(zw, path, "")
+	})
+	return pr, toFileInfo(info), nil
+}
 
-			// Create file in zip
-			writer, err := zw.CreateHeader(header)
-			if err != nil {
-				pw.CloseWithError(fmt.Errorf("failed to create file in zip: %w", err))
-				return
-			}
+// DownloadZip streams the given files and directories as one zip archive,
+// each at its top level.
+func (s *SFTPDownloader) DownloadZip(paths []string) (io.ReadCloser, error) {
+	for _, path := range paths {
+		if _, err := s.client.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+	}
 
-			if info.IsDir() {
-				continue
+	names := zipNames(paths)
+	return zipStream(func(zw *zip.Writer) error {
+		for i, path := range paths {
+			if err := s.zipTree(zw, path, names[i]); err != nil {
+				return err
 			}
+		}
+		return nil
+	}), nil
+}
 
-			// Copy file content
-			file, err := s.client.Open(filePath)
-			if err != nil {
-				pw.CloseWithError(fmt.Errorf("failed to open file: %w", err))
-				return
-			}
+// zipTree adds root and everything under it to zw, below prefix.
+func (s *SFTPDownloader) zipTree(zw *zip.Writer, root, prefix string) error {
+	walker := s.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
 
-			_, err = io.Copy(writer, file)
-			file.Close()
-			if err != nil {
-				pw.CloseWithError(fmt.Errorf("failed to copy file content: %w", err))
-				return
-			}
+		filePath := walker.Path()
+		info := walker.Stat()
+		// links could point anywhere, they are left out
+		if info.Mode()&os.ModeSymlink != 0 {
+			continue
 		}
-	}()
 
-	return pr, toFileInfo(info), nil
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		name := filepath.ToSlash(relPath)
+		if prefix != "" {
+			name = path.Join(prefix, name)
+		}
+		err = zipEntry(zw, name, info, func() (io.ReadCloser, error) {
+			return s.client.Open(filePath)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *SFTPDownloader) Stat(path string) (*FileInfo, error) {
@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// zipEntry adds info to zw under name, with the contents open returns for
+// files.
+func zipEntry(zw *zip.Writer, name string, info os.FileInfo, open func() (io.ReadCloser, error)) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return fmt.Errorf("failed to create zip header: %w", err)
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	writer, err := zw.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to create file in zip: %w", err)
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	file, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(writer, file); err != nil {
+		return fmt.Errorf("failed to copy file content: %w", err)
+	}
+	return nil
+}
+
+// zipNames picks the top level name of every path in a multi-path archive,
+// numbering the names found more than once: a, a (2), a (3).
+func zipNames(paths []string) []string {
+	names := make([]string, len(paths))
+	seen := make(map[string]bool, len(paths))
+	for i, p := range paths {
+		base := strings.TrimRight(p, `/\`)
+		base = base[strings.LastIndexAny(base, `/\`)+1:]
+		if base == "" || base == "." || base == ".." {
+			base = "root"
+		}
+		name := base
+		for n := 2; seen[name]; n++ {
+			ext := path.Ext(base)
+			name = strings.TrimSuffix(base, ext) + " (" + strconv.Itoa(n) + ")" + ext
+		}
+		seen[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// zipStream runs write in the background and returns the archive it writes.
+func zipStream(write func(zw *zip.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := zip.NewWriter(pw)
+		err := write(zw)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,48 @@
+package limits
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+const (
+	maxConnectionsPerClientName = "WEBSHELL_MAX_CONNECTIONS_PER_CLIENT"
+	maxConnectionsName          = "WEBSHELL_MAX_CONNECTIONS"
+	maxSSHClientsPerHostName    = "WEBSHELL_MAX_SSH_CLIENTS_PER_HOST"
+	maxSSHClientsName           = "WEBSHELL_MAX_SSH_CLIENTS"
+	maxShellsPerConnectionName  = "WEBSHELL_MAX_SHELLS_PER_CONNECTION"
+	maxShellsName               = "WEBSHELL_MAX_SHELLS"
+)
+
+var (
+	// Connections counts websocket connections per user or IP.
+	Connections = NewLimiter(
+		"connections_per_client", getEnvMax(maxConnectionsPerClientName),
+		"connections", getEnvMax(maxConnectionsName),
+	)
+	// SSHClients counts logged in SSH clients per host.
+	SSHClients = NewLimiter(
+		"ssh_clients_per_host", getEnvMax(maxSSHClientsPerHostName),
+		"ssh_clients", getEnvMax(maxSSHClientsName),
+	)
+	// Shells counts running shells per connection.
+	Shells = NewLimiter(
+		"shells_per_connection", getEnvMax(maxShellsPerConnectionName),
+		"shells", getEnvMax(maxShellsName),
+	)
+)
+
+func getEnvMax(name string) int {
+	if value := os.Getenv(name); value == "" {
+		log.Printf("$%s not set, default to unlimited", name)
+	} else {
+		n, err := strconv.Atoi(value)
+		if err == nil && n >= 0 {
+			return n
+		}
+		log.Printf("$%s (%v) is not a valid limit, default to unlimited", name, value)
+	}
+
+	return 0
+}
@@ -0,0 +1,75 @@
+package limits
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CodeLimitExceeded is sent along with a LimitError so clients can tell it
+// from other failures.
+const CodeLimitExceeded = "limit_exceeded"
+
+// LimitError reports a request over a cap.
+type LimitError struct {
+	Code  string `json:"code"`
+	Limit string `json:"limit"`
+	Max   int    `json:"max"`
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("limit exceeded: %s (max %d)", e.Limit, e.Max)
+}
+
+// Limiter counts resources per key and in total. A max of 0 disables that
+// cap.
+type Limiter struct {
+	keyLimit   string
+	maxPerKey  int
+	totalLimit string
+	maxTotal   int
+
+	counts map[string]int
+	total  int
+	*sync.Mutex
+}
+
+func NewLimiter(keyLimit string, maxPerKey int, totalLimit string, maxTotal int) *Limiter {
+	return &Limiter{
+		keyLimit:   keyLimit,
+		maxPerKey:  maxPerKey,
+		totalLimit: totalLimit,
+		maxTotal:   maxTotal,
+		counts:     make(map[string]int),
+		Mutex:      new(sync.Mutex),
+	}
+}
+
+// Acquire takes a slot for key. The returned function gives it back and may
+// be called more than once.
+func (l *Limiter) Acquire(key string) (func(), error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return nil, &LimitError{Code: CodeLimitExceeded, Limit: l.totalLimit, Max: l.maxTotal}
+	}
+	if l.maxPerKey > 0 && l.counts[key] >= l.maxPerKey {
+		return nil, &LimitError{Code: CodeLimitExceeded, Limit: l.keyLimit, Max: l.maxPerKey}
+	}
+
+	l.total++
+	l.counts[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+
+			l.total--
+			if l.counts[key]--; l.counts[key] <= 0 {
+				delete(l.counts, key)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,36 @@
+package limits
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter("per_key", 2, "total", 3)
+
+	releaseA1, err := l.Acquire("a")
+	assert.NoError(t, err)
+	_, err = l.Acquire("a")
+	assert.NoError(t, err)
+
+	_, err = l.Acquire("a")
+	var limitErr *LimitError
+	assert.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "per_key", limitErr.Limit)
+	assert.Equal(t, 2, limitErr.Max)
+
+	_, err = l.Acquire("b")
+	assert.NoError(t, err)
+	_, err = l.Acquire("c")
+	assert.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "total", limitErr.Limit)
+
+	// releasing twice only frees one slot
+	releaseA1()
+	releaseA1()
+	_, err = l.Acquire("c")
+	assert.NoError(t, err)
+	_, err = l.Acquire("d")
+	assert.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package sandbox
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	localRootName = "WEBSHELL_FS_ROOT"
+	sftpRootName  = "WEBSHELL_SFTP_ROOT"
+)
+
+var (
+	// LocalRoots are the local directories the file services may use.
+	LocalRoots = getEnvLocalRoots()
+	// SFTPRoots are the remote directories the file services may use. When
+	// empty the home directory of the remote user is used.
+	SFTPRoots = getEnvSFTPRoots()
+
+	// Local is the jail of the local file services.
+	Local = NewLocal(LocalRoots...)
+)
+
+// getEnvLocalRoots reads a list of roots separated like $PATH.
+func getEnvLocalRoots() []string {
+	var roots []string
+	if value := os.Getenv(localRootName); value == "" {
+		log.Printf("$%s not set, using home directory", localRootName)
+	} else {
+		for _, root := range filepath.SplitList(value) {
+			if _, err := os.Stat(root); err != nil {
+				log.Printf("$%s: %s is not a valid path, skipping", localRootName, root)
+				continue
+			}
+			if abs, err := filepath.Abs(root); err == nil {
+				roots = append(roots, abs)
+			}
+		}
+		if len(roots) > 0 {
+			return roots
+		}
+		log.Printf("$%s (%s) has no valid path, using home directory", localRootName, value)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("failed to get user home directory: %v", err)
+		log.Printf("using cwd as fallback")
+		homeDir, _ = filepath.Abs(".")
+	}
+
+	return []string{homeDir}
+}
+
+// getEnvSFTPRoots reads a list of remote roots separated by colons.
+func getEnvSFTPRoots() []string {
+	value := os.Getenv(sftpRootName)
+	if value == "" {
+		log.Printf("$%s not set, using remote home directory", sftpRootName)
+		return nil
+	}
+
+	var roots []string
+	for _, root := range strings.Split(value, ":") {
+		if root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
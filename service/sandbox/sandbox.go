@@ -0,0 +1,249 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// CodeOutsideRoot is sent along with an OutsideRootError so clients can tell
+// it from other failures.
+const CodeOutsideRoot = "outside_root"
+
+// OutsideRootError reports a path a jail does not allow.
+type OutsideRootError struct {
+	Code string `json:"code"`
+	Path string `json:"path"`
+}
+
+func (e *OutsideRootError) Error() string {
+	return fmt.Sprintf("path is outside of the allowed roots: %s", e.Path)
+}
+
+func outside(p string) error {
+	return &OutsideRootError{Code: CodeOutsideRoot, Path: p}
+}
+
+// Resolver gives a jail access to the file system it guards.
+type Resolver interface {
+	// Resolve returns path with every symlink followed. It fails with
+	// fs.ErrNotExist when path does not exist.
+	Resolve(path string) (string, error)
+
+	Lstat(path string) (os.FileInfo, error)
+}
+
+type localResolver struct{}
+
+func (localResolver) Resolve(p string) (string, error) {
+	return filepath.EvalSymlinks(p)
+}
+
+func (localResolver) Lstat(p string) (os.FileInfo, error) {
+	return os.Lstat(p)
+}
+
+type sftpResolver struct {
+	client *sftp.Client
+}
+
+func (r sftpResolver) Resolve(p string) (string, error) {
+	// servers may canonicalize paths that do not exist
+	if _, err := r.client.Stat(p); err != nil {
+		return "", err
+	}
+	return r.client.RealPath(p)
+}
+
+func (r sftpResolver) Lstat(p string) (os.FileInfo, error) {
+	return r.client.Lstat(p)
+}
+
+// Jail only lets through paths that stay under its roots once symlinks are
+// resolved.
+type Jail struct {
+	roots    []string
+	resolver Resolver
+	// remote paths always use slashes
+	slash bool
+}
+
+// NewLocal returns a jail for the local file system.
+func NewLocal(roots ...string) *Jail {
+	return newJail(localResolver{}, false, roots)
+}
+
+// NewSFTP returns a jail for the file system behind client, limited to
+// SFTPRoots or else the directory the server starts in, the home directory
+// of the user.
+func NewSFTP(client *sftp.Client) (*Jail, error) {
+	roots := SFTPRoots
+	if len(roots) == 0 {
+		home, err := client.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get remote home directory: %w", err)
+		}
+		roots = []string{home}
+	}
+	return newJail(sftpResolver{client}, true, roots), nil
+}
+
+func newJail(r Resolver, slash bool, roots []string) *Jail {
+	j := &Jail{resolver: r, slash: slash}
+	for _, root := range roots {
+		root = j.clean(root)
+		if real, err := r.Resolve(root); err == nil {
+			root = real
+		}
+		j.roots = append(j.roots, root)
+	}
+	return j
+}
+
+// Roots returns the roots of the jail, with symlinks resolved.
+func (j *Jail) Roots() []string {
+	return j.roots
+}
+
+// Check returns an OutsideRootError unless p, an absolute path, is under one
+// of the roots. Paths that do not exist yet are checked through their
+// closest existing parent.
+func (j *Jail) Check(p string) error {
+	if !j.isAbs(p) {
+		return outside(p)
+	}
+	real, err := j.resolve(j.clean(p))
+	if err != nil {
+		return err
+	}
+	if !j.within(real) {
+		return outside(p)
+	}
+	return nil
+}
+
+// CheckLink is Check for operations on p itself, such as removing or
+// renaming it, which do not follow p when it is a symlink. Only its parent
+// is resolved, so links pointing outside the roots, or nowhere, pass.
+func (j *Jail) CheckLink(p string) error {
+	if !j.isAbs(p) {
+		return outside(p)
+	}
+	real, err := j.resolveLink(j.clean(p))
+	if err != nil {
+		return err
+	}
+	if !j.within(real) {
+		return outside(p)
+	}
+	return nil
+}
+
+// IsRoot reports whether p is one of the roots, which must not be removed.
+// As with CheckLink, a symlink p is not followed.
+func (j *Jail) IsRoot(p string) bool {
+	if !j.isAbs(p) {
+		return false
+	}
+	real, err := j.resolveLink(j.clean(p))
+	if err != nil {
+		return false
+	}
+	for _, root := range j.roots {
+		if real == root {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Jail) resolve(p string) (string, error) {
+	real, err := j.resolver.Resolve(p)
+	if err == nil {
+		return real, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if _, err := j.resolver.Lstat(p); err == nil {
+		// a dangling symlink, creating p would write wherever it points
+		return "", outside(p)
+	}
+
+	parent := j.dir(p)
+	if parent == p {
+		return p, nil
+	}
+	realParent, err := j.resolve(parent)
+	if err != nil {
+		return "", err
+	}
+	return j.join(realParent, j.base(p)), nil
+}
+
+// resolveLink resolves the parent of p and keeps its last element.
+func (j *Jail) resolveLink(p string) (string, error) {
+	parent := j.dir(p)
+	if parent == p {
+		return p, nil
+	}
+	realParent, err := j.resolve(parent)
+	if err != nil {
+		return "", err
+	}
+	return j.join(realParent, j.base(p)), nil
+}
+
+func (j *Jail) within(p string) bool {
+	sep := string(filepath.Separator)
+	if j.slash {
+		sep = "/"
+	}
+	for _, root := range j.roots {
+		if p == root || strings.HasPrefix(p, strings.TrimSuffix(root, sep)+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Jail) isAbs(p string) bool {
+	if j.slash {
+		return path.IsAbs(p)
+	}
+	return filepath.IsAbs(p)
+}
+
+func (j *Jail) clean(p string) string {
+	if j.slash {
+		return path.Clean(p)
+	}
+	return filepath.Clean(p)
+}
+
+func (j *Jail) dir(p string) string {
+	if j.slash {
+		return path.Dir(p)
+	}
+	return filepath.Dir(p)
+}
+
+func (j *Jail) base(p string) string {
+	if j.slash {
+		return path.Base(p)
+	}
+	return filepath.Base(p)
+}
+
+func (j *Jail) join(elem ...string) string {
+	if j.slash {
+		return path.Join(elem...)
+	}
+	return filepath.Join(elem...)
+}
@@ -0,0 +1,76 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJail(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outsideDir := filepath.Join(base, "outside")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dir"), 0755))
+	require.NoError(t, os.Mkdir(outsideDir, 0755))
+	require.NoError(t, os.Symlink(outsideDir, filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "dir"), filepath.Join(root, "inside")))
+	require.NoError(t, os.Symlink(filepath.Join(outsideDir, "missing"), filepath.Join(root, "dangling")))
+
+	j := NewLocal(root)
+
+	for _, p := range []string{
+		root,
+		filepath.Join(root, "dir"),
+		filepath.Join(root, "inside"),
+		filepath.Join(root, "new", "file"),
+		filepath.Join(root, "dir", "..", "dir"),
+	} {
+		assert.NoError(t, j.Check(p), p)
+	}
+
+	for _, p := range []string{
+		"relative",
+		base,
+		outsideDir,
+		filepath.Join(root, ".."),
+		filepath.Join(root, "dir", "..", "..", "outside"),
+		filepath.Join(root, "escape"),
+		filepath.Join(root, "escape", "new"),
+		filepath.Join(root, "dangling"),
+		root + "-sibling",
+	} {
+		err := j.Check(p)
+		var outsideErr *OutsideRootError
+		if assert.ErrorAs(t, err, &outsideErr, p) {
+			assert.Equal(t, CodeOutsideRoot, outsideErr.Code)
+		}
+	}
+
+	assert.True(t, j.IsRoot(root))
+	assert.True(t, j.IsRoot(root+"/"))
+	assert.False(t, j.IsRoot(filepath.Join(root, "dir")))
+
+	// links are checked where they are, not where they point
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "self")))
+	assert.False(t, j.IsRoot(filepath.Join(root, "self")))
+	for _, p := range []string{
+		root,
+		filepath.Join(root, "escape"),
+		filepath.Join(root, "dangling"),
+		filepath.Join(root, "inside", "new"),
+	} {
+		assert.NoError(t, j.CheckLink(p), p)
+	}
+	for _, p := range []string{
+		"relative",
+		filepath.Join(root, ".."),
+		filepath.Join(root, "escape", "new"),
+		filepath.Join(outsideDir, "missing"),
+	} {
+		var outsideErr *OutsideRootError
+		assert.ErrorAs(t, j.CheckLink(p), &outsideErr, p)
+	}
+}
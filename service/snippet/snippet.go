@@ -0,0 +1,72 @@
+package snippet
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrNotFound  = errors.New("snippet not found")
+	ErrForbidden = errors.New("snippet belongs to another user or team")
+
+	paramPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// Snippet is a saved command sequence. Content may contain named
+// parameters written as {{name}}.
+type Snippet struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Content     string `json:"content"`
+	// Params lists the parameter names found in Content.
+	Params []string `json:"params"`
+
+	// Owner is set for personal snippets, Team for snippets shared with a
+	// team. Exactly one of them is set.
+	Owner string `json:"owner,omitempty"`
+	Team  string `json:"team,omitempty"`
+
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+// Visible reports whether user, a member of team, may see and run s.
+func (s *Snippet) Visible(user, team string) bool {
+	if s.Team != "" {
+		return s.Team == team
+	}
+	return s.Owner == user
+}
+
+// Params returns the distinct parameter names in content, in order of first
+// use.
+func Params(content string) []string {
+	params := []string{}
+	seen := make(map[string]bool)
+	for _, m := range paramPattern.FindAllStringSubmatch(content, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			params = append(params, m[1])
+		}
+	}
+	return params
+}
+
+// Render fills in the parameters of content. Every parameter must be given.
+func Render(content string, params map[string]string) (string, error) {
+	var missing []string
+	for _, name := range Params(content) {
+		if _, ok := params[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing snippet parameters: %s", strings.Join(missing, ", "))
+	}
+
+	return paramPattern.ReplaceAllStringFunc(content, func(m string) string {
+		return params[paramPattern.FindStringSubmatch(m)[1]]
+	}), nil
+}
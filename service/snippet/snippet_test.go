@@ -0,0 +1,49 @@
+package snippet
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	content := "journalctl -u {{ unit }} --since {{since}} | grep {{unit}}\n"
+	assert.Equal(t, []string{"unit", "since"}, Params(content))
+
+	out, err := Render(content, map[string]string{"unit": "nginx", "since": "today"})
+	assert.NoError(t, err)
+	assert.Equal(t, "journalctl -u nginx --since today | grep nginx\n", out)
+
+	_, err = Render(content, map[string]string{"unit": "nginx"})
+	assert.ErrorContains(t, err, "since")
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snippets.json")
+	store, err := NewFileStore(path)
+	assert.NoError(t, err)
+
+	mine := &Snippet{Name: "disk", Content: "df -h {{path}}", Owner: "alice"}
+	shared := &Snippet{Name: "load", Content: "uptime", Team: "ops"}
+	assert.NoError(t, store.Create(mine))
+	assert.NoError(t, store.Create(shared))
+	assert.Equal(t, []string{"path"}, mine.Params)
+
+	// reopening reads the file back
+	store, err = NewFileStore(path)
+	assert.NoError(t, err)
+
+	list, err := store.List("alice", "ops")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	list, err = store.List("bob", "ops")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "load", list[0].Name)
+
+	assert.NoError(t, store.Delete(mine.Id))
+	_, err = store.Get(mine.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,180 @@
+package snippet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Store keeps snippets.
+type Store interface {
+	// List returns the snippets visible to user in team.
+	List(user, team string) ([]*Snippet, error)
+
+	Get(id string) (*Snippet, error)
+
+	// Create assigns the id of s and saves it.
+	Create(s *Snippet) error
+
+	Update(s *Snippet) error
+
+	Delete(id string) error
+}
+
+// FileStore is a Store backed by a JSON file, rewritten on every change.
+type FileStore struct {
+	path     string
+	snippets map[string]*Snippet
+	*sync.RWMutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:     path,
+		snippets: make(map[string]*Snippet),
+		RWMutex:  new(sync.RWMutex),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read snippet file: %w", err)
+	}
+
+	var list []*Snippet
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse snippet file: %w", err)
+	}
+	for _, sn := range list {
+		s.snippets[sn.Id] = sn
+	}
+	return s, nil
+}
+
+func (s *FileStore) List(user, team string) ([]*Snippet, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := []*Snippet{}
+	for _, sn := range s.snippets {
+		if sn.Visible(user, team) {
+			c := *sn
+			list = append(list, &c)
+		}
+	}
+	slices.SortFunc(list, func(a, b *Snippet) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list, nil
+}
+
+func (s *FileStore) Get(id string) (*Snippet, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	sn, ok := s.snippets[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *sn
+	return &c, nil
+}
+
+func (s *FileStore) Create(sn *Snippet) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sn.Id = uuid.NewString()
+	sn.Params = Params(sn.Content)
+	sn.UpdatedAt = time.Now().Unix()
+
+	c := *sn
+	s.snippets[sn.Id] = &c
+	if err := s.save(); err != nil {
+		delete(s.snippets, sn.Id)
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Update(sn *Snippet) error {
+	s.Lock()
+	defer s.Unlock()
+
+	old, ok := s.snippets[sn.Id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	sn.Params = Params(sn.Content)
+	sn.UpdatedAt = time.Now().Unix()
+
+	c := *sn
+	s.snippets[sn.Id] = &c
+	if err := s.save(); err != nil {
+		s.snippets[sn.Id] = old
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	old, ok := s.snippets[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.snippets, id)
+	if err := s.save(); err != nil {
+		s.snippets[id] = old
+		return err
+	}
+	return nil
+}
+
+// save writes all snippets to a temporary file and renames it over the
+// store, so a crash never leaves a truncated file. The caller holds the lock.
+func (s *FileStore) save() error {
+	list := make([]*Snippet, 0, len(s.snippets))
+	for _, sn := range s.snippets {
+		list = append(list, sn)
+	}
+	slices.SortFunc(list, func(a, b *Snippet) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save snippets: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save snippets: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save snippets: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save snippets: %w", err)
+	}
+	return nil
+}
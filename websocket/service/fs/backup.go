@@ -0,0 +1,160 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	backupNone = "none"
+	// name.bak, replaced on every save
+	backupBak = "bak"
+	// name.20060102-150405.bak, the newest Keep of them are kept
+	backupTimestamp = "timestamp"
+
+	backupTimeFormat = "20060102-150405"
+)
+
+// backupRule says how saves back up files in Dir and below.
+type backupRule struct {
+	Dir  string `json:"dir"`
+	Mode string `json:"mode"`
+	// Keep is the number of timestamped backups kept, 0 keeps all.
+	Keep int `json:"keep,omitempty"`
+}
+
+// ruleFor returns the rule of the deepest directory holding p, which uses
+// slashes.
+func ruleFor(rules []backupRule, p string) backupRule {
+	best := backupRule{Mode: backupNone}
+	bestLen := -1
+	for _, rule := range rules {
+		dir := strings.TrimSuffix(rule.Dir, "/")
+		if p != dir && !strings.HasPrefix(p, dir+"/") {
+			continue
+		}
+		if len(dir) > bestLen {
+			best, bestLen = rule, len(dir)
+		}
+	}
+	return best
+}
+
+// backupStore is what a file system offers to keep backups.
+type backupStore interface {
+	copyFile(src, dst string) error
+	readDir(dir string) ([]string, error)
+	remove(p string) error
+	split(p string) (dir, name string)
+	join(dir, name string) string
+}
+
+// backup copies the file at p as rule says, before it is replaced.
+func backup(st backupStore, p string, rule backupRule, now time.Time) error {
+	switch rule.Mode {
+	case backupBak:
+		return st.copyFile(p, p+".bak")
+	case backupTimestamp:
+		if err := st.copyFile(p, fmt.Sprintf("%s.%s.bak", p, now.Format(backupTimeFormat))); err != nil {
+			return err
+		}
+		if rule.Keep > 0 {
+			return pruneBackups(st, p, rule.Keep)
+		}
+	}
+	return nil
+}
+
+// pruneBackups removes the oldest timestamped backups of p beyond keep.
+func pruneBackups(st backupStore, p string, keep int) error {
+	dir, name := st.split(p)
+	names, err := st.readDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, n := range names {
+		stamp, ok := strings.CutPrefix(n, name+".")
+		if !ok {
+			continue
+		}
+		stamp, ok = strings.CutSuffix(stamp, ".bak")
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, n)
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	// the timestamps sort in time order
+	slices.Sort(backups)
+	for _, n := range backups[:len(backups)-keep] {
+		if err := st.remove(st.join(dir, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type localBackups struct{}
+
+func (localBackups) copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// an existing backup keeps its mode, and a new one loses bits to umask
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (localBackups) readDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+func (localBackups) remove(p string) error {
+	return os.Remove(p)
+}
+
+func (localBackups) split(p string) (string, string) {
+	return filepath.Dir(p), filepath.Base(p)
+}
+
+func (localBackups) join(dir, name string) string {
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSFTPFileSystem serves the local file system over an in-process SFTP
+// server.
+func newTestSFTPFileSystem(t *testing.T) *SFTPFileSystem {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	return &SFTPFileSystem{
+		Client:    client,
+		Logger:    log.New(io.Discard, "", 0),
+		separator: "/",
+	}
+}
+
+func TestRuleFor(t *testing.T) {
+	rules := []backupRule{
+		{Dir: "/", Mode: backupBak},
+		{Dir: "/etc/", Mode: backupTimestamp, Keep: 3},
+		{Dir: "/etc/ssl", Mode: backupNone},
+	}
+	assert.Equal(t, backupBak, ruleFor(rules, "/home/a.txt").Mode)
+	assert.Equal(t, 3, ruleFor(rules, "/etc/hosts").Keep)
+	assert.Equal(t, backupNone, ruleFor(rules, "/etc/ssl/openssl.cnf").Mode)
+	assert.Equal(t, backupBak, ruleFor(rules, "/etcetera").Mode)
+	assert.Equal(t, backupNone, ruleFor(nil, "/etc/hosts").Mode)
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "app.conf")
+	require.NoError(t, os.WriteFile(p, []byte("v1"), 0644))
+
+	require.NoError(t, backup(localBackups{}, p, backupRule{Mode: backupBak}, time.Now()))
+	data, _ := os.ReadFile(p + ".bak")
+	assert.Equal(t, "v1", string(data))
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rule := backupRule{Mode: backupTimestamp, Keep: 2}
+	for i := range 3 {
+		require.NoError(t, backup(localBackups{}, p, rule, start.Add(time.Duration(i)*time.Hour)))
+	}
+	_, err := os.Stat(p + ".20260102-030405.bak")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.FileExists(t, p+".20260102-040405.bak")
+	assert.FileExists(t, p+".20260102-050405.bak")
+	assert.FileExists(t, p+".bak")
+}
+
+func TestAtomicWrite(t *testing.T) {
+	backupRules = []backupRule{{Dir: "/", Mode: backupBak}}
+	defer func() { backupRules = nil }()
+
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := filepath.Join(dir, "run.sh")
+			require.NoError(t, os.WriteFile(p, []byte("echo 1\n"), 0750))
+			require.NoError(t, os.Symlink(p, filepath.Join(dir, "link")))
+
+			info, err := fs.WriteFile(filepath.Join(dir, "link"), []byte("echo 2\n"))
+			require.NoError(t, err)
+			assert.Equal(t, int64(7), info.Size())
+
+			data, _ := os.ReadFile(p)
+			assert.Equal(t, "echo 2\n", string(data))
+			data, _ = os.ReadFile(p + ".bak")
+			assert.Equal(t, "echo 1\n", string(data))
+
+			// mode and link are kept, no temporary file is left
+			st, err := os.Stat(p)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), st.Mode().Perm())
+			lst, err := os.Lstat(filepath.Join(dir, "link"))
+			require.NoError(t, err)
+			assert.NotZero(t, lst.Mode()&os.ModeSymlink)
+			entries, _ := os.ReadDir(dir)
+			assert.Len(t, entries, 3)
+
+			// backups are no more readable than the file
+			st, err = os.Stat(p + ".bak")
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), st.Mode().Perm())
+			require.NoError(t, os.Chmod(p, 0600))
+			_, err = fs.WriteFile(p, []byte("echo 3\n"))
+			require.NoError(t, err)
+			st, err = os.Stat(p + ".bak")
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+			// new files
+			_, err = fs.WriteFile(filepath.Join(dir, "new.txt"), []byte("x"))
+			require.NoError(t, err)
+			assert.NoFileExists(t, filepath.Join(dir, "new.txt.bak"))
+		})
+	}
+}
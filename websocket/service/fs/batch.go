@@ -0,0 +1,137 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// id names the request, data is a batchData; the reply is a batchResult
+	// under the same action, sent once every item is done
+	actionBatchDelete = "batch_delete"
+	actionBatchCopy   = "batch_copy"
+	actionBatchMove   = "batch_move"
+	actionBatchChmod  = "batch_chmod"
+)
+
+type batchData struct {
+	Paths []string `json:"paths"`
+	// copy and move
+	Dest     string `json:"dest,omitempty"`
+	Conflict string `json:"conflict,omitempty"`
+	// chmod
+	Mode      uint32 `json:"mode,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+	// delete
+	Permanent bool `json:"permanent,omitempty"`
+	jobData
+}
+
+type batchItem struct {
+	Path    string `json:"path"`
+	Skipped bool   `json:"skipped,omitempty"`
+	// Dest is where copies and moves ended up.
+	Dest  string `json:"dest,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Data holds the details of errors with a code, as in single requests.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type batchResult struct {
+	Items []batchItem `json:"items"`
+}
+
+// runBatch applies the batch action to every path of d, and returns how
+// each went.
+func (s *FSService) runBatch(ctx context.Context, action string, d *batchData, p *progress) []batchItem {
+	items := make([]batchItem, len(d.Paths))
+	for i, path := range d.Paths {
+		items[i].Path = path
+	}
+	if action == actionBatchDelete && !d.Permanent {
+		s.purgeOldTrash(ctx)
+	}
+	if action == actionBatchChmod && !d.Recursive {
+		// recursive changes count the entries they walk
+		p.addTotal(int64(len(d.Paths)), 0)
+	}
+
+	for i, path := range d.Paths {
+		item := &items[i]
+		if ctx.Err() != nil {
+			s.batchError(item, &CanceledError{Code: CodeCanceled, Job: d.Job})
+			continue
+		}
+
+		var err error
+		switch action {
+		case actionBatchDelete:
+			if d.Permanent {
+				err = s.FS.Delete(ctx, path, p)
+			} else {
+				err = s.FS.Trash(ctx, path, p)
+			}
+		case actionBatchChmod:
+			err = s.FS.Chmod(path, unixMode(d.Mode), d.Recursive, p)
+		case actionBatchCopy:
+			item.Dest, err = s.FS.Copy(ctx, path, d.Dest, d.Conflict, p)
+			item.Skipped = err == nil && item.Dest == ""
+		case actionBatchMove:
+			item.Dest, err = s.FS.Move(ctx, path, d.Dest, d.Conflict, p)
+			item.Skipped = err == nil && item.Dest == ""
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = &CanceledError{Code: CodeCanceled, Job: d.Job}
+			}
+			s.batchError(item, err)
+		}
+	}
+	return items
+}
+
+func (s *FSService) batchError(item *batchItem, err error) {
+	item.Error = err.Error()
+	item.Data = errorData(err)
+}
+
+func (s *FSService) handleBatch(id, action string, data json.RawMessage) {
+	var d batchData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("error unmarshalling fs %s payload: %v", action, err)
+		return
+	}
+	conflict, err := checkConflictPolicy(d.Conflict)
+	if err != nil {
+		s.handleError(id, action, err)
+		return
+	}
+	d.Conflict = conflict
+	if d.Job == "" {
+		d.Job = id
+	}
+
+	var res batchResult
+	err = s.runJob(action, id, d.jobData, func(ctx context.Context, p *progress) error {
+		res.Items = s.runBatch(ctx, action, &d, p)
+		return nil
+	})
+	if err != nil {
+		s.handleError(id, action, err)
+		return
+	}
+
+	r, err := json.Marshal(res)
+	if err != nil {
+		s.Printf("error marshalling %s response: %v", action, err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  action,
+		Data:    r,
+	})
+}
@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"webshell/service/sandbox"
+)
+
+func TestBatch(t *testing.T) {
+	roots := sandbox.LocalRoots
+	t.Cleanup(func() { sandbox.LocalRoots = roots })
+	sftpFS := newTestSFTPFileSystem(t)
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  sftpFS,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &FSService{FS: fs, Logger: log.New(io.Discard, "", 0)}
+			root := t.TempDir()
+			// overwritten files go to the trash of the root
+			sandbox.LocalRoots = []string{root}
+			sftpFS.roots = []string{root}
+			ctx := context.Background()
+
+			src, dest := filepath.Join(root, "src"), filepath.Join(root, "dest")
+			require.NoError(t, os.MkdirAll(filepath.Join(src, "dir"), 0755))
+			require.NoError(t, os.Mkdir(dest, 0755))
+			for _, p := range []string{filepath.Join(src, "a"), filepath.Join(src, "b"), filepath.Join(dest, "a")} {
+				require.NoError(t, os.WriteFile(p, []byte(p), 0644))
+			}
+			a, b, missing := filepath.Join(src, "a"), filepath.Join(src, "b"), filepath.Join(src, "missing")
+			read := func(p string) string {
+				data, _ := os.ReadFile(p)
+				return string(data)
+			}
+
+			// one failure does not stop the others
+			var p progress
+			items := s.runBatch(ctx, actionBatchMove, &batchData{Paths: []string{a, missing, filepath.Join(src, "dir")}, Dest: dest, Conflict: conflictSkip}, &p)
+			require.Len(t, items, 3)
+			assert.True(t, items[0].Skipped)
+			assert.NotEmpty(t, items[1].Error)
+			assert.Empty(t, items[2].Error)
+			assert.Equal(t, int64(1), p.files.Load())
+			assert.FileExists(t, a)
+			assert.Equal(t, filepath.Join(dest, "a"), read(filepath.Join(dest, "a")))
+			assert.DirExists(t, filepath.Join(dest, "dir"))
+
+			items = s.runBatch(ctx, actionBatchMove, &batchData{Paths: []string{a}, Dest: dest, Conflict: conflictRename}, nil)
+			assert.Empty(t, items[0].Error)
+			assert.Equal(t, a, read(filepath.Join(dest, "a copy")))
+
+			require.NoError(t, os.WriteFile(a, []byte("new"), 0644))
+			items = s.runBatch(ctx, actionBatchMove, &batchData{Paths: []string{a}, Dest: dest, Conflict: conflictOverwrite}, nil)
+			assert.Empty(t, items[0].Error)
+			assert.Equal(t, filepath.Join(dest, "a"), items[0].Dest)
+			assert.Equal(t, "new", read(filepath.Join(dest, "a")))
+
+			// but never the source itself
+			items = s.runBatch(ctx, actionBatchMove, &batchData{Paths: []string{filepath.Join(dest, "a")}, Dest: dest, Conflict: conflictOverwrite}, nil)
+			assert.NotEmpty(t, items[0].Error)
+			assert.FileExists(t, filepath.Join(dest, "a"))
+			require.NoError(t, os.WriteFile(filepath.Join(dest, "b"), nil, 0644))
+
+			p = progress{}
+			items = s.runBatch(ctx, actionBatchChmod, &batchData{Paths: []string{filepath.Join(dest, "a"), filepath.Join(dest, "b")}, Mode: 0600}, &p)
+			assert.Empty(t, items[0].Error)
+			assert.Empty(t, items[1].Error)
+			assert.Equal(t, int64(2), p.filesTotal.Load())
+			assert.Equal(t, int64(2), p.files.Load())
+			info, err := os.Stat(filepath.Join(dest, "b"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+			// recursive changes count every entry below
+			require.NoError(t, os.WriteFile(filepath.Join(dest, "dir", "f"), nil, 0644))
+			p = progress{}
+			items = s.runBatch(ctx, actionBatchChmod, &batchData{Paths: []string{filepath.Join(dest, "dir")}, Mode: 0700, Recursive: true}, &p)
+			assert.Empty(t, items[0].Error)
+			assert.Equal(t, int64(2), p.filesTotal.Load())
+			assert.Equal(t, int64(2), p.files.Load())
+
+			items = s.runBatch(ctx, actionBatchDelete, &batchData{Paths: []string{filepath.Join(dest, "a"), filepath.Join(dest, "dir")}, Permanent: true}, nil)
+			assert.Empty(t, items[0].Error)
+			assert.Empty(t, items[1].Error)
+			assert.NoFileExists(t, filepath.Join(dest, "a"))
+			assert.NoDirExists(t, filepath.Join(dest, "dir"))
+
+			// stopped batches report what was not done
+			items = s.runBatch(newCountdownContext(0), actionBatchDelete, &batchData{Paths: []string{b}, jobData: jobData{Job: "j"}}, nil)
+			assert.JSONEq(t, `{"code":"canceled","job":"j"}`, string(items[0].Data))
+			assert.FileExists(t, b)
+		})
+	}
+}
+
+func TestLocalBatchCopy(t *testing.T) {
+	fs := &LocalFileSystem{Logger: log.New(io.Discard, "", 0)}
+	s := &FSService{FS: fs, Logger: fs.Logger}
+	src, dest := newCopyTree(t), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "a"), []byte("old"), 0644))
+
+	var p progress
+	paths := []string{filepath.Join(src, "a"), filepath.Join(src, "missing"), filepath.Join(src, "sub")}
+	items := s.runBatch(context.Background(), actionBatchCopy, &batchData{Paths: paths, Dest: dest, Conflict: conflictSkip}, &p)
+	require.Len(t, items, 3)
+	assert.True(t, items[0].Skipped)
+	assert.NotEmpty(t, items[1].Error)
+	assert.Empty(t, items[2].Error)
+	assert.FileExists(t, filepath.Join(dest, "sub", "big"))
+	assert.Equal(t, int64(2), p.files.Load())
+
+	items = s.runBatch(context.Background(), actionBatchCopy, &batchData{Paths: paths[:1], Dest: dest, Conflict: conflictRename}, nil)
+	assert.Empty(t, items[0].Error)
+	data, _ := os.ReadFile(filepath.Join(dest, "a copy"))
+	assert.Equal(t, "hello", string(data))
+}
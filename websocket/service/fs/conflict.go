@@ -0,0 +1,210 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// what copies and moves do when the destination exists
+
+	// conflictFail fails with an ExistsError
+	conflictFail = "fail"
+	// conflictOverwrite replaces the destination, which goes to the trash
+	conflictOverwrite = "overwrite"
+	// conflictSkip leaves both as they are
+	conflictSkip = "skip"
+	// conflictRename picks a free name: "a copy", "a copy 2", ...
+	conflictRename = "rename"
+	// conflictMerge merges directories into each other, files found on both
+	// sides are overwritten as above
+	conflictMerge = "merge"
+
+	CodeExists = "exists"
+)
+
+// ExistsError reports a copy or move whose destination exists.
+type ExistsError struct {
+	Code string `json:"code"`
+	Path string `json:"path"`
+}
+
+func (e *ExistsError) Error() string {
+	return fmt.Sprintf("目标路径已存在: %s", e.Path)
+}
+
+// checkConflictPolicy returns the policy to use for the one a client sent,
+// renaming when none was given.
+func checkConflictPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return conflictRename, nil
+	case conflictFail, conflictOverwrite, conflictSkip, conflictRename, conflictMerge:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy: %s", policy)
+}
+
+// transferStore is a file system copies and moves work on.
+type transferStore interface {
+	lstat(p string) (os.FileInfo, error)
+	readDir(dir string) ([]os.FileInfo, error)
+	// move renames oldPath to newPath, counting one file.
+	move(ctx context.Context, oldPath, newPath string, p *progress) error
+	removeAll(ctx context.Context, p string, prog *progress) error
+	join(elem ...string) string
+	// copyTree copies src, which has the given info, to dst, which does not
+	// exist, counting the work in p.
+	copyTree(ctx context.Context, src, dst string, info os.FileInfo, p *progress) error
+	// trash moves p to the trash, and returns how to restore it.
+	trash(ctx context.Context, p string) (restore func() error, err error)
+}
+
+// transfer copies or moves src, which has the given info, into the
+// directory dest, resolving a conflict with policy. It returns where src
+// ended up, or "" when it was skipped.
+func transfer(ctx context.Context, st transferStore, src, dest string, info os.FileInfo, policy string, move bool, p *progress) (string, error) {
+	policy, err := checkConflictPolicy(policy)
+	if err != nil {
+		return "", err
+	}
+
+	src, dest = st.join(src), st.join(dest)
+	if info.IsDir() && within(dest, src) {
+		return "", fmt.Errorf("cannot copy or move a directory into itself: %s", src)
+	}
+
+	target := st.join(dest, info.Name())
+	existing, err := st.lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return target, place(ctx, st, src, target, info, move, p)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch policy {
+	case conflictFail:
+		return "", &ExistsError{Code: CodeExists, Path: target}
+	case conflictSkip:
+		return "", nil
+	case conflictRename:
+		if target, err = freeName(st, dest, info.Name()); err != nil {
+			return "", err
+		}
+	case conflictOverwrite, conflictMerge:
+		if within(src, target) {
+			return "", fmt.Errorf("source and destination are the same: %s", target)
+		}
+		if policy == conflictMerge && info.IsDir() && existing.IsDir() {
+			return target, merge(ctx, st, src, target, move, p)
+		}
+		return target, replace(ctx, st, src, target, info, move, p)
+	}
+	return target, place(ctx, st, src, target, info, move, p)
+}
+
+// replace puts src in place of target, which goes to the trash. A failed
+// copy or move brings target back.
+func replace(ctx context.Context, st transferStore, src, target string, info os.FileInfo, move bool, p *progress) error {
+	restore, err := st.trash(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to move %s to the trash: %w", target, err)
+	}
+	if err := place(ctx, st, src, target, info, move, p); err != nil {
+		if restoreErr := restore(); restoreErr != nil {
+			return fmt.Errorf("%w, and %s could not be restored from the trash: %v", err, target, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// place copies or moves src to target, which does not exist. Failed copies
+// leave nothing behind.
+func place(ctx context.Context, st transferStore, src, target string, info os.FileInfo, move bool, p *progress) error {
+	if move {
+		return st.move(ctx, src, target, p)
+	}
+	if err := st.copyTree(ctx, src, target, info, p); err != nil {
+		// 只清理自己创建的目标
+		if _, statErr := st.lstat(target); statErr == nil {
+			st.removeAll(context.Background(), target, nil)
+		}
+		return err
+	}
+	return nil
+}
+
+// merge copies or moves everything in the directory src into the directory
+// dst, merging the directories found in both.
+func merge(ctx context.Context, st transferStore, src, dst string, move bool, p *progress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := st.readDir(src)
+	if err != nil {
+		return err
+	}
+	p.addTotal(1, 0)
+	for _, info := range entries {
+		from, to := st.join(src, info.Name()), st.join(dst, info.Name())
+		existing, err := st.lstat(to)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return err
+		case info.IsDir() && existing.IsDir():
+			if err := merge(ctx, st, from, to, move, p); err != nil {
+				return err
+			}
+			continue
+		default:
+			if err := replace(ctx, st, from, to, info, move, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := place(ctx, st, from, to, info, move, p); err != nil {
+			return err
+		}
+	}
+	if move {
+		// 内容已全部移走
+		if err := st.removeAll(ctx, src, nil); err != nil {
+			return err
+		}
+	}
+	p.add(1, 0)
+	return nil
+}
+
+// within reports whether the clean path p is dir or below it.
+func within(p, dir string) bool {
+	if !strings.HasPrefix(p, dir) {
+		return false
+	}
+	rel := p[len(dir):]
+	isSep := func(c byte) bool { return c == '/' || c == os.PathSeparator }
+	return rel == "" || isSep(rel[0]) || (dir != "" && isSep(dir[len(dir)-1]))
+}
+
+// freeName returns the first of "name copy", "name copy 2", ... not in dir.
+func freeName(st transferStore, dir, name string) (string, error) {
+	for n := 1; ; n++ {
+		candidate := name + " copy"
+		if n > 1 {
+			candidate += " " + strconv.Itoa(n)
+		}
+		p := st.join(dir, candidate)
+		if _, err := st.lstat(p); errors.Is(err, os.ErrNotExist) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"webshell/service/sandbox"
+)
+
+// newConflictTree creates a directory d to copy or move into dest, where
+// another d is in the way, and returns both parents. Their root is the one
+// root of both file systems, whose trash keeps what is overwritten.
+func newConflictTree(t *testing.T, sftpFS *SFTPFileSystem) (src, dest string) {
+	root := t.TempDir()
+	sandbox.LocalRoots = []string{root}
+	sftpFS.roots = []string{root}
+	src, dest = filepath.Join(root, "src"), filepath.Join(root, "dest")
+	for p, data := range map[string]string{
+		filepath.Join(src, "d", "x"):         "new",
+		filepath.Join(src, "d", "sub", "y"):  "new",
+		filepath.Join(dest, "d", "x"):        "old",
+		filepath.Join(dest, "d", "z"):        "old",
+		filepath.Join(dest, "d", "sub", "w"): "old",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(data), 0644))
+	}
+	return src, dest
+}
+
+func TestConflictPolicies(t *testing.T) {
+	roots := sandbox.LocalRoots
+	t.Cleanup(func() { sandbox.LocalRoots = roots })
+	local := &LocalFileSystem{Logger: log.New(io.Discard, "", 0)}
+	sftpFS := newTestSFTPFileSystem(t)
+	for name, tc := range map[string]struct {
+		fs   FileSystem
+		move bool
+	}{
+		"local copy": {fs: local},
+		"local move": {fs: local, move: true},
+		"sftp copy":  {fs: sftpFS},
+		"sftp move":  {fs: sftpFS, move: true},
+	} {
+		transfer := tc.fs.Copy
+		if tc.move {
+			transfer = tc.fs.Move
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			read := func(p string) string {
+				data, _ := os.ReadFile(p)
+				return string(data)
+			}
+			srcLeft := func(t *testing.T, src string) {
+				if tc.move {
+					assert.NoDirExists(t, filepath.Join(src, "d"))
+				} else {
+					assert.FileExists(t, filepath.Join(src, "d", "x"))
+				}
+			}
+
+			t.Run("fail", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				_, err := transfer(ctx, filepath.Join(src, "d"), dest, conflictFail, nil)
+				var existsErr *ExistsError
+				require.ErrorAs(t, err, &existsErr)
+				assert.Equal(t, CodeExists, existsErr.Code)
+				assert.Equal(t, filepath.Join(dest, "d"), existsErr.Path)
+				assert.DirExists(t, filepath.Join(src, "d"))
+			})
+
+			t.Run("skip", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				target, err := transfer(ctx, filepath.Join(src, "d"), dest, conflictSkip, nil)
+				require.NoError(t, err)
+				assert.Empty(t, target)
+				assert.DirExists(t, filepath.Join(src, "d"))
+				assert.Equal(t, "old", read(filepath.Join(dest, "d", "x")))
+			})
+
+			t.Run("rename", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				require.NoError(t, os.Mkdir(filepath.Join(dest, "d copy"), 0755))
+				target, err := transfer(ctx, filepath.Join(src, "d"), dest, conflictRename, nil)
+				require.NoError(t, err)
+				assert.Equal(t, filepath.Join(dest, "d copy 2"), target)
+				assert.Equal(t, "new", read(filepath.Join(target, "sub", "y")))
+				assert.Equal(t, "old", read(filepath.Join(dest, "d", "x")))
+				srcLeft(t, src)
+			})
+
+			t.Run("overwrite", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				target, err := transfer(ctx, filepath.Join(src, "d"), dest, conflictOverwrite, nil)
+				require.NoError(t, err)
+				assert.Equal(t, filepath.Join(dest, "d"), target)
+				assert.Equal(t, "new", read(filepath.Join(target, "x")))
+				assert.NoFileExists(t, filepath.Join(target, "z"))
+				assert.NoFileExists(t, filepath.Join(target, "sub", "w"))
+				srcLeft(t, src)
+
+				// the old one is in the trash
+				entries, err := tc.fs.TrashList()
+				require.NoError(t, err)
+				require.Len(t, entries, 1)
+				assert.Equal(t, target, entries[0].Path)
+				assert.Equal(t, "old", read(filepath.Join(entries[0].Id, "z")))
+			})
+
+			t.Run("overwrite fails", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				_, err := transfer(newCountdownContext(3), filepath.Join(src, "d"), dest, conflictOverwrite, nil)
+				if tc.move {
+					// a rename does not look at the context
+					require.NoError(t, err)
+					return
+				}
+				assert.Error(t, err)
+				assert.Equal(t, "old", read(filepath.Join(dest, "d", "x")))
+				assert.Equal(t, "old", read(filepath.Join(dest, "d", "z")))
+				entries, err := tc.fs.TrashList()
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			})
+
+			t.Run("merge", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				var p progress
+				target, err := transfer(ctx, filepath.Join(src, "d"), dest, conflictMerge, &p)
+				require.NoError(t, err)
+				assert.Equal(t, filepath.Join(dest, "d"), target)
+				assert.Equal(t, "new", read(filepath.Join(target, "x")))
+				assert.Equal(t, "new", read(filepath.Join(target, "sub", "y")))
+				assert.Equal(t, "old", read(filepath.Join(target, "z")))
+				assert.Equal(t, "old", read(filepath.Join(target, "sub", "w")))
+				assert.Equal(t, p.filesTotal.Load(), p.files.Load())
+				srcLeft(t, src)
+			})
+
+			t.Run("merge into a file", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				require.NoError(t, os.RemoveAll(filepath.Join(dest, "d")))
+				require.NoError(t, os.WriteFile(filepath.Join(dest, "d"), nil, 0644))
+				_, err := transfer(ctx, filepath.Join(src, "d"), dest, conflictMerge, nil)
+				require.NoError(t, err)
+				assert.Equal(t, "new", read(filepath.Join(dest, "d", "x")))
+			})
+
+			t.Run("same path", func(t *testing.T) {
+				src, _ := newConflictTree(t, sftpFS)
+				for _, policy := range []string{conflictOverwrite, conflictMerge} {
+					_, err := transfer(ctx, filepath.Join(src, "d"), src, policy, nil)
+					assert.Error(t, err)
+					assert.FileExists(t, filepath.Join(src, "d", "x"))
+				}
+				_, err := transfer(ctx, src, filepath.Join(src, "d"), conflictRename, nil)
+				assert.Error(t, err)
+			})
+
+			t.Run("unknown policy", func(t *testing.T) {
+				src, dest := newConflictTree(t, sftpFS)
+				_, err := transfer(ctx, filepath.Join(src, "d"), dest, "replace", nil)
+				assert.Error(t, err)
+				assert.DirExists(t, filepath.Join(src, "d"))
+			})
+		})
+	}
+}
+
+func TestWithin(t *testing.T) {
+	assert.True(t, within("/a/b", "/a"))
+	assert.True(t, within("/a", "/a"))
+	assert.True(t, within("/a", "/"))
+	assert.False(t, within("/ab", "/a"))
+	assert.False(t, within("/a", "/a/b"))
+}
@@ -0,0 +1,359 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+
+	"webshell/utils"
+	ws "webshell/websocket"
+)
+
+const (
+	actionRead  = "read"
+	actionWrite = "write"
+
+	CodeConflict    = "conflict"
+	CodeTooLarge    = "too_large"
+	CodeUnencodable = "unencodable"
+
+	// bytes looked at for NUL bytes, as git does
+	binarySniffLength = 8000
+)
+
+type readData struct {
+	// req: decode with this charset instead of guessing
+	Encoding string `json:"encoding,omitempty"`
+	// res
+	Content *string `json:"content,omitempty"`
+	Binary  bool    `json:"binary"`
+	fileVersion
+}
+
+type writeData struct {
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"`
+	// Base is the version the content was edited from, empty for a new
+	// file. The write fails with a ConflictError if the file changed since.
+	Base *fileVersion `json:"base,omitempty"`
+	// Force writes whatever the file holds now.
+	Force bool `json:"force,omitempty"`
+}
+
+// fileVersion identifies the content of a file.
+type fileVersion struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Hash    string `json:"hash"`
+}
+
+// ConflictError reports a write based on content that is no longer current.
+type ConflictError struct {
+	Code string `json:"code"`
+	// Current is the version the file has now, nil if it was removed.
+	Current *fileVersion `json:"current,omitempty"`
+}
+
+func (e *ConflictError) Error() string {
+	return "文件已被修改"
+}
+
+// TooLargeError reports a file over the editor limit.
+type TooLargeError struct {
+	Code string `json:"code"`
+	Size int64  `json:"size"`
+	Max  int64  `json:"max"`
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("文件过大: %d 字节, 最大 %d 字节", e.Size, e.Max)
+}
+
+// UnencodableError reports text the charset it is saved in cannot hold, so
+// the user can pick another one.
+type UnencodableError struct {
+	Code     string `json:"code"`
+	Encoding string `json:"encoding"`
+	Char     string `json:"char"`
+	// Line counts from 1.
+	Line int `json:"line"`
+}
+
+func (e *UnencodableError) Error() string {
+	return fmt.Sprintf("字符 %q 无法用 %s 保存 (第 %d 行)", e.Char, e.Encoding, e.Line)
+}
+
+func newVersion(data []byte, info os.FileInfo) fileVersion {
+	sum := sha256.Sum256(data)
+	return fileVersion{
+		Size:    int64(len(data)),
+		ModTime: info.ModTime().UnixMilli(),
+		Hash:    hex.EncodeToString(sum[:]),
+	}
+}
+
+// readLimited reads a file of the given info, up to maxSize bytes.
+func readLimited(r io.Reader, info os.FileInfo, maxSize int64) ([]byte, error) {
+	if info.IsDir() {
+		return nil, fmt.Errorf("path is a directory")
+	}
+	if info.Size() > maxSize {
+		return nil, &TooLargeError{Code: CodeTooLarge, Size: info.Size(), Max: maxSize}
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	// grown since the stat
+	if int64(len(data)) > maxSize {
+		return nil, &TooLargeError{Code: CodeTooLarge, Size: int64(len(data)), Max: maxSize}
+	}
+	return data, nil
+}
+
+// editorEncodings are the charsets only files have: their byte order marks
+// are kept when writing back. Shells and file names use the shared table.
+var editorEncodings = map[string]encoding.Encoding{
+	"utf-8-bom": unicode.UTF8BOM,
+	"utf-16le":  unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"utf-16be":  unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+}
+
+// lookupEditorEncoding is utils.LookupEncoding with the editorEncodings.
+func lookupEditorEncoding(name string) (encoding.Encoding, error) {
+	key := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "_", "-")
+	if enc, ok := editorEncodings[key]; ok {
+		return enc, nil
+	}
+	return utils.LookupEncoding(name)
+}
+
+// isBinary reports whether data looks like anything but text. UTF-16 text
+// has NUL bytes too, so callers check for its byte order mark first.
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLength {
+		data = data[:binarySniffLength]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// detectEncoding guesses the charset of text, trying hint before the
+// legacy charsets.
+func detectEncoding(data []byte, hint string) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8-bom"
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case utf8.Valid(data):
+		return "utf-8"
+	}
+
+	if hint != "" {
+		if enc, err := lookupEditorEncoding(hint); err == nil && enc != nil && decodesCleanly(enc, data) {
+			return hint
+		}
+	}
+	if decodesCleanly(simplifiedchinese.GB18030, data) {
+		return "gb18030"
+	}
+	// every byte is a latin1 character
+	return "latin1"
+}
+
+func decodesCleanly(enc encoding.Encoding, data []byte) bool {
+	decoded, err := enc.NewDecoder().Bytes(data)
+	return err == nil && !bytes.ContainsRune(decoded, utf8.RuneError)
+}
+
+func decodeText(data []byte, name string) (string, error) {
+	enc, err := lookupEditorEncoding(name)
+	if err != nil {
+		return "", err
+	}
+	if enc == nil {
+		return string(data), nil
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func encodeText(text string, name string) ([]byte, error) {
+	enc, err := lookupEditorEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return []byte(text), nil
+	}
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err == nil {
+		return data, nil
+	}
+
+	// find the first character to blame
+	line := 1
+	for _, r := range text {
+		if _, err := enc.NewEncoder().String(string(r)); err != nil {
+			return nil, &UnencodableError{Code: CodeUnencodable, Encoding: name, Char: string(r), Line: line}
+		}
+		if r == '\n' {
+			line++
+		}
+	}
+	return nil, err
+}
+
+// readFile returns the text of the file at path for the editor.
+func (s *FSService) readFile(path string, d *readData) error {
+	data, info, err := s.FS.ReadFile(path, editorMaxSize)
+	if err != nil {
+		return err
+	}
+	d.fileVersion = newVersion(data, info)
+
+	name := d.Encoding
+	if name == "" {
+		isUTF16 := bytes.HasPrefix(data, []byte{0xff, 0xfe}) || bytes.HasPrefix(data, []byte{0xfe, 0xff})
+		if !isUTF16 && isBinary(data) {
+			d.Binary = true
+			return nil
+		}
+		name = detectEncoding(data, s.Encoding)
+	}
+
+	text, err := decodeText(data, name)
+	if err != nil {
+		return err
+	}
+	d.Encoding = name
+	d.Content = &text
+	return nil
+}
+
+// writeFile saves the text of the editor to path, unless the file changed
+// since it was read.
+func (s *FSService) writeFile(path string, d *writeData) (*fileVersion, error) {
+	data, err := encodeText(d.Content, d.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > editorMaxSize {
+		return nil, &TooLargeError{Code: CodeTooLarge, Size: int64(len(data)), Max: editorMaxSize}
+	}
+
+	if !d.Force {
+		if err := s.checkVersion(path, d.Base); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := s.FS.WriteFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	v := newVersion(data, info)
+	return &v, nil
+}
+
+func (s *FSService) checkVersion(path string, base *fileVersion) error {
+	current, info, err := s.FS.ReadFile(path, editorMaxSize)
+	if errors.Is(err, os.ErrNotExist) {
+		if base == nil {
+			return nil
+		}
+		return &ConflictError{Code: CodeConflict}
+	}
+
+	var tooLarge *TooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		// cannot be hashed, the size tells it changed
+		if base == nil || base.Size != tooLarge.Size {
+			return &ConflictError{Code: CodeConflict}
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+
+	v := newVersion(current, info)
+	if base == nil {
+		return &ConflictError{Code: CodeConflict, Current: &v}
+	}
+	if base.Hash != "" && base.Hash != v.Hash || base.Hash == "" && base.ModTime != v.ModTime {
+		return &ConflictError{Code: CodeConflict, Current: &v}
+	}
+	return nil
+}
+
+func (s *FSService) handleRead(id string, data json.RawMessage) {
+	var d readData
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.Printf("error unmarshalling fs read payload: %v", err)
+			return
+		}
+	}
+
+	if err := s.readFile(id, &d); err != nil {
+		s.handleError(id, actionRead, err)
+		return
+	}
+
+	r, err := json.Marshal(d)
+	if err != nil {
+		s.Printf("error marshalling read response: %v", err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionRead,
+		Data:    r,
+	})
+}
+
+func (s *FSService) handleWrite(id string, data json.RawMessage) {
+	var d writeData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("error unmarshalling fs write payload: %v", err)
+		return
+	}
+
+	v, err := s.writeFile(id, &d)
+	if err != nil {
+		s.handleError(id, actionWrite, err)
+		return
+	}
+
+	r, err := json.Marshal(v)
+	if err != nil {
+		s.Printf("error marshalling write response: %v", err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionWrite,
+		Data:    r,
+	})
+}
@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	assert.Equal(t, "utf-8", detectEncoding([]byte("héllo"), ""))
+	assert.Equal(t, "utf-8-bom", detectEncoding([]byte("\xef\xbb\xbfhi"), ""))
+	assert.Equal(t, "utf-16le", detectEncoding([]byte("\xff\xfeh\x00"), ""))
+	// 你好 in GBK
+	assert.Equal(t, "gb18030", detectEncoding([]byte("\xc4\xe3\xba\xc3"), ""))
+	assert.Equal(t, "gbk", detectEncoding([]byte("\xc4\xe3\xba\xc3"), "gbk"))
+	assert.Equal(t, "latin1", detectEncoding([]byte("caf\xe9\xff"), ""))
+
+	assert.True(t, isBinary([]byte("\x7fELF\x02\x01\x01\x00")))
+	assert.False(t, isBinary([]byte("plain text\n")))
+}
+
+func TestReadWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	s := &FSService{FS: &LocalFileSystem{}}
+	p := filepath.Join(dir, "app.conf")
+
+	// a new file needs no base
+	v, err := s.writeFile(p, &writeData{Content: "port = 80\n"})
+	require.NoError(t, err)
+
+	// but an existing one does
+	_, err = s.writeFile(p, &writeData{Content: "port = 81\n"})
+	var conflictErr *ConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, v.Hash, conflictErr.Current.Hash)
+
+	var d readData
+	require.NoError(t, s.readFile(p, &d))
+	assert.Equal(t, "port = 80\n", *d.Content)
+	assert.Equal(t, "utf-8", d.Encoding)
+	assert.Equal(t, v.Hash, d.Hash)
+
+	v2, err := s.writeFile(p, &writeData{Content: "port = 81\n", Base: &d.fileVersion})
+	require.NoError(t, err)
+	assert.NotEqual(t, v.Hash, v2.Hash)
+
+	// saving again from the first version conflicts
+	_, err = s.writeFile(p, &writeData{Content: "port = 82\n", Base: &d.fileVersion})
+	require.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, v2.Hash, conflictErr.Current.Hash)
+
+	_, err = s.writeFile(p, &writeData{Content: "port = 82\n", Force: true})
+	assert.NoError(t, err)
+
+	// the charset is kept
+	gbk := filepath.Join(dir, "gbk.txt")
+	require.NoError(t, os.WriteFile(gbk, []byte("\xc4\xe3\xba\xc3"), 0644))
+	s.Encoding = "gbk"
+	d = readData{}
+	require.NoError(t, s.readFile(gbk, &d))
+	assert.Equal(t, "你好", *d.Content)
+	_, err = s.writeFile(gbk, &writeData{Content: "你好!", Encoding: d.Encoding, Base: &d.fileVersion})
+	require.NoError(t, err)
+	data, _ := os.ReadFile(gbk)
+	assert.Equal(t, []byte("\xc4\xe3\xba\xc3!"), data)
+
+	// what the charset cannot hold is not saved as "?"
+	_, err = s.writeFile(gbk, &writeData{Content: "café\n€ 5", Encoding: "latin1", Force: true})
+	var encodeErr *UnencodableError
+	require.ErrorAs(t, err, &encodeErr)
+	assert.Equal(t, UnencodableError{Code: CodeUnencodable, Encoding: "latin1", Char: "€", Line: 2}, *encodeErr)
+	data, _ = os.ReadFile(gbk)
+	assert.Equal(t, []byte("\xc4\xe3\xba\xc3!"), data)
+
+	bin := filepath.Join(dir, "bin")
+	require.NoError(t, os.WriteFile(bin, []byte{0x7f, 'E', 'L', 'F', 0}, 0644))
+	d = readData{}
+	require.NoError(t, s.readFile(bin, &d))
+	assert.True(t, d.Binary)
+	assert.Nil(t, d.Content)
+
+	big := filepath.Join(dir, "big")
+	require.NoError(t, os.WriteFile(big, make([]byte, editorMaxSize+1), 0644))
+	var tooLargeErr *TooLargeError
+	assert.ErrorAs(t, s.readFile(big, &readData{}), &tooLargeErr)
+}
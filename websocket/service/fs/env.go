@@ -1,35 +1,75 @@
 package fs
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
-	fsRoot = getEnvRoot()
+	// largest file the editor reads or writes, in bytes
+	editorMaxSize = int64(getEnvInt(editorMaxSizeName, 5<<20))
+	// how saves back up files, by directory
+	backupRules = getEnvBackupRules()
+	// directories watched per connection, 0 is unlimited
+	maxWatches = getEnvInt(maxWatchesName, 32)
+	// how often directories without change notification are listed
+	watchPollInterval = time.Duration(getEnvInt(watchPollIntervalName, 2)) * time.Second
+	// matches sent per search at most
+	searchMaxResults = getEnvInt(searchMaxResultsName, 1000)
+	// larger files are left out of content searches
+	searchMaxFileSize = int64(getEnvInt(searchMaxFileSizeName, 16<<20))
+	// trash items older than this are deleted, 0 keeps them
+	trashMaxAge = time.Duration(getEnvInt(trashDaysName, 30)) * 24 * time.Hour
 )
 
 const (
-	envName = "WEBSHELL_FS_ROOT"
+	editorMaxSizeName     = "WEBSHELL_EDITOR_MAX_SIZE"
+	backupRulesName       = "WEBSHELL_BACKUP_RULES"
+	maxWatchesName        = "WEBSHELL_FS_MAX_WATCHES"
+	watchPollIntervalName = "WEBSHELL_FS_POLL_INTERVAL"
+	searchMaxResultsName  = "WEBSHELL_FS_SEARCH_MAX_RESULTS"
+	searchMaxFileSizeName = "WEBSHELL_FS_SEARCH_MAX_FILE_SIZE"
+	trashDaysName         = "WEBSHELL_TRASH_DAYS"
 )
 
-func getEnvRoot() string {
-	if cwd := os.Getenv(envName); cwd == "" {
-		log.Printf("$%s not set, using home directory", envName)
+func getEnvInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value == "" {
+		log.Printf("$%s not set, default to %d", name, defaultValue)
 	} else {
-		_, err := os.Stat(cwd)
+		n, err := strconv.Atoi(value)
 		if err == nil {
-			return cwd
+			return n
 		}
-		log.Printf("$%s (%s) is not a valid path, using home directory", envName, cwd)
+		log.Printf("$%s (%v) is not a valid integer, default to %d", name, value, defaultValue)
 	}
 
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Printf("failed to get user home directory: %v", err)
-		log.Printf("using cwd as fallback")
-		return "."
+	return defaultValue
+}
+
+// getEnvBackupRules reads a JSON list of backupRule, such as
+// [{"dir":"/etc","mode":"timestamp","keep":10},{"dir":"/","mode":"bak"}].
+func getEnvBackupRules() []backupRule {
+	value := os.Getenv(backupRulesName)
+	if value == "" {
+		log.Printf("$%s not set, no backups are kept", backupRulesName)
+		return nil
 	}
 
-	return homeDir
+	var rules []backupRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		log.Printf("$%s is not a valid list of rules, no backups are kept: %v", backupRulesName, err)
+		return nil
+	}
+	for _, rule := range rules {
+		switch rule.Mode {
+		case backupNone, backupBak, backupTimestamp:
+		default:
+			log.Printf("$%s: unknown backup mode %q, no backups are kept", backupRulesName, rule.Mode)
+			return nil
+		}
+	}
+	return rules
 }
@@ -0,0 +1,250 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"webshell/service/sandbox"
+)
+
+// jailFileSystem checks every path given to a FileSystem against a jail.
+// New FileSystem methods must be added here too.
+type jailFileSystem struct {
+	fs   FileSystem
+	jail *sandbox.Jail
+	// converts paths to what the jail sees, such as another charset
+	convert func(string) string
+}
+
+func newJailFileSystem(fs FileSystem, jail *sandbox.Jail, convert func(string) string) *jailFileSystem {
+	return &jailFileSystem{fs: fs, jail: jail, convert: convert}
+}
+
+func (j *jailFileSystem) jailPath(p string) string {
+	if j.convert != nil {
+		return j.convert(p)
+	}
+	return p
+}
+
+func (j *jailFileSystem) check(paths ...string) error {
+	for _, p := range paths {
+		if err := j.jail.Check(j.jailPath(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLink checks paths acted on themselves, links included, rather than
+// through what they point to.
+func (j *jailFileSystem) checkLink(paths ...string) error {
+	for _, p := range paths {
+		if err := j.jail.CheckLink(j.jailPath(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRemove keeps the roots themselves in place.
+func (j *jailFileSystem) checkRemove(p string) error {
+	if j.jail.IsRoot(j.jailPath(p)) {
+		return fmt.Errorf("cannot remove a root directory: %s", p)
+	}
+	return nil
+}
+
+// checkName rejects names that would leave the parent directory.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("文件名不合法: %s", name)
+	}
+	return nil
+}
+
+func (j *jailFileSystem) GetRoot() ([]*FileSystemEntry, error) {
+	return j.fs.GetRoot()
+}
+
+func (j *jailFileSystem) List(p string, showHidden bool) ([]*FileSystemEntry, error) {
+	if err := j.check(p); err != nil {
+		return nil, err
+	}
+	return j.fs.List(p, showHidden)
+}
+
+func (j *jailFileSystem) Rename(oldPath, newName string) error {
+	if err := checkName(newName); err != nil {
+		return err
+	}
+	if err := j.checkLink(oldPath); err != nil {
+		return err
+	}
+	if err := j.check(path.Join(path.Dir(oldPath), newName)); err != nil {
+		return err
+	}
+	if err := j.checkRemove(oldPath); err != nil {
+		return err
+	}
+	return j.fs.Rename(oldPath, newName)
+}
+
+func (j *jailFileSystem) Create(parentPath, name string, isDir bool) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := j.check(parentPath, path.Join(parentPath, name)); err != nil {
+		return err
+	}
+	return j.fs.Create(parentPath, name, isDir)
+}
+
+func (j *jailFileSystem) Delete(ctx context.Context, p string, prog *progress) error {
+	if err := j.checkLink(p); err != nil {
+		return err
+	}
+	if err := j.checkRemove(p); err != nil {
+		return err
+	}
+	return j.fs.Delete(ctx, p, prog)
+}
+
+func (j *jailFileSystem) Copy(ctx context.Context, src, dest, policy string, p *progress) (string, error) {
+	if err := j.check(src, dest); err != nil {
+		return "", err
+	}
+	return j.fs.Copy(ctx, src, dest, policy, p)
+}
+
+func (j *jailFileSystem) Move(ctx context.Context, src, dest, policy string, p *progress) (string, error) {
+	if err := j.checkLink(src); err != nil {
+		return "", err
+	}
+	if err := j.check(dest); err != nil {
+		return "", err
+	}
+	if err := j.checkRemove(src); err != nil {
+		return "", err
+	}
+	return j.fs.Move(ctx, src, dest, policy, p)
+}
+
+func (j *jailFileSystem) ReadFile(p string, maxSize int64) ([]byte, os.FileInfo, error) {
+	if err := j.check(p); err != nil {
+		return nil, nil, err
+	}
+	return j.fs.ReadFile(p, maxSize)
+}
+
+func (j *jailFileSystem) WriteFile(p string, data []byte) (os.FileInfo, error) {
+	if err := j.check(p); err != nil {
+		return nil, err
+	}
+	return j.fs.WriteFile(p, data)
+}
+
+// Chmod and Chown leave links alone, so a link only needs to be in a root.
+func (j *jailFileSystem) Chmod(p string, mode os.FileMode, recursive bool, prog *progress) error {
+	if err := j.checkLink(p); err != nil {
+		return err
+	}
+	return j.fs.Chmod(p, mode, recursive, prog)
+}
+
+func (j *jailFileSystem) Chown(p, owner, group string, recursive bool) error {
+	if err := j.checkLink(p); err != nil {
+		return err
+	}
+	return j.fs.Chown(p, owner, group, recursive)
+}
+
+// Symlink also checks where the link points, relative targets from the
+// directory of the link.
+func (j *jailFileSystem) Symlink(target, linkPath string) error {
+	resolved := target
+	if !path.IsAbs(target) && !filepath.IsAbs(target) {
+		resolved = path.Join(path.Dir(linkPath), target)
+	}
+	if err := j.check(linkPath, resolved); err != nil {
+		return err
+	}
+	return j.fs.Symlink(target, linkPath)
+}
+
+func (j *jailFileSystem) ReadLink(p string) (string, error) {
+	if err := j.checkLink(p); err != nil {
+		return "", err
+	}
+	return j.fs.ReadLink(p)
+}
+
+func (j *jailFileSystem) Watch(p string, notify func(watchEvent)) (io.Closer, error) {
+	if err := j.check(p); err != nil {
+		return nil, err
+	}
+	return j.fs.Watch(p, notify)
+}
+
+func (j *jailFileSystem) Search(ctx context.Context, root string, q *searchQuery, found func(searchMatch) bool) error {
+	if err := j.check(root); err != nil {
+		return err
+	}
+	return j.fs.Search(ctx, root, q, found)
+}
+
+func (j *jailFileSystem) Trash(ctx context.Context, p string, prog *progress) error {
+	if err := j.checkLink(p); err != nil {
+		return err
+	}
+	if err := j.checkRemove(p); err != nil {
+		return err
+	}
+	return j.fs.Trash(ctx, p, prog)
+}
+
+// TrashList leaves out the items deleted from outside the roots.
+func (j *jailFileSystem) TrashList() ([]*trashEntry, error) {
+	entries, err := j.fs.TrashList()
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if j.check(e.Path) == nil {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// Restore checks where the item goes back to.
+func (j *jailFileSystem) Restore(id string) (string, error) {
+	entries, err := j.fs.TrashList()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.Id != id {
+			continue
+		}
+		if err := j.check(e.Path); err != nil {
+			return "", err
+		}
+		return j.fs.Restore(id)
+	}
+	return "", fmt.Errorf("not in the trash: %s", id)
+}
+
+// EmptyTrash only deletes the items deleted from inside the roots.
+func (j *jailFileSystem) EmptyTrash(ctx context.Context, before time.Time, match func(string) bool, p *progress) error {
+	return j.fs.EmptyTrash(ctx, before, func(orig string) bool {
+		return j.check(orig) == nil && (match == nil || match(orig))
+	}, p)
+}
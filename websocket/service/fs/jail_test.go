@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"webshell/service/sandbox"
+)
+
+func TestJailFileSystem(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	require.NoError(t, os.Mkdir(root, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret"), []byte("x"), 0644))
+
+	fs := newJailFileSystem(&LocalFileSystem{}, sandbox.NewLocal(root), nil)
+	var outsideErr *sandbox.OutsideRootError
+
+	require.NoError(t, fs.Create(root, "a", false))
+	_, err := fs.List(root, true)
+	assert.NoError(t, err)
+
+	_, err = fs.List(base, true)
+	assert.ErrorAs(t, err, &outsideErr)
+	assert.ErrorAs(t, fs.Delete(context.Background(), filepath.Join(base, "secret"), nil), &outsideErr)
+	_, err = fs.Copy(context.Background(), filepath.Join(base, "secret"), root, conflictFail, nil)
+	assert.ErrorAs(t, err, &outsideErr)
+	_, err = fs.Move(context.Background(), filepath.Join(root, "a"), base, conflictFail, nil)
+	assert.ErrorAs(t, err, &outsideErr)
+	assert.Error(t, fs.Rename(filepath.Join(root, "a"), "../b"))
+	assert.Error(t, fs.Create(root, "..", true))
+
+	// the root itself stays
+	assert.Error(t, fs.Delete(context.Background(), root, nil))
+	assert.DirExists(t, root)
+	assert.FileExists(t, filepath.Join(base, "secret"))
+}
+
+func TestJailFileSystemLinks(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "outdir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "outdir", "f"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret"), []byte("x"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(base, "secret"), filepath.Join(root, "out")))
+	require.NoError(t, os.Symlink(filepath.Join(base, "outdir"), filepath.Join(root, "outdir")))
+	require.NoError(t, os.Symlink(filepath.Join(base, "missing"), filepath.Join(root, "dangling")))
+
+	fs := newJailFileSystem(&LocalFileSystem{}, sandbox.NewLocal(root), nil)
+	ctx := context.Background()
+	var outsideErr *sandbox.OutsideRootError
+
+	// what links point to stays out of reach
+	_, _, err := fs.ReadFile(filepath.Join(root, "out"), 0)
+	assert.ErrorAs(t, err, &outsideErr)
+	_, err = fs.List(filepath.Join(root, "outdir"), true)
+	assert.ErrorAs(t, err, &outsideErr)
+
+	// the links themselves do not
+	target, err := fs.ReadLink(filepath.Join(root, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(base, "secret"), target)
+	_, err = fs.ReadLink(filepath.Join(root, "dangling"))
+	assert.NoError(t, err)
+	require.NoError(t, fs.Chmod(filepath.Join(root, "outdir"), 0700, true, nil))
+	st, err := os.Stat(filepath.Join(base, "outdir", "f"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), st.Mode().Perm())
+
+	require.NoError(t, fs.Rename(filepath.Join(root, "out"), "renamed"))
+	_, err = fs.Move(ctx, filepath.Join(root, "renamed"), filepath.Join(root, "sub"), conflictFail, nil)
+	require.NoError(t, err)
+	require.NoError(t, fs.Delete(ctx, filepath.Join(root, "sub", "renamed"), nil))
+	require.NoError(t, fs.Delete(ctx, filepath.Join(root, "dangling"), nil))
+	require.NoError(t, fs.Delete(ctx, filepath.Join(root, "outdir"), nil))
+
+	assert.FileExists(t, filepath.Join(base, "secret"))
+	assert.FileExists(t, filepath.Join(base, "outdir", "f"))
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "sub", entries[0].Name())
+}
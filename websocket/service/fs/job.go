@@ -0,0 +1,230 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// server -> client, id is the job and data a jobStatus
+	actionProgress = "progress"
+	// id is the job to stop
+	actionCancel = "cancel"
+	// replies with the jobStatus of every running job
+	actionJobs = "jobs"
+
+	CodeCanceled = "canceled"
+
+	// progress is sent this often at most
+	progressInterval = 250 * time.Millisecond
+	// chunk size of copies, cancellation is checked between chunks
+	copyChunkSize = 256 << 10
+)
+
+// jobData is the part of copy, move and delete requests naming the job.
+type jobData struct {
+	// Job is the id progress is sent under, generated when empty.
+	Job string `json:"job,omitempty"`
+}
+
+// CanceledError reports a job stopped by the client.
+type CanceledError struct {
+	Code string `json:"code"`
+	Job  string `json:"job"`
+}
+
+func (e *CanceledError) Error() string {
+	return "操作已取消"
+}
+
+// progress counts the work of a job. A nil progress counts nothing.
+type progress struct {
+	files, filesTotal atomic.Int64
+	bytes, bytesTotal atomic.Int64
+}
+
+// addTotal adds work found to do.
+func (p *progress) addTotal(files, bytes int64) {
+	if p != nil {
+		p.filesTotal.Add(files)
+		p.bytesTotal.Add(bytes)
+	}
+}
+
+// add adds work done.
+func (p *progress) add(files, bytes int64) {
+	if p != nil {
+		p.files.Add(files)
+		p.bytes.Add(bytes)
+	}
+}
+
+// copyContents copies src to dst, counting the bytes in p, until ctx is done.
+func copyContents(ctx context.Context, dst io.Writer, src io.Reader, p *progress) error {
+	buf := make([]byte, copyChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			p.add(0, int64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type jobStatus struct {
+	Job        string `json:"job"`
+	Op         string `json:"op"`
+	Path       string `json:"path"`
+	Files      int64  `json:"files"`
+	FilesTotal int64  `json:"filesTotal"`
+	Bytes      int64  `json:"bytes"`
+	BytesTotal int64  `json:"bytesTotal"`
+}
+
+// job is a running copy, move or delete.
+type job struct {
+	id, op, path string
+	cancel       context.CancelFunc
+	progress
+}
+
+func (j *job) status() jobStatus {
+	return jobStatus{
+		Job:        j.id,
+		Op:         j.op,
+		Path:       j.path,
+		Files:      j.files.Load(),
+		FilesTotal: j.filesTotal.Load(),
+		Bytes:      j.bytes.Load(),
+		BytesTotal: j.bytesTotal.Load(),
+	}
+}
+
+// runJob runs fn as the job d names, sending its progress until it ends.
+func (s *FSService) runJob(op, path string, d jobData, fn func(context.Context, *progress) error) error {
+	id := d.Job
+	if id == "" {
+		id = uuid.NewString()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j := &job{id: id, op: op, path: path, cancel: cancel}
+
+	s.jobMu.Lock()
+	if _, ok := s.jobs[id]; ok {
+		s.jobMu.Unlock()
+		return fmt.Errorf("job %s is already running", id)
+	}
+	if s.jobs == nil {
+		s.jobs = make(map[string]*job)
+	}
+	s.jobs[id] = j
+	s.jobMu.Unlock()
+
+	defer func() {
+		s.jobMu.Lock()
+		delete(s.jobs, id)
+		s.jobMu.Unlock()
+	}()
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		// the first one tells the client the job id
+		s.sendProgress(j.status())
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.sendProgress(j.status())
+			}
+		}
+	}()
+
+	err := fn(ctx, &j.progress)
+	// no progress after the reply
+	close(done)
+	<-stopped
+	if err != nil && ctx.Err() != nil {
+		return &CanceledError{Code: CodeCanceled, Job: id}
+	}
+	return err
+}
+
+func (s *FSService) sendProgress(st jobStatus) {
+	r, err := json.Marshal(st)
+	if err != nil {
+		s.Printf("error marshalling job progress: %v", err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      st.Job,
+		Action:  actionProgress,
+		Data:    r,
+	})
+}
+
+// handleCancel stops job id, whose request then fails with a CanceledError.
+func (s *FSService) handleCancel(id string) {
+	s.jobMu.Lock()
+	j := s.jobs[id]
+	s.jobMu.Unlock()
+
+	if j == nil {
+		s.handleError(id, actionCancel, fmt.Errorf("job %s is not running", id))
+		return
+	}
+	j.cancel()
+}
+
+func (s *FSService) handleJobs(id string) {
+	s.jobMu.Lock()
+	jobs := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j.status())
+	}
+	s.jobMu.Unlock()
+
+	r, err := json.Marshal(jobs)
+	if err != nil {
+		s.Printf("error marshalling jobs response: %v", err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionJobs,
+		Data:    r,
+	})
+}
+
+func (s *FSService) cancelJobs() {
+	s.jobMu.Lock()
+	for _, j := range s.jobs {
+		j.cancel()
+	}
+	s.jobMu.Unlock()
+}
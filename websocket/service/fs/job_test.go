@@ -0,0 +1,140 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countdownContext is canceled once Err has been called n times.
+type countdownContext struct {
+	context.Context
+	n atomic.Int64
+}
+
+func newCountdownContext(n int64) *countdownContext {
+	ctx := &countdownContext{Context: context.Background()}
+	ctx.n.Store(n)
+	return ctx
+}
+
+func (c *countdownContext) Err() error {
+	if c.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// newCopyTree creates a tree to copy and returns its root.
+func newCopyTree(t *testing.T) string {
+	src := filepath.Join(t.TempDir(), "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte("hello"), 0640))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", "big"), []byte(strings.Repeat("x", 3*copyChunkSize)), 0600))
+	require.NoError(t, os.Symlink("a", filepath.Join(src, "link")))
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "a"), old, old))
+	return src
+}
+
+func TestLocalCopyProgress(t *testing.T) {
+	fs := &LocalFileSystem{Logger: log.New(io.Discard, "", 0)}
+	src := newCopyTree(t)
+	dest := t.TempDir()
+
+	var p progress
+	_, err := fs.Copy(context.Background(), src, dest, conflictFail, &p)
+	require.NoError(t, err)
+	// src, a, sub, sub/big and link
+	assert.Equal(t, int64(5), p.filesTotal.Load())
+	assert.Equal(t, int64(5), p.files.Load())
+	assert.Equal(t, int64(5+3*copyChunkSize), p.bytesTotal.Load())
+	assert.Equal(t, p.bytesTotal.Load(), p.bytes.Load())
+
+	copied := filepath.Join(dest, "src")
+	info, err := os.Stat(filepath.Join(copied, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.Equal(t, 2020, info.ModTime().Year())
+	info, err = os.Stat(filepath.Join(copied, "sub"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(copied, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", target)
+
+	// later copies are renamed
+	for _, name := range []string{"src copy", "src copy 2"} {
+		target, err := fs.Copy(context.Background(), src, dest, conflictRename, nil)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dest, name), target)
+		assert.FileExists(t, filepath.Join(target, "sub", "big"))
+	}
+}
+
+func TestLocalCopyCanceled(t *testing.T) {
+	fs := &LocalFileSystem{Logger: log.New(io.Discard, "", 0)}
+	src := newCopyTree(t)
+
+	// stop at every step of the copy, none may leave anything behind
+	for n := int64(0); ; n++ {
+		dest := t.TempDir()
+		_, err := fs.Copy(newCountdownContext(n), src, dest, conflictFail, nil)
+		if err == nil {
+			break
+		}
+		assert.ErrorIs(t, err, context.Canceled)
+		entries, err := os.ReadDir(dest)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "stopped after %d checks", n)
+	}
+}
+
+func TestDeleteProgress(t *testing.T) {
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := newCopyTree(t)
+
+			// stopped deletes keep what is left
+			assert.ErrorIs(t, fs.Delete(newCountdownContext(7), src, nil), context.Canceled)
+			assert.DirExists(t, src)
+
+			var p progress
+			require.NoError(t, fs.Delete(context.Background(), src, &p))
+			assert.NoDirExists(t, src)
+			assert.Equal(t, p.filesTotal.Load(), p.files.Load())
+			assert.Equal(t, p.bytesTotal.Load(), p.bytes.Load())
+		})
+	}
+}
+
+func TestMoveProgress(t *testing.T) {
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := newCopyTree(t)
+			dest := t.TempDir()
+
+			var p progress
+			_, err := fs.Move(context.Background(), src, dest, conflictFail, &p)
+			require.NoError(t, err)
+			assert.NoDirExists(t, src)
+			assert.FileExists(t, filepath.Join(dest, "src", "sub", "big"))
+			assert.Equal(t, int64(1), p.files.Load())
+		})
+	}
+}
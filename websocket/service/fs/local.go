@@ -1,14 +1,19 @@
 package fs
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	iofs "io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"path"
-	"runtime"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
+	"webshell/service/sandbox"
 	ws "webshell/websocket"
 )
 
@@ -17,93 +22,154 @@ type LocalFileSystem struct {
 }
 
 func (l *LocalFileSystem) GetRoot() ([]*FileSystemEntry, error) {
-	info, err := os.Stat(fsRoot)
-
-	if err != nil {
-		l.Printf("error getting root directory info: %v", err)
-		return nil, err
-	}
+	entries := make([]*FileSystemEntry, 0, len(sandbox.LocalRoots))
+	for _, root := range sandbox.LocalRoots {
+		info, err := os.Stat(root)
+		if err != nil {
+			l.Printf("error getting root directory info: %v", err)
+			return nil, err
+		}
 
-	entry := &FileSystemEntry{
-		Name:    "/",
-		Path:    fsRoot,
-		IsDir:   true,
-		Size:    info.Size(),
-		Mode:    info.Mode(),
-		ModTime: info.ModTime().UnixMilli(),
+		name := "/"
+		if len(sandbox.LocalRoots) > 1 {
+			name = root
+		}
+		entries = append(entries, &FileSystemEntry{
+			Name:    name,
+			Path:    root,
+			IsDir:   true,
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime().UnixMilli(),
+		})
 	}
 
-	return []*FileSystemEntry{entry}, nil
+	return entries, nil
 }
 
 // Copy implements fileSystem.
-func (l *LocalFileSystem) Copy(src string, dest string) error {
+func (l *LocalFileSystem) Copy(ctx context.Context, src, dest, policy string, p *progress) (string, error) {
 	srcInfo, err := os.Stat(src)
 	if err != nil {
-		return fmt.Errorf("failed to stat source: %w", err)
+		return "", fmt.Errorf("failed to stat source: %w", err)
 	}
+	return transfer(ctx, localStore{}, src, dest, srcInfo, policy, false, p)
+}
 
-	destPath := path.Join(dest, srcInfo.Name())
-	if _, err := os.Stat(destPath); err == nil {
-		destPath += " copy"
+// countLocal adds the entries and bytes below p, which has the given info,
+// to the total of prog.
+func countLocal(ctx context.Context, p string, info os.FileInfo, prog *progress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			prog.addTotal(1, info.Size())
+		} else {
+			prog.addTotal(1, 0)
+		}
+		return nil
 	}
 
-	// 在类Unix系统上尝试使用cp命令
-	if runtime.GOOS != "windows" {
-		if _, err := exec.LookPath("cp"); err == nil {
-			// cp命令存在，使用cp命令
-			cmd := exec.Command("cp", "-a", src, destPath)
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("cp command failed: %w", err)
-			}
-			return nil
+	prog.addTotal(1, 0)
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		child, err := e.Info()
+		if err != nil {
+			return err
 		}
-		l.Printf("cp command not found, falling back to Go implementation")
+		if err := countLocal(ctx, filepath.Join(p, e.Name()), child, prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLocal copies src, which has the given info, to dst as cp -a does:
+// symlinks are copied as links, modes, times and owners are kept when
+// possible.
+func copyLocal(ctx context.Context, src, dst string, info os.FileInfo, p *progress) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
 
-	// cp命令不存在，继续使用Go实现
-	if srcInfo.IsDir() {
-		// Create destination directory
-		if err := os.MkdirAll(destPath, srcInfo.Mode()); err != nil {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+		p.add(1, 0)
+	case info.IsDir():
+		// 复制内容时目录需要可写
+		if err := os.Mkdir(dst, 0700); err != nil {
 			return fmt.Errorf("failed to create destination directory: %w", err)
 		}
-
-		// Read source directory
 		entries, err := os.ReadDir(src)
 		if err != nil {
 			return fmt.Errorf("failed to read source directory: %w", err)
 		}
-
-		// Recursively copy contents
-		for _, entry := range entries {
-			srcPath := path.Join(src, entry.Name())
-			if err := l.Copy(srcPath, destPath); err != nil {
-				// cleanup on error
-				os.RemoveAll(destPath)
+		for _, e := range entries {
+			child, err := e.Info()
+			if err != nil {
+				return err
+			}
+			if err := copyLocal(ctx, filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()), child, p); err != nil {
 				return err
 			}
 		}
+		if err := os.Chmod(dst, mode); err != nil {
+			return err
+		}
+		p.add(1, 0)
+	case info.Mode().IsRegular():
+		if err := copyLocalFile(ctx, src, dst, mode, p); err != nil {
+			return err
+		}
+		p.add(1, 0)
+	default:
+		// 设备文件和管道等不复制
+		p.add(1, 0)
 		return nil
 	}
 
+	if uid, gid, ok := fileOwner(info); ok {
+		// 只有 root 能设置其他用户
+		os.Lchown(dst, uid, gid)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+func copyLocalFile(ctx context.Context, src, dst string, mode os.FileMode, p *progress) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer srcFile.Close()
 
-	destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY, srcInfo.Mode())
+	destFile, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
 	if err != nil {
 		return fmt.Errorf("failed to create destination file: %w", err)
 	}
-	defer destFile.Close()
-
-	if _, err = io.Copy(destFile, srcFile); err != nil {
-		os.Remove(destPath) // cleanup on error
+	if err := copyContents(ctx, destFile, srcFile, p); err != nil {
+		destFile.Close()
 		return fmt.Errorf("failed to copy file contents: %w", err)
 	}
-
-	return nil
+	if err := destFile.Close(); err != nil {
+		return err
+	}
+	// umask 会去掉部分权限位
+	return os.Chmod(dst, mode)
 }
 
 // Create implements fileSystem.
@@ -130,11 +196,53 @@ func (l *LocalFileSystem) Create(parentPath string, name string, isDir bool) err
 }
 
 // Delete implements fileSystem.
-func (l *LocalFileSystem) Delete(path string) error {
-	if err := os.RemoveAll(path); err != nil {
+func (l *LocalFileSystem) Delete(ctx context.Context, path string, p *progress) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := countLocal(ctx, path, info, p); err != nil {
 		return err
 	}
+	return removeLocal(ctx, path, info, p)
+}
 
+// removeLocal removes p, which has the given info, and everything below it.
+func removeLocal(ctx context.Context, p string, info os.FileInfo, prog *progress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			child, err := e.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := removeLocal(ctx, filepath.Join(p, e.Name()), child, prog); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		prog.add(1, info.Size())
+	} else {
+		prog.add(1, 0)
+	}
 	return nil
 }
 
@@ -156,32 +264,37 @@ func (l *LocalFileSystem) List(dirPath string, showHidden bool) ([]*FileSystemEn
 		if !showHidden && dirEntry.Name()[0] == '.' {
 			continue
 		}
-		entries = append(entries, &FileSystemEntry{
+		entry := &FileSystemEntry{
 			Name:    dirEntry.Name(),
 			Path:    path.Join(dirPath, dirEntry.Name()),
 			IsDir:   dirEntry.IsDir(),
 			Size:    info.Size(),
 			Mode:    info.Mode(),
 			ModTime: info.ModTime().UnixMilli(),
-		})
+		}
+		if uid, gid, ok := fileOwner(info); ok {
+			entry.Owner, entry.Group = localOwnerNames(uid, gid)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			entry.IsSymlink = true
+			entry.LinkTarget, _ = os.Readlink(entry.Path)
+			if target, err := os.Stat(entry.Path); err == nil {
+				entry.IsDir = target.IsDir()
+			}
+		}
+		entries = append(entries, entry)
 	}
 
 	return entries, nil
 }
 
 // Move implements fileSystem.
-func (l *LocalFileSystem) Move(src string, dest string) error {
-	srcInfo, err := os.Stat(src)
+func (l *LocalFileSystem) Move(ctx context.Context, src, dest, policy string, p *progress) (string, error) {
+	srcInfo, err := os.Lstat(src)
 	if err != nil {
-		return fmt.Errorf("failed to stat source: %w", err)
+		return "", fmt.Errorf("failed to stat source: %w", err)
 	}
-
-	destPath := path.Join(dest, srcInfo.Name())
-	if _, err := os.Stat(destPath); err == nil {
-		destPath += " copy"
-	}
-
-	return os.Rename(src, destPath)
+	return transfer(ctx, localStore{}, src, dest, srcInfo, policy, true, p)
 }
 
 // Rename implements fileSystem.
@@ -203,13 +316,249 @@ func (l *LocalFileSystem) Rename(oldPath string, newName string) error {
 	return nil
 }
 
+// ReadFile implements fileSystem.
+func (l *LocalFileSystem) ReadFile(path string, maxSize int64) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readLimited(f, info, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, info, nil
+}
+
+// WriteFile implements fileSystem. The content goes to a temporary file
+// that replaces the original, so a failed save leaves it intact.
+func (l *LocalFileSystem) WriteFile(path string, data []byte) (os.FileInfo, error) {
+	// replace the file a link points to, not the link
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+
+	info, err := os.Stat(path)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	mode := os.FileMode(0644)
+	if exists {
+		mode = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		rule := ruleFor(backupRules, filepath.ToSlash(path))
+		if err := backup(localBackups{}, path, rule, time.Now()); err != nil {
+			return nil, fmt.Errorf("failed to back up file: %w", err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".webshell-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		if uid, gid, ok := fileOwner(info); ok && (uid != os.Getuid() || gid != os.Getgid()) {
+			if err := os.Chown(tmp.Name(), uid, gid); err != nil {
+				// keeping the owner matters more than an atomic save
+				l.Printf("cannot keep owner of %s, writing in place: %v", path, err)
+				if err := os.WriteFile(path, data, mode); err != nil {
+					return nil, err
+				}
+				return os.Stat(path)
+			}
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+// Chmod implements fileSystem.
+func (l *LocalFileSystem) Chmod(path string, mode os.FileMode, recursive bool, prog *progress) error {
+	if recursive {
+		err := walkLocal(path, true, func(string, iofs.DirEntry) error {
+			prog.addTotal(1, 0)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return walkLocal(path, recursive, func(p string, d iofs.DirEntry) error {
+		// the mode of a link is that of its target
+		if d.Type()&os.ModeSymlink == 0 {
+			if err := os.Chmod(p, mode); err != nil {
+				return err
+			}
+		}
+		prog.add(1, 0)
+		return nil
+	})
+}
+
+// Chown implements fileSystem.
+func (l *LocalFileSystem) Chown(path, owner, group string, recursive bool) error {
+	uid, gid, err := lookupLocalOwner(owner, group)
+	if err != nil {
+		return err
+	}
+	return walkLocal(path, recursive, func(p string, _ iofs.DirEntry) error {
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// walkLocal calls fn for path, and for everything below it if recursive.
+func walkLocal(path string, recursive bool, fn func(string, iofs.DirEntry) error) error {
+	if !recursive {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		return fn(path, iofs.FileInfoToDirEntry(info))
+	}
+	return filepath.WalkDir(path, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(p, d)
+	})
+}
+
+// Symlink implements fileSystem.
+func (l *LocalFileSystem) Symlink(target, linkPath string) error {
+	return os.Symlink(target, linkPath)
+}
+
+// ReadLink implements fileSystem.
+func (l *LocalFileSystem) ReadLink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+// rootTrash returns the trash kept in a root, as the freedesktop.org
+// specification has it for the top directory of a volume.
+func rootTrash(root string) string {
+	return filepath.Join(root, fmt.Sprintf(".Trash-%d", os.Getuid()))
+}
+
+// localTrashes returns the trash of every root.
+func localTrashes() []string {
+	var trashes []string
+	for _, root := range sandbox.LocalRoots {
+		if trash := rootTrash(root); !slices.Contains(trashes, trash) {
+			trashes = append(trashes, trash)
+		}
+	}
+	return trashes
+}
+
+// localTrashFor returns the trash of the root of p.
+func localTrashFor(p string) (string, error) {
+	root := ""
+	for _, r := range sandbox.LocalRoots {
+		if isUnder(p, r) && len(r) > len(root) {
+			root = r
+		}
+	}
+	if root == "" {
+		return "", fmt.Errorf("no trash for a path outside of the roots: %s", p)
+	}
+	return rootTrash(root), nil
+}
+
+// isUnder reports whether p is dir or below it.
+func isUnder(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Trash implements fileSystem.
+func (l *LocalFileSystem) Trash(ctx context.Context, path string, p *progress) error {
+	path = filepath.Clean(path)
+	for _, trash := range localTrashes() {
+		if isUnder(path, trash) {
+			// 回收站中的文件直接删除
+			return l.Delete(ctx, path, p)
+		}
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+
+	trash, err := localTrashFor(path)
+	if err != nil {
+		return err
+	}
+	_, err = moveToTrash(ctx, localStore{}, trash, path, path, time.Now(), p)
+	return err
+}
+
+// TrashList implements fileSystem.
+func (l *LocalFileSystem) TrashList() ([]*trashEntry, error) {
+	var entries []*trashEntry
+	for _, trash := range localTrashes() {
+		items, err := listTrash(localStore{}, trash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, items...)
+	}
+	slices.SortFunc(entries, func(a, b *trashEntry) int {
+		return cmp.Compare(b.DeletedAt, a.DeletedAt)
+	})
+	return entries, nil
+}
+
+// Restore implements fileSystem.
+func (l *LocalFileSystem) Restore(id string) (string, error) {
+	trash, name, ok := trashItem(localStore{}, localTrashes(), filepath.Clean(id))
+	if !ok {
+		return "", fmt.Errorf("not in the trash: %s", id)
+	}
+	return restoreFromTrash(localStore{}, trash, name)
+}
+
+// EmptyTrash implements fileSystem.
+func (l *LocalFileSystem) EmptyTrash(ctx context.Context, before time.Time, match func(string) bool, p *progress) error {
+	for _, trash := range localTrashes() {
+		if err := purgeTrash(ctx, localStore{}, trash, before, match, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func NewLocalService() ws.Service {
 	logger := log.New(log.Writer(), "[fs] ", log.LstdFlags)
 	fs := &LocalFileSystem{
 		Logger: logger,
 	}
 	service := &FSService{
-		FS:     fs,
+		FS:     newJailFileSystem(fs, sandbox.Local, nil),
 		Logger: logger,
 	}
 	return service
@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"context"
 	"os"
 	"path"
 	"testing"
@@ -59,7 +60,7 @@ func TestLocalFileSystem(t *testing.T) {
 		assert.NoError(t, err)
 
 		// 复制文件
-		err = fs.Copy(srcPath, tmpDir)
+		_, err = fs.Copy(context.Background(), srcPath, tmpDir, "", nil)
 		assert.NoError(t, err)
 
 		// 验证复制的文件
@@ -78,7 +79,7 @@ func TestLocalFileSystem(t *testing.T) {
 
 		// 移动文件
 		destDir := path.Join(tmpDir, "testdir")
-		err = fs.Move(srcPath, destDir)
+		_, err = fs.Move(context.Background(), srcPath, destDir, "", nil)
 		assert.NoError(t, err)
 
 		// 验证文件已移动
@@ -96,7 +97,7 @@ func TestLocalFileSystem(t *testing.T) {
 		err := os.WriteFile(filePath, []byte("to be deleted"), 0644)
 		assert.NoError(t, err)
 
-		err = fs.Delete(filePath)
+		err = fs.Delete(context.Background(), filePath, nil)
 		assert.NoError(t, err)
 
 		_, err = os.Stat(filePath)
@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// localNames caches the names of local users and groups by id.
+var localNames = struct {
+	sync.RWMutex
+	users  map[int]string
+	groups map[int]string
+}{users: make(map[int]string), groups: make(map[int]string)}
+
+// localOwnerNames returns the names of uid and gid, or the ids when unknown.
+func localOwnerNames(uid, gid int) (string, string) {
+	localNames.RLock()
+	owner, okUser := localNames.users[uid]
+	group, okGroup := localNames.groups[gid]
+	localNames.RUnlock()
+	if okUser && okGroup {
+		return owner, group
+	}
+
+	owner, group = strconv.Itoa(uid), strconv.Itoa(gid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+
+	localNames.Lock()
+	localNames.users[uid] = owner
+	localNames.groups[gid] = group
+	localNames.Unlock()
+	return owner, group
+}
+
+// lookupLocalOwner returns the ids of owner and group, given by name or id.
+// Empty ones are -1, which os.Lchown leaves unchanged.
+func lookupLocalOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		if id, err := strconv.Atoi(owner); err == nil {
+			uid = id
+		} else if u, err := user.Lookup(owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else {
+			return 0, 0, fmt.Errorf("unknown user: %s", owner)
+		}
+	}
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else if g, err := user.LookupGroup(group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else {
+			return 0, 0, fmt.Errorf("unknown group: %s", group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// unixMode converts permission bits as chmod takes them, such as 04755,
+// to an os.FileMode.
+func unixMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"encoding/json"
+
+	ws "webshell/websocket"
+)
+
+const (
+	actionChmod    = "chmod"
+	actionChown    = "chown"
+	actionSymlink  = "symlink"
+	actionReadlink = "readlink"
+)
+
+type chmodData struct {
+	// Mode holds permission bits as chmod takes them, such as 0755 or 04755.
+	Mode      uint32 `json:"mode"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+type chownData struct {
+	// Owner and Group are names or ids, empty ones are left unchanged.
+	Owner     string `json:"owner,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+type linkData struct {
+	Target string `json:"target"`
+}
+
+func (s *FSService) handleChmod(id string, data json.RawMessage) {
+	var d chmodData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("error unmarshalling fs chmod payload: %v", err)
+		return
+	}
+
+	if err := s.FS.Chmod(id, unixMode(d.Mode), d.Recursive, nil); err != nil {
+		s.handleError(id, actionChmod, err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionChmod,
+	})
+}
+
+func (s *FSService) handleChown(id string, data json.RawMessage) {
+	var d chownData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("error unmarshalling fs chown payload: %v", err)
+		return
+	}
+
+	if err := s.FS.Chown(id, d.Owner, d.Group, d.Recursive); err != nil {
+		s.handleError(id, actionChown, err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionChown,
+	})
+}
+
+// handleSymlink creates a symlink at id.
+func (s *FSService) handleSymlink(id string, data json.RawMessage) {
+	var d linkData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("error unmarshalling fs symlink payload: %v", err)
+		return
+	}
+
+	if err := s.FS.Symlink(d.Target, id); err != nil {
+		s.handleError(id, actionSymlink, err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionSymlink,
+	})
+}
+
+func (s *FSService) handleReadlink(id string) {
+	target, err := s.FS.ReadLink(id)
+	if err != nil {
+		s.handleError(id, actionReadlink, err)
+		return
+	}
+
+	r, err := json.Marshal(linkData{Target: target})
+	if err != nil {
+		s.Printf("error marshalling readlink response: %v", err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionReadlink,
+		Data:    r,
+	})
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixMode(t *testing.T) {
+	assert.Equal(t, os.FileMode(0755), unixMode(0755))
+	assert.Equal(t, os.FileMode(0755)|os.ModeSetuid, unixMode(04755))
+	assert.Equal(t, os.FileMode(0777)|os.ModeSticky, unixMode(01777))
+}
+
+func TestPermissionsAndLinks(t *testing.T) {
+	me, err := user.Current()
+	require.NoError(t, err)
+
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			sub := filepath.Join(dir, "sub")
+			require.NoError(t, os.Mkdir(sub, 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(sub, "f"), nil, 0644))
+
+			require.NoError(t, fs.Symlink("sub", filepath.Join(dir, "link")))
+			target, err := fs.ReadLink(filepath.Join(dir, "link"))
+			require.NoError(t, err)
+			assert.Equal(t, "sub", target)
+
+			require.NoError(t, fs.Chmod(sub, 0700, true, nil))
+			st, _ := os.Stat(filepath.Join(sub, "f"))
+			assert.Equal(t, os.FileMode(0700), st.Mode().Perm())
+			require.NoError(t, fs.Chmod(sub, 0750, false, nil))
+			st, _ = os.Stat(sub)
+			assert.Equal(t, os.FileMode(0750), st.Mode().Perm())
+			st, _ = os.Stat(filepath.Join(sub, "f"))
+			assert.Equal(t, os.FileMode(0700), st.Mode().Perm())
+
+			// owners by id and by name
+			require.NoError(t, fs.Chown(sub, me.Uid, "", true))
+			require.NoError(t, fs.Chown(sub, me.Username, "", false))
+			assert.Error(t, fs.Chown(sub, "no-such-user-webshell", "", false))
+
+			entries, err := fs.List(dir, true)
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			for _, e := range entries {
+				assert.Equal(t, me.Username, e.Owner)
+				assert.NotEmpty(t, e.Group)
+				assert.True(t, e.IsDir, e.Name)
+				if e.Name == "link" {
+					assert.True(t, e.IsSymlink)
+					assert.Equal(t, "sub", e.LinkTarget)
+				} else {
+					assert.False(t, e.IsSymlink)
+				}
+			}
+		})
+	}
+}
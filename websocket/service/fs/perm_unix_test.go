@@ -0,0 +1,46 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChownSkipsLinks(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chown needs root")
+	}
+
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			base := t.TempDir()
+			outside := filepath.Join(base, "outside")
+			require.NoError(t, os.WriteFile(outside, nil, 0644))
+			require.NoError(t, os.Chown(outside, 4242, 4242))
+			root := filepath.Join(base, "root")
+			require.NoError(t, os.Mkdir(root, 0755))
+			require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+
+			require.NoError(t, fs.Chown(root, "4343", "4343", true))
+			require.NoError(t, fs.Chown(filepath.Join(root, "link"), "4343", "4343", false))
+
+			st, err := os.Stat(outside)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(4242), st.Sys().(*syscall.Stat_t).Uid)
+			st, err = os.Stat(root)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(4343), st.Sys().(*syscall.Stat_t).Uid)
+		})
+	}
+}
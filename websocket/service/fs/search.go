@@ -0,0 +1,380 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// id is the directory searched, data a searchData; the matches come back
+	// as searchMatch data under actionSearchMatch, then a searchResult under
+	// actionSearch
+	actionSearch       = "search"
+	actionSearchMatch  = "search_match"
+	actionSearchCancel = "search_cancel"
+
+	// longer matching lines are cut
+	maxSearchLineLength = 500
+	// longer lines are not searched
+	maxSearchScanLength = 1 << 20
+)
+
+type searchData struct {
+	// Name matches the file name, as a glob such as *.go unless Regex is set.
+	Name  string `json:"name,omitempty"`
+	Regex bool   `json:"regex,omitempty"`
+	// Content matches the lines of regular files, literally unless
+	// ContentRegex is set.
+	Content      string `json:"content,omitempty"`
+	ContentRegex bool   `json:"contentRegex,omitempty"`
+	IgnoreCase   bool   `json:"ignoreCase,omitempty"`
+	// size filters leave out directories, 0 is no limit
+	MinSize int64 `json:"minSize,omitempty"`
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// unix milliseconds, 0 is no limit
+	ModifiedAfter  int64 `json:"modifiedAfter,omitempty"`
+	ModifiedBefore int64 `json:"modifiedBefore,omitempty"`
+	ShowHidden     bool  `json:"showHidden,omitempty"`
+	// MaxResults is capped by the server limit.
+	MaxResults int `json:"maxResults,omitempty"`
+}
+
+type searchMatch struct {
+	Path    string `json:"path"`
+	IsDir   bool   `json:"isDir"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	// set on content matches
+	Line int    `json:"line,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+type searchResult struct {
+	Count int `json:"count"`
+	// Truncated tells the search stopped at the result limit.
+	Truncated bool `json:"truncated"`
+	Canceled  bool `json:"canceled"`
+}
+
+// searchQuery is a compiled searchData.
+type searchQuery struct {
+	searchData
+	// nil matches every name
+	name *regexp.Regexp
+	// nil when only names are searched
+	content *regexp.Regexp
+}
+
+func newSearchQuery(d searchData) (*searchQuery, error) {
+	q := &searchQuery{searchData: d}
+	flags := ""
+	if d.IgnoreCase {
+		flags = "(?i)"
+	}
+
+	if d.Name != "" {
+		expr := d.Name
+		if !d.Regex {
+			var err error
+			if expr, err = globRegexp(d.Name); err != nil {
+				return nil, err
+			}
+		}
+		re, err := regexp.Compile(flags + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %w", err)
+		}
+		q.name = re
+	}
+
+	if d.Content != "" {
+		expr := d.Content
+		if !d.ContentRegex {
+			expr = regexp.QuoteMeta(expr)
+		}
+		re, err := regexp.Compile(flags + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content pattern: %w", err)
+		}
+		q.content = re
+	}
+	return q, nil
+}
+
+// globRegexp converts a glob as path.Match takes it to a regexp matching
+// whole names.
+func globRegexp(glob string) (string, error) {
+	if _, err := path.Match(glob, ""); err != nil {
+		return "", fmt.Errorf("invalid name pattern: %w", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			// path.Match classes, such as [^a-z], read the same as regexp ones
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("invalid name pattern: %w", path.ErrBadPattern)
+			}
+			b.WriteString(glob[i : i+end+1])
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// matchEntry reports whether an entry passes the name, size and time
+// filters. Content searches only match regular files.
+func (q *searchQuery) matchEntry(name string, mode os.FileMode, size int64, modTime time.Time) bool {
+	if q.content != nil && !mode.IsRegular() {
+		return false
+	}
+	if q.name != nil && !q.name.MatchString(name) {
+		return false
+	}
+	if q.MinSize > 0 || q.MaxSize > 0 {
+		if mode.IsDir() || size < q.MinSize || q.MaxSize > 0 && size > q.MaxSize {
+			return false
+		}
+	}
+	if q.ModifiedAfter > 0 && modTime.UnixMilli() < q.ModifiedAfter {
+		return false
+	}
+	if q.ModifiedBefore > 0 && modTime.UnixMilli() > q.ModifiedBefore {
+		return false
+	}
+	return true
+}
+
+// grepLines calls fn with the lines of r matching re, until fn returns
+// false, and reports whether to go on. Binary files have no lines.
+func grepLines(r io.Reader, re *regexp.Regexp, fn func(line int, text string) bool) (bool, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(binarySniffLength)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return true, err
+	}
+	if isBinary(head) {
+		return true, nil
+	}
+
+	sc := bufio.NewScanner(br)
+	sc.Buffer(nil, maxSearchScanLength)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSuffix(sc.Bytes(), []byte("\r"))
+		if re.Match(line) && !fn(n, searchLine(line)) {
+			return false, nil
+		}
+	}
+	if errors.Is(sc.Err(), bufio.ErrTooLong) {
+		return true, nil
+	}
+	return true, sc.Err()
+}
+
+// searchLine returns a matching line as sent to the client.
+func searchLine(line []byte) string {
+	if len(line) > maxSearchLineLength {
+		cut := maxSearchLineLength
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		line = line[:cut]
+	}
+	return strings.ToValidUTF8(string(line), "�")
+}
+
+// Search implements fileSystem.
+func (l *LocalFileSystem) Search(ctx context.Context, root string, q *searchQuery, found func(searchMatch) bool) error {
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	stopped := errors.New("search stopped")
+
+	err := filepath.WalkDir(root, func(p string, d iofs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p == root {
+			return err
+		}
+		if err != nil {
+			// unreadable directories are left out
+			return nil
+		}
+		if !q.ShowHidden && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || !q.matchEntry(d.Name(), info.Mode(), info.Size(), info.ModTime()) {
+			return nil
+		}
+		m := searchMatch{
+			Path:    p,
+			IsDir:   d.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixMilli(),
+		}
+		if q.content == nil {
+			if !found(m) {
+				return stopped
+			}
+			return nil
+		}
+
+		if info.Size() > searchMaxFileSize {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		more, _ := grepLines(f, q.content, func(line int, text string) bool {
+			m.Line, m.Text = line, text
+			return ctx.Err() == nil && found(m)
+		})
+		if !more {
+			return stopped
+		}
+		return nil
+	})
+	if err == stopped {
+		return nil
+	}
+	return err
+}
+
+func (s *FSService) handleSearch(id string, data json.RawMessage) {
+	var d searchData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("error unmarshalling fs search payload: %v", err)
+		return
+	}
+	q, err := newSearchQuery(d)
+	if err != nil {
+		s.handleError(id, actionSearch, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.searchMu.Lock()
+	if _, ok := s.searches[id]; ok {
+		s.searchMu.Unlock()
+		s.handleError(id, actionSearch, fmt.Errorf("a search is already running"))
+		return
+	}
+	if s.searches == nil {
+		s.searches = make(map[string]context.CancelFunc)
+	}
+	s.searches[id] = cancel
+	s.searchMu.Unlock()
+
+	defer func() {
+		s.searchMu.Lock()
+		delete(s.searches, id)
+		s.searchMu.Unlock()
+	}()
+
+	limit := d.MaxResults
+	if limit <= 0 || limit > searchMaxResults {
+		limit = searchMaxResults
+	}
+	var res searchResult
+	err = s.FS.Search(ctx, id, q, func(m searchMatch) bool {
+		if res.Count >= limit {
+			res.Truncated = true
+			return false
+		}
+		res.Count++
+		s.sendSearchMatch(id, m)
+		return true
+	})
+	if ctx.Err() != nil {
+		res.Canceled = true
+	} else if err != nil {
+		s.handleError(id, actionSearch, fmt.Errorf("failed to search: %w", err))
+		return
+	}
+
+	r, err := json.Marshal(res)
+	if err != nil {
+		s.Printf("error marshalling search response: %v", err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionSearch,
+		Data:    r,
+	})
+}
+
+func (s *FSService) sendSearchMatch(id string, m searchMatch) {
+	r, err := json.Marshal(m)
+	if err != nil {
+		s.Printf("error marshalling search match: %v", err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionSearchMatch,
+		Data:    r,
+	})
+}
+
+// handleSearchCancel stops the search of directory id, which then replies
+// with Canceled set.
+func (s *FSService) handleSearchCancel(id string) {
+	s.searchMu.Lock()
+	cancel := s.searches[id]
+	s.searchMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (s *FSService) cancelSearches() {
+	s.searchMu.Lock()
+	for _, cancel := range s.searches {
+		cancel()
+	}
+	s.searchMu.Unlock()
+}
@@ -0,0 +1,297 @@
+package fs
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSearchQuery(t *testing.T) {
+	q, err := newSearchQuery(searchData{Name: "*.go"})
+	require.NoError(t, err)
+	assert.True(t, q.matchEntry("main.go", 0, 1, time.Now()))
+	assert.False(t, q.matchEntry("main.go.bak", 0, 1, time.Now()))
+	assert.False(t, q.matchEntry("MAIN.GO", 0, 1, time.Now()))
+
+	q, err = newSearchQuery(searchData{Name: "[a-c]?.TXT", IgnoreCase: true})
+	require.NoError(t, err)
+	assert.True(t, q.matchEntry("b1.txt", 0, 1, time.Now()))
+	assert.False(t, q.matchEntry("d1.txt", 0, 1, time.Now()))
+
+	q, err = newSearchQuery(searchData{Name: `^\d+$`, Regex: true, MinSize: 10, ModifiedAfter: 1000})
+	require.NoError(t, err)
+	assert.True(t, q.matchEntry("123", 0, 10, time.UnixMilli(1000)))
+	assert.False(t, q.matchEntry("123", 0, 9, time.UnixMilli(1000)))
+	assert.False(t, q.matchEntry("123", os.ModeDir, 10, time.UnixMilli(1000)))
+	assert.False(t, q.matchEntry("123", 0, 10, time.UnixMilli(999)))
+
+	q, err = newSearchQuery(searchData{Content: "a.b"})
+	require.NoError(t, err)
+	assert.False(t, q.matchEntry("dir", os.ModeDir, 0, time.Now()))
+	assert.True(t, q.content.MatchString("xa.b"))
+	assert.False(t, q.content.MatchString("axb"))
+
+	_, err = newSearchQuery(searchData{Name: "[a-"})
+	assert.Error(t, err)
+	_, err = newSearchQuery(searchData{Content: "(", ContentRegex: true})
+	assert.Error(t, err)
+}
+
+func TestSearchLine(t *testing.T) {
+	line := strings.Repeat("a", maxSearchLineLength-1) + "中文"
+	assert.Equal(t, strings.Repeat("a", maxSearchLineLength-1), searchLine([]byte(line)))
+	assert.Equal(t, "a�b", searchLine([]byte("a\xffb")))
+}
+
+// newSearchTree creates a tree to search and returns its root.
+func newSearchTree(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.go":           "package a\nfunc Hello() {}\n",
+		"sub/b.go":       "package b\n\n// hello world\r\n",
+		"sub/c.txt":      "nothing here\n",
+		"sub/bin.go":     "hello\x00binary",
+		".hidden/d.go":   "hello\n",
+		"sub/.e.go":      "hello\n",
+		"sub/deep/f.log": strings.Repeat("x", 100),
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+	return root
+}
+
+func searchAll(t *testing.T, fs FileSystem, root string, d searchData) []searchMatch {
+	q, err := newSearchQuery(d)
+	require.NoError(t, err)
+	var matches []searchMatch
+	err = fs.Search(context.Background(), root, q, func(m searchMatch) bool {
+		m.Path = strings.TrimPrefix(m.Path, root+"/")
+		m.ModTime, m.Size = 0, 0
+		matches = append(matches, m)
+		return true
+	})
+	require.NoError(t, err)
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Path < matches[j].Path })
+	return matches
+}
+
+func TestSearch(t *testing.T) {
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := newSearchTree(t)
+
+			assert.Equal(t, []searchMatch{
+				{Path: "a.go"},
+				{Path: "sub/b.go"},
+				{Path: "sub/bin.go"},
+			}, searchAll(t, fs, root, searchData{Name: "*.go"}))
+
+			assert.Len(t, searchAll(t, fs, root, searchData{Name: "*.go", ShowHidden: true}), 5)
+
+			assert.Equal(t, []searchMatch{
+				{Path: "sub/deep/f.log"},
+			}, searchAll(t, fs, root, searchData{MinSize: 50}))
+
+			assert.Equal(t, []searchMatch{
+				{Path: "a.go", Line: 2, Text: "func Hello() {}"},
+				{Path: "sub/b.go", Line: 3, Text: "// hello world"},
+			}, searchAll(t, fs, root, searchData{Content: "hello", IgnoreCase: true}))
+
+			assert.Equal(t, []searchMatch{
+				{Path: "sub/b.go", Line: 3, Text: "// hello world"},
+			}, searchAll(t, fs, root, searchData{Name: "b*", Content: "h.l+o", ContentRegex: true}))
+
+			// stops when found says so
+			q, err := newSearchQuery(searchData{})
+			require.NoError(t, err)
+			count := 0
+			require.NoError(t, fs.Search(context.Background(), root, q, func(searchMatch) bool {
+				count++
+				return false
+			}))
+			assert.Equal(t, 1, count)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			assert.ErrorIs(t, fs.Search(ctx, root, q, func(searchMatch) bool { return true }), context.Canceled)
+
+			assert.Error(t, fs.Search(context.Background(), filepath.Join(root, "missing"), q, func(searchMatch) bool { return true }))
+		})
+	}
+}
+
+func TestRemoteSearchCommands(t *testing.T) {
+	if out, err := exec.Command("sh", "-c", findCommand(".", false)+" -quit").CombinedOutput(); err != nil {
+		t.Skipf("find cannot run the remote command: %v: %s", err, out)
+	}
+	root := newSearchTree(t)
+
+	out, err := exec.Command("sh", "-c", findCommand(root, false)).Output()
+	require.NoError(t, err)
+	var paths []string
+	require.NoError(t, readFindEntries(strings.NewReader(string(out)), func(e findEntry) bool {
+		if e.path == filepath.Join(root, "sub/deep/f.log") {
+			assert.Equal(t, int64(100), e.size)
+			assert.True(t, e.mode.IsRegular())
+			assert.WithinDuration(t, time.Now(), e.modTime, time.Minute)
+		}
+		if e.path == filepath.Join(root, "sub") {
+			assert.True(t, e.mode.IsDir())
+		}
+		paths = append(paths, strings.TrimPrefix(e.path, root+"/"))
+		return true
+	}))
+	assert.ElementsMatch(t, []string{"a.go", "sub", "sub/b.go", "sub/c.txt", "sub/bin.go", "sub/deep", "sub/deep/f.log"}, paths)
+
+	q, err := newSearchQuery(searchData{Content: "HELLO", IgnoreCase: true})
+	require.NoError(t, err)
+	files := []string{filepath.Join(root, "a.go"), filepath.Join(root, "sub/b.go"), filepath.Join(root, "sub/bin.go")}
+	out, _ = exec.Command("sh", "-c", grepCommand(q, q.Content, files)).Output()
+	var lines []string
+	require.NoError(t, readGrepMatches(strings.NewReader(string(out)), func(p string, line int, text []byte) bool {
+		lines = append(lines, strings.TrimPrefix(p, root+"/")+":"+string(text))
+		return true
+	}))
+	assert.Equal(t, []string{"a.go:func Hello() {}", "sub/b.go:// hello world"}, lines)
+}
+
+// newTestSSHFileSystem returns an SFTP file system whose SSH server runs
+// commands locally, so that searches go through find and grep.
+func newTestSSHFileSystem(t *testing.T) *SFTPFileSystem {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSH(nc, config)
+		}
+	}()
+
+	sshClient, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	client, err := sftp.NewClient(sshClient)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		sshClient.Close()
+	})
+
+	return &SFTPFileSystem{
+		Client:    client,
+		Logger:    log.New(io.Discard, "", 0),
+		sshClient: sshClient,
+		separator: "/",
+	}
+}
+
+func serveTestSSH(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSession(ch, requests)
+	}
+}
+
+func serveTestSession(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(true, nil)
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+			var status struct{ Status uint32 }
+			if err := cmd.Run(); err != nil {
+				status.Status = 127
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) {
+					status.Status = uint32(exitErr.ExitCode())
+				}
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+			return
+		case "subsystem":
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err == nil {
+				server.Serve()
+			}
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestSearchRegex(t *testing.T) {
+	if out, err := exec.Command("sh", "-c", findCommand(".", false)+" -quit").CombinedOutput(); err != nil {
+		t.Skipf("find cannot run the remote command: %v: %s", err, out)
+	}
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "v.txt"), []byte("version v2\nvd\n"), 0644))
+
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSSHFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// a digit for Go, a plain d for grep -E
+			assert.Equal(t, []searchMatch{
+				{Path: "v.txt", Line: 1, Text: "version v2"},
+			}, searchAll(t, fs, root, searchData{Content: `v\d`, ContentRegex: true}))
+
+			assert.Equal(t, []searchMatch{
+				{Path: "v.txt", Line: 2, Text: "vd"},
+			}, searchAll(t, fs, root, searchData{Content: `vd`}))
+		})
+	}
+}
@@ -1,9 +1,15 @@
 package fs
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"sync"
+	"time"
 
+	"webshell/service/limits"
+	"webshell/service/sandbox"
 	ws "webshell/websocket"
 )
 
@@ -32,16 +38,48 @@ type createData struct {
 }
 type copyData struct {
 	Dest string `json:"dest"`
+	// Conflict is the conflict policy, rename when empty.
+	Conflict string `json:"conflict,omitempty"`
+	jobData
 }
 type moveData struct {
-	Dest string `json:"dest"`
+	Dest     string `json:"dest"`
+	Conflict string `json:"conflict,omitempty"`
+	jobData
+}
+
+// transferResult is the reply to copies and moves.
+type transferResult struct {
+	// Path is where the source ended up, empty when skipped.
+	Path    string `json:"path,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+}
+type deleteData struct {
+	// Permanent skips the trash.
+	Permanent bool `json:"permanent,omitempty"`
+	jobData
 }
 
 type FSService struct {
 	conn *ws.Conn
 
 	FS FileSystem
+	// Encoding is tried first when guessing the charset of a file.
+	Encoding string
 	*log.Logger
+
+	// watched directories, nil while a watch starts
+	watchMu sync.Mutex
+	watches map[string]*watch
+	// running searches by directory
+	searchMu sync.Mutex
+	searches map[string]context.CancelFunc
+	// running copies, moves and deletes by job id
+	jobMu sync.Mutex
+	jobs  map[string]*job
+	// last purge of old trash items
+	purgeMu  sync.Mutex
+	purgedAt time.Time
 }
 
 // Register implements service.Service.
@@ -69,10 +107,46 @@ func (s *FSService) HandleTextMessage(id, action string, data json.RawMessage) {
 		go s.handleCopy(id, data)
 	case actionMove:
 		go s.handleMove(id, data)
+	case actionRead:
+		go s.handleRead(id, data)
+	case actionWrite:
+		go s.handleWrite(id, data)
+	case actionChmod:
+		go s.handleChmod(id, data)
+	case actionChown:
+		go s.handleChown(id, data)
+	case actionSymlink:
+		go s.handleSymlink(id, data)
+	case actionReadlink:
+		go s.handleReadlink(id)
+	case actionWatch:
+		go s.handleWatch(id)
+	case actionUnwatch:
+		go s.handleUnwatch(id)
+	case actionSearch:
+		go s.handleSearch(id, data)
+	case actionSearchCancel:
+		go s.handleSearchCancel(id)
+	case actionCancel:
+		go s.handleCancel(id)
+	case actionJobs:
+		go s.handleJobs(id)
+	case actionTrashList:
+		go s.handleTrashList(id)
+	case actionTrashRestore:
+		go s.handleTrashRestore(id)
+	case actionTrashEmpty:
+		go s.handleTrashEmpty(id, data)
+	case actionBatchDelete, actionBatchCopy, actionBatchMove, actionBatchChmod:
+		go s.handleBatch(id, action, data)
 	}
 }
 
-func (s *FSService) Cleanup(err error) {}
+func (s *FSService) Cleanup(err error) {
+	s.closeWatches()
+	s.cancelSearches()
+	s.cancelJobs()
+}
 
 func (s *FSService) handleMove(id string, data json.RawMessage) {
 	var d moveData
@@ -81,17 +155,12 @@ func (s *FSService) handleMove(id string, data json.RawMessage) {
 		return
 	}
 
-	err := s.FS.Move(id, d.Dest)
-	if err != nil {
-		s.handleError(id, actionMove, err)
-		return
-	}
-
-	s.conn.WriteJSON(&ws.ServiceMessage{
-		Service: s.Name(),
-		Id:      id,
-		Action:  actionMove,
+	var target string
+	err := s.runJob(actionMove, id, d.jobData, func(ctx context.Context, p *progress) (err error) {
+		target, err = s.FS.Move(ctx, id, d.Dest, d.Conflict, p)
+		return err
 	})
+	s.replyTransfer(id, actionMove, target, err)
 }
 
 func (s *FSService) handleCopy(id string, data json.RawMessage) {
@@ -101,21 +170,49 @@ func (s *FSService) handleCopy(id string, data json.RawMessage) {
 		return
 	}
 
-	err := s.FS.Copy(id, d.Dest)
+	var target string
+	err := s.runJob(actionCopy, id, d.jobData, func(ctx context.Context, p *progress) (err error) {
+		target, err = s.FS.Copy(ctx, id, d.Dest, d.Conflict, p)
+		return err
+	})
+	s.replyTransfer(id, actionCopy, target, err)
+}
+
+func (s *FSService) replyTransfer(id, action, target string, err error) {
 	if err != nil {
-		s.handleError(id, actionCopy, err)
+		s.handleError(id, action, err)
 		return
 	}
 
+	r, err := json.Marshal(transferResult{Path: target, Skipped: target == ""})
+	if err != nil {
+		s.Printf("error marshalling %s response: %v", action, err)
+		return
+	}
 	s.conn.WriteJSON(&ws.ServiceMessage{
 		Service: s.Name(),
 		Id:      id,
-		Action:  actionCopy,
+		Action:  action,
+		Data:    r,
 	})
 }
 
-func (s *FSService) handleDelete(id string, _ json.RawMessage) {
-	err := s.FS.Delete(id)
+func (s *FSService) handleDelete(id string, data json.RawMessage) {
+	var d deleteData
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.Printf("error unmarshalling fs delete payload: %v", err)
+			return
+		}
+	}
+
+	err := s.runJob(actionDelete, id, d.jobData, func(ctx context.Context, p *progress) error {
+		if d.Permanent {
+			return s.FS.Delete(ctx, id, p)
+		}
+		s.purgeOldTrash(ctx)
+		return s.FS.Trash(ctx, id, p)
+	})
 	if err != nil {
 		s.handleError(id, actionDelete, err)
 		return
@@ -221,10 +318,50 @@ func (s *FSService) handleGetRoot(id string) {
 func (s *FSService) handleError(id, action string, err error) {
 	s.Println(err)
 
-	s.conn.WriteJSON(&ws.ServiceMessage{
+	msg := &ws.ServiceMessage{
 		Service: s.Name(),
 		Id:      id,
 		Action:  action,
 		Error:   err.Error(),
-	})
+	}
+	msg.Data = errorData(err)
+	s.conn.WriteJSON(msg)
+}
+
+// errorData returns the details of errors with a code the client can tell
+// apart, nil for others.
+func errorData(err error) json.RawMessage {
+	var (
+		outsideErr  *sandbox.OutsideRootError
+		conflictErr *ConflictError
+		tooLargeErr *TooLargeError
+		limitErr    *limits.LimitError
+		canceledErr *CanceledError
+		existsErr   *ExistsError
+		encodeErr   *UnencodableError
+		noTrashErr  *NoTrashError
+		detail      any
+	)
+	switch {
+	case errors.As(err, &outsideErr):
+		detail = outsideErr
+	case errors.As(err, &conflictErr):
+		detail = conflictErr
+	case errors.As(err, &tooLargeErr):
+		detail = tooLargeErr
+	case errors.As(err, &limitErr):
+		detail = limitErr
+	case errors.As(err, &canceledErr):
+		detail = canceledErr
+	case errors.As(err, &existsErr):
+		detail = existsErr
+	case errors.As(err, &encodeErr):
+		detail = encodeErr
+	case errors.As(err, &noTrashErr):
+		detail = noTrashErr
+	default:
+		return nil
+	}
+	r, _ := json.Marshal(detail)
+	return r
 }
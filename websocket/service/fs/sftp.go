@@ -1,15 +1,28 @@
 package fs
 
 import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"webshell/service/sandbox"
+	"webshell/utils"
 	ws "webshell/websocket"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/text/encoding"
 )
 
 type SFTPFileSystem struct {
@@ -17,6 +30,22 @@ type SFTPFileSystem struct {
 	sshClient *ssh.Client
 	*log.Logger
 	separator string // 路径分隔符
+	// 远程文件名的字符集, nil 表示 UTF-8
+	encoding encoding.Encoding
+	// 允许访问的目录, 为空时使用 home 目录
+	roots []string
+
+	// 远程 /etc/passwd 和 /etc/group 中的用户名和组名, 首次使用时读取
+	namesOnce sync.Once
+	names     *remoteNames
+}
+
+// remoteNames 是远程系统的用户和组
+type remoteNames struct {
+	users    map[uint32]string
+	groups   map[uint32]string
+	userIds  map[string]uint32
+	groupIds map[string]uint32
 }
 
 // 检测远程系统类型并返回对应的路径分隔符
@@ -61,18 +90,85 @@ func (s *SFTPFileSystem) joinPath(elem ...string) string {
 	return p
 }
 
+// remote 将前端使用的 UTF-8 路径转换为远程字符集
+func (s *SFTPFileSystem) remote(p string) string {
+	if s.encoding == nil {
+		return p
+	}
+	encoded, err := encoding.ReplaceUnsupported(s.encoding.NewEncoder()).String(p)
+	if err != nil {
+		return p
+	}
+	return encoded
+}
+
+// local 将远程字符集的文件名转换为 UTF-8
+func (s *SFTPFileSystem) local(p string) string {
+	if s.encoding == nil {
+		return p
+	}
+	decoded, err := s.encoding.NewDecoder().String(p)
+	if err != nil {
+		return p
+	}
+	return decoded
+}
+
+// jailPath 将前端路径转换为 jail 检查的远程路径, jail 只接受 / 分隔的路径
+func (s *SFTPFileSystem) jailPath(p string) string {
+	p = s.remote(p)
+	if s.separator == "\\" {
+		p = strings.ReplaceAll(p, "\\", "/")
+	}
+	return p
+}
+
+// shellQuote 将参数包裹在单引号中, 供远程 shell 命令使用
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // GetRoot implements fileSystem.
 func (s *SFTPFileSystem) GetRoot() ([]*FileSystemEntry, error) {
+	if len(s.roots) == 0 {
+		home, err := s.home()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := s.rootEntry("/", home)
+		if err != nil {
+			return nil, err
+		}
+		return []*FileSystemEntry{entry}, nil
+	}
+
+	entries := make([]*FileSystemEntry, 0, len(s.roots))
+	for _, root := range s.roots {
+		name := "/"
+		if len(s.roots) > 1 {
+			name = s.local(root)
+		}
+		entry, err := s.rootEntry(name, root)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// home 返回远程用户的 home 目录
+func (s *SFTPFileSystem) home() (string, error) {
 	// Get home directory using ssh session
 	session, err := s.sshClient.NewSession()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ssh session: %w", err)
+		return "", fmt.Errorf("failed to create ssh session: %w", err)
 	}
 	defer session.Close()
 
 	output, err := session.Output("echo $HOME")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return "", fmt.Errorf("failed to get home directory: %w", err)
 	}
 
 	// Trim any whitespace/newlines from the output
@@ -80,28 +176,29 @@ func (s *SFTPFileSystem) GetRoot() ([]*FileSystemEntry, error) {
 	if homePath == "" {
 		homePath = "~" // fallback to ~ if we couldn't get the explicit path
 	}
+	return homePath, nil
+}
 
-	// Get file info of the home directory
-	info, err := s.Client.Stat(homePath)
+func (s *SFTPFileSystem) rootEntry(name, remotePath string) (*FileSystemEntry, error) {
+	// Get file info of the root directory
+	info, err := s.Client.Stat(remotePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory info: %w", err)
+		return nil, fmt.Errorf("failed to get root directory info: %w", err)
 	}
 
-	entry := &FileSystemEntry{
-		Name:    "/",
-		Path:    homePath,
+	return &FileSystemEntry{
+		Name:    name,
+		Path:    s.local(remotePath),
 		IsDir:   true,
 		Size:    info.Size(),
 		Mode:    info.Mode(),
 		ModTime: info.ModTime().Unix(),
-	}
-
-	return []*FileSystemEntry{entry}, nil
+	}, nil
 }
 
 // List implements fileSystem.
 func (s *SFTPFileSystem) List(path string, showHidden bool) ([]*FileSystemEntry, error) {
-	files, err := s.Client.ReadDir(path)
+	files, err := s.Client.ReadDir(s.remote(path))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read directory: %w", err)
 	}
@@ -113,21 +210,36 @@ func (s *SFTPFileSystem) List(path string, showHidden bool) ([]*FileSystemEntry,
 			continue
 		}
 
-		entries = append(entries, &FileSystemEntry{
-			Name:    file.Name(),
-			Path:    s.joinPath(path, file.Name()),
+		name := s.local(file.Name())
+		entry := &FileSystemEntry{
+			Name:    name,
+			Path:    s.joinPath(path, name),
 			Size:    file.Size(),
 			Mode:    file.Mode(),
 			ModTime: file.ModTime().Unix(),
 			IsDir:   file.IsDir(),
-		})
+		}
+		if st, ok := file.Sys().(*sftp.FileStat); ok {
+			entry.Owner, entry.Group = s.ownerNames(st.UID, st.GID)
+		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			remotePath := s.remote(entry.Path)
+			entry.IsSymlink = true
+			if target, err := s.Client.ReadLink(remotePath); err == nil {
+				entry.LinkTarget = s.local(target)
+			}
+			if target, err := s.Client.Stat(remotePath); err == nil {
+				entry.IsDir = target.IsDir()
+			}
+		}
+		entries = append(entries, entry)
 	}
 	return entries, nil
 }
 
 // Create implements fileSystem.
 func (s *SFTPFileSystem) Create(parentPath string, name string, isDir bool) error {
-	fullPath := s.joinPath(parentPath, name)
+	fullPath := s.remote(s.joinPath(parentPath, name))
 
 	if isDir {
 		return s.Client.MkdirAll(fullPath)
@@ -141,81 +253,185 @@ func (s *SFTPFileSystem) Create(parentPath string, name string, isDir bool) erro
 }
 
 // Delete implements fileSystem.
-func (s *SFTPFileSystem) Delete(path string) error {
-	// Check if it's a directory first
-	info, err := s.Client.Stat(path)
+func (s *SFTPFileSystem) Delete(ctx context.Context, path string, p *progress) error {
+	path = s.remote(path)
+
+	info, err := s.Client.Lstat(path)
 	if err != nil {
 		return fmt.Errorf("failed to stat path: %w", err)
 	}
 
+	if err := s.count(ctx, path, info, p, nil); err != nil {
+		return err
+	}
+	return s.removeTree(ctx, path, info, p)
+}
+
+// count 统计 p 下的文件数和字节数, sizes 不为 nil 时记录每个普通文件的大小
+func (s *SFTPFileSystem) count(ctx context.Context, p string, info os.FileInfo, prog *progress, sizes map[string]int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			prog.addTotal(1, info.Size())
+			if sizes != nil {
+				sizes[p] = info.Size()
+			}
+		} else {
+			prog.addTotal(1, 0)
+		}
+		return nil
+	}
+
+	prog.addTotal(1, 0)
+	files, err := s.Client.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := s.count(ctx, path.Join(p, file.Name()), file, prog, sizes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTree 删除 p 及其下的所有文件
+func (s *SFTPFileSystem) removeTree(ctx context.Context, p string, info os.FileInfo, prog *progress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if info.IsDir() {
-		// Remove directory and its contents
-		return s.Client.RemoveAll(path)
+		files, err := s.Client.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := s.removeTree(ctx, path.Join(p, file.Name()), file, prog); err != nil {
+				return err
+			}
+		}
+		if err := s.Client.RemoveDirectory(p); err != nil {
+			return err
+		}
+		prog.add(1, 0)
+		return nil
 	}
 
-	// Remove single file
-	return s.Client.Remove(path)
+	if err := s.Client.Remove(p); err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		prog.add(1, info.Size())
+	} else {
+		prog.add(1, 0)
+	}
+	return nil
 }
 
 // Copy implements fileSystem.
-func (s *SFTPFileSystem) Copy(src string, dest string) error {
+func (s *SFTPFileSystem) Copy(ctx context.Context, src, dest, policy string, p *progress) (string, error) {
+	src, dest = s.jailPath(src), s.jailPath(dest)
+
 	// 先检查源路径是否存在
-	if _, err := s.Client.Stat(src); err != nil {
-		return fmt.Errorf("source path does not exist: %w", err)
+	srcInfo, err := s.Client.Stat(src)
+	if err != nil {
+		return "", fmt.Errorf("source path does not exist: %w", err)
 	}
+	return s.transferResult(transfer(ctx, sftpStore{s}, src, dest, srcInfo, policy, false, p))
+}
 
-	destPath := s.joinPath(dest, path.Base(src))
-	if _, err := s.Client.Stat(destPath); err == nil {
-		destPath = s.joinPath(dest, path.Base(src)+" copy")
+// transferResult 将 transfer 返回的远程路径转换为前端路径
+func (s *SFTPFileSystem) transferResult(target string, err error) (string, error) {
+	var existsErr *ExistsError
+	if errors.As(err, &existsErr) {
+		existsErr.Path = s.clientPath(existsErr.Path)
+	}
+	if err != nil || target == "" {
+		return "", err
 	}
+	return s.clientPath(target), nil
+}
 
-	// 尝试使用cp命令
-	if s.sshClient != nil {
-		// 先检查 cp 命令是否存在
-		checkSession, err := s.sshClient.NewSession()
-		if err != nil {
-			return fmt.Errorf("failed to create ssh session: %w", err)
-		}
+// copyTree 复制 src 到不存在的 dst, 优先使用远程 cp 命令, 没有 cp 时只通过 SFTP 复制
+func (s *SFTPFileSystem) copyTree(ctx context.Context, src, dst string, info os.FileInfo, p *progress) error {
+	if !s.hasCp() {
+		return s.copySFTP(ctx, src, dst, info, p)
+	}
 
-		defer checkSession.Close()
-		err = checkSession.Run("which cp")
-		if err != nil {
-			return fmt.Errorf("cp command not found: %w", err)
+	sizes := make(map[string]int64)
+	if err := s.count(ctx, src, info, p, sizes); err != nil {
+		return err
+	}
+	if err := s.copyCommand(ctx, src, dst, sizes, p); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		return err
+	}
+	return nil
+}
 
-		// cp命令存在，执行复制操作
-		copySession, err := s.sshClient.NewSession()
-		if err != nil {
-			return fmt.Errorf("failed to create ssh session: %w", err)
-		}
-		defer copySession.Close()
+// hasCp 检查远程是否有 cp 命令, Windows 服务器上不使用 cp
+func (s *SFTPFileSystem) hasCp() bool {
+	if s.sshClient == nil || s.separator == "\\" {
+		return false
+	}
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+	return session.Run("which cp") == nil
+}
 
-		if err := copySession.Run(fmt.Sprintf("cp -a %q %q", src, destPath)); err != nil {
-			return fmt.Errorf("cp command failed: %w", err)
+// copyCommand 在远程执行 cp -av, 根据输出的每一行统计进度
+func (s *SFTPFileSystem) copyCommand(ctx context.Context, src, destPath string, sizes map[string]int64, p *progress) error {
+	lines := 0
+	stderr, err := s.runCommand(ctx, fmt.Sprintf("cp -av %s %s", shellQuote(src), shellQuote(destPath)), func(r io.Reader) error {
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			lines++
+			// GNU cp: 'src' -> 'dst'
+			line := sc.Text()
+			if from, _, ok := strings.Cut(strings.TrimPrefix(line, "'"), "' -> '"); ok {
+				p.add(1, sizes[from])
+			} else {
+				p.add(1, 0)
+			}
 		}
-		return nil
+		return sc.Err()
+	})
+	if err != nil && lines == 0 && ctx.Err() == nil {
+		// 不支持 -v 时不统计进度
+		s.Client.RemoveAll(destPath)
+		stderr, err = s.runCommand(ctx, fmt.Sprintf("cp -a %s %s", shellQuote(src), shellQuote(destPath)), func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		})
 	}
-	return fmt.Errorf("ssh client not available")
+	if err != nil {
+		return fmt.Errorf("cp command failed: %w: %s", err, strings.TrimSpace(string(stderr)))
+	}
+	return nil
 }
 
 // Move implements fileSystem.
-func (s *SFTPFileSystem) Move(src string, dest string) error {
-	srcStat, err := s.Client.Stat(src)
+func (s *SFTPFileSystem) Move(ctx context.Context, src, dest, policy string, p *progress) (string, error) {
+	src, dest = s.jailPath(src), s.jailPath(dest)
 
+	srcInfo, err := s.Client.Lstat(src)
 	if err != nil {
-		return fmt.Errorf("source path does not exist: %w", err)
+		return "", fmt.Errorf("source path does not exist: %w", err)
 	}
-
-	newPath := s.joinPath(dest, srcStat.Name())
-
-	if _, err := s.Client.Stat(newPath); err == nil {
-		newPath = s.joinPath(dest, srcStat.Name()+" copy")
-	}
-	return s.Client.Rename(src, newPath)
+	return s.transferResult(transfer(ctx, sftpStore{s}, src, dest, srcInfo, policy, true, p))
 }
 
 // Rename implements fileSystem.
 func (s *SFTPFileSystem) Rename(oldPath string, newName string) error {
+	oldPath, newName = s.remote(oldPath), s.remote(newName)
+
 	// Get the parent directory of the oldPath
 	parentDir := filepath.Dir(oldPath)
 	// Construct the new full path
@@ -228,11 +444,596 @@ func (s *SFTPFileSystem) Rename(oldPath string, newName string) error {
 	return nil
 }
 
-// NewSFTPService creates a new SFTP filesystem with both SFTP and SSH clients
-func NewSFTPService(sshClient *ssh.Client) (ws.Service, error) {
-	sftpClient, err := sftp.NewClient(sshClient)
+// ReadFile implements fileSystem.
+func (s *SFTPFileSystem) ReadFile(path string, maxSize int64) ([]byte, os.FileInfo, error) {
+	f, err := s.Client.Open(s.remote(path))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readLimited(f, info, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, info, nil
+}
+
+// WriteFile implements fileSystem. The content goes to a temporary file
+// that replaces the original, so a failed save leaves it intact.
+func (s *SFTPFileSystem) WriteFile(path string, data []byte) (os.FileInfo, error) {
+	path = s.remote(path)
+
+	// replace the file a link points to, not the link
+	path = s.followLinks(path)
+
+	info, err := s.Client.Stat(path)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	mode := os.FileMode(0644)
+	if exists {
+		mode = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		rule := ruleFor(backupRules, strings.ReplaceAll(path, "\\", "/"))
+		if err := backup(sftpBackups{s}, path, rule, time.Now()); err != nil {
+			return nil, fmt.Errorf("failed to back up file: %w", err)
+		}
+	}
+
+	dir, name := s.split(path)
+	tmp := s.joinPath(dir, fmt.Sprintf(".%s.webshell-%d", name, time.Now().UnixNano()))
+	f, err := s.Client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer s.Client.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := s.Client.Chmod(tmp, mode); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		if err := s.keepOwner(tmp, info); err != nil {
+			// keeping the owner matters more than an atomic save
+			s.Printf("cannot keep owner of %s, writing in place: %v", path, err)
+			return s.writeInPlace(path, data)
+		}
+	}
+
+	if _, ok := s.Client.HasExtension("posix-rename@openssh.com"); ok {
+		err = s.Client.PosixRename(tmp, path)
+	} else {
+		// plain SFTP renames fail when the target exists
+		if exists {
+			if err := s.Client.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		err = s.Client.Rename(tmp, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to replace file: %w", err)
+	}
+	return s.Client.Stat(path)
+}
+
+// followLinks returns the file the symlink at p points to, through any
+// number of links. Servers do not all resolve links in RealPath.
+func (s *SFTPFileSystem) followLinks(p string) string {
+	for range 40 {
+		info, err := s.Client.Lstat(p)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return p
+		}
+		target, err := s.Client.ReadLink(p)
+		if err != nil {
+			return p
+		}
+		if !path.IsAbs(target) && !strings.HasPrefix(target, s.separator) {
+			dir, _ := s.split(p)
+			target = s.joinPath(dir, target)
+		}
+		p = target
+	}
+	return p
+}
+
+// keepOwner gives the file at p the owner of info, if it differs.
+func (s *SFTPFileSystem) keepOwner(p string, info os.FileInfo) error {
+	want, ok := info.Sys().(*sftp.FileStat)
+	if !ok {
+		return nil
+	}
+	current, err := s.Client.Stat(p)
+	if err != nil {
+		return err
+	}
+	if have, ok := current.Sys().(*sftp.FileStat); ok && have.UID == want.UID && have.GID == want.GID {
+		return nil
+	}
+	return s.Client.Chown(p, int(want.UID), int(want.GID))
+}
+
+func (s *SFTPFileSystem) writeInPlace(path string, data []byte) (os.FileInfo, error) {
+	f, err := s.Client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return s.Client.Stat(path)
+}
+
+// split 返回远程路径的父目录和文件名
+func (s *SFTPFileSystem) split(p string) (string, string) {
+	i := strings.LastIndex(p, s.separator)
+	if i < 0 {
+		return ".", p
+	}
+	if i == 0 {
+		return s.separator, p[1:]
+	}
+	return p[:i], p[i+1:]
+}
+
+// sftpBackups keeps backups next to remote files.
+type sftpBackups struct {
+	s *SFTPFileSystem
+}
+
+func (b sftpBackups) copyFile(src, dst string) error {
+	in, err := b.s.Client.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := b.s.Client.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	// 新建的文件使用服务器的默认权限, 写入内容前先改为与原文件相同
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (b sftpBackups) readDir(dir string) ([]string, error) {
+	infos, err := b.s.Client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
+
+func (b sftpBackups) remove(p string) error {
+	return b.s.Client.Remove(p)
+}
+
+func (b sftpBackups) split(p string) (string, string) {
+	return b.s.split(p)
+}
+
+func (b sftpBackups) join(dir, name string) string {
+	return b.s.joinPath(dir, name)
+}
+
+// Chmod implements fileSystem.
+func (s *SFTPFileSystem) Chmod(path string, mode os.FileMode, recursive bool, prog *progress) error {
+	if recursive {
+		err := s.walk(s.remote(path), true, func(string, os.FileInfo) error {
+			prog.addTotal(1, 0)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.walk(s.remote(path), recursive, func(p string, info os.FileInfo) error {
+		// the mode of a link is that of its target
+		if info.Mode()&os.ModeSymlink == 0 {
+			if err := s.Client.Chmod(p, mode); err != nil {
+				return err
+			}
+		}
+		prog.add(1, 0)
+		return nil
+	})
+}
+
+// Chown implements fileSystem.
+func (s *SFTPFileSystem) Chown(path, owner, group string, recursive bool) error {
+	uid, gid, err := s.lookupOwner(owner, group)
+	if err != nil {
+		return err
+	}
+	return s.walk(s.remote(path), recursive, func(p string, info os.FileInfo) error {
+		// SFTP 没有 lchown, 设置链接会改到它指向的文件
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		// SFTP sets both, keep what is not given
+		st, ok := info.Sys().(*sftp.FileStat)
+		if !ok {
+			return fmt.Errorf("no owner information for %s", p)
+		}
+		u, g := st.UID, st.GID
+		if uid >= 0 {
+			u = uint32(uid)
+		}
+		if gid >= 0 {
+			g = uint32(gid)
+		}
+		return s.Client.Chown(p, int(u), int(g))
+	})
+}
+
+// walk 对 path 调用 fn, recursive 时包括其下所有文件, 不跟随链接
+func (s *SFTPFileSystem) walk(path string, recursive bool, fn func(string, os.FileInfo) error) error {
+	if !recursive {
+		info, err := s.Client.Lstat(path)
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	}
+	walker := s.Client.Walk(path)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if err := fn(walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Symlink implements fileSystem.
+func (s *SFTPFileSystem) Symlink(target, linkPath string) error {
+	return s.Client.Symlink(s.remote(target), s.remote(linkPath))
+}
+
+// ReadLink implements fileSystem.
+func (s *SFTPFileSystem) ReadLink(path string) (string, error) {
+	target, err := s.Client.ReadLink(s.remote(path))
+	if err != nil {
+		return "", err
+	}
+	return s.local(target), nil
+}
+
+// remoteNames 读取远程的用户和组, 读不到时只显示 id
+func (s *SFTPFileSystem) remoteNames() *remoteNames {
+	s.namesOnce.Do(func() {
+		s.names = &remoteNames{
+			users:    make(map[uint32]string),
+			groups:   make(map[uint32]string),
+			userIds:  make(map[string]uint32),
+			groupIds: make(map[string]uint32),
+		}
+		s.readIdFile("/etc/passwd", s.names.users, s.names.userIds)
+		s.readIdFile("/etc/group", s.names.groups, s.names.groupIds)
+	})
+	return s.names
+}
+
+// readIdFile 解析 name:x:id:... 格式的文件
+func (s *SFTPFileSystem) readIdFile(p string, names map[uint32]string, ids map[string]uint32) {
+	f, err := s.Client.Open(p)
+	if err != nil {
+		s.Printf("cannot read remote %s: %v", p, err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := names[uint32(id)]; !ok {
+			names[uint32(id)] = fields[0]
+		}
+		ids[fields[0]] = uint32(id)
+	}
+}
+
+func (s *SFTPFileSystem) ownerNames(uid, gid uint32) (string, string) {
+	names := s.remoteNames()
+	owner, ok := names.users[uid]
+	if !ok {
+		owner = strconv.FormatUint(uint64(uid), 10)
+	}
+	group, ok := names.groups[gid]
+	if !ok {
+		group = strconv.FormatUint(uint64(gid), 10)
+	}
+	return owner, group
+}
+
+// lookupOwner 返回用户和组的 id, 未指定的为 -1
+func (s *SFTPFileSystem) lookupOwner(owner, group string) (int64, int64, error) {
+	names := s.remoteNames()
+	uid, gid := int64(-1), int64(-1)
+	if owner != "" {
+		if id, err := strconv.ParseUint(owner, 10, 32); err == nil {
+			uid = int64(id)
+		} else if id, ok := names.userIds[owner]; ok {
+			uid = int64(id)
+		} else {
+			return 0, 0, fmt.Errorf("unknown user: %s", owner)
+		}
+	}
+	if group != "" {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			gid = int64(id)
+		} else if id, ok := names.groupIds[group]; ok {
+			gid = int64(id)
+		} else {
+			return 0, 0, fmt.Errorf("unknown group: %s", group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// sftpTrashName 是远程回收站的目录名, 位于每个根目录下
+const sftpTrashName = ".webshell-trash"
+
+// clientPath 将远程路径转换为前端使用的路径
+func (s *SFTPFileSystem) clientPath(p string) string {
+	p = s.local(p)
+	if s.separator == "\\" {
+		p = strings.ReplaceAll(p, "/", "\\")
+	}
+	return p
+}
+
+// trashes 返回每个根目录的回收站, 使用 / 分隔的远程路径
+func (s *SFTPFileSystem) trashes() ([]string, error) {
+	roots := s.roots
+	if len(roots) == 0 {
+		home, err := s.Client.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get remote home directory: %w", err)
+		}
+		roots = []string{home}
+	}
+	trashes := make([]string, len(roots))
+	for i, root := range roots {
+		trashes[i] = path.Join(root, sftpTrashName)
+	}
+	return trashes, nil
+}
+
+// Trash implements fileSystem.
+func (s *SFTPFileSystem) Trash(ctx context.Context, p string, prog *progress) error {
+	remotePath := path.Clean(s.jailPath(p))
+	trash, inTrash, err := s.trashFor(remotePath)
+	if err != nil {
+		return err
+	}
+	if inTrash {
+		// 回收站中的文件直接删除
+		return s.Delete(ctx, p, prog)
+	}
+	if _, err := s.Client.Lstat(remotePath); err != nil {
+		return err
+	}
+
+	_, err = moveToTrash(ctx, sftpStore{s}, trash, remotePath, remotePath, time.Now(), prog)
+	return err
+}
+
+// trashFor 返回远程路径 p 所在根目录的回收站, inTrash 表示 p 已在回收站中
+func (s *SFTPFileSystem) trashFor(p string) (trash string, inTrash bool, err error) {
+	trashes, err := s.trashes()
+	if err != nil {
+		return "", false, err
+	}
+	for _, t := range trashes {
+		if p == t || strings.HasPrefix(p, t+"/") {
+			return t, true, nil
+		}
+		root := path.Dir(t)
+		if (p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")) && len(t) > len(trash) {
+			trash = t
+		}
+	}
+	if trash == "" {
+		trash = trashes[0]
+	}
+	return trash, false, nil
+}
+
+// TrashList implements fileSystem.
+func (s *SFTPFileSystem) TrashList() ([]*trashEntry, error) {
+	trashes, err := s.trashes()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*trashEntry
+	for _, trash := range trashes {
+		items, err := listTrash(sftpStore{s}, trash)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			item.Id, item.Name, item.Path = s.clientPath(item.Id), s.local(item.Name), s.clientPath(item.Path)
+		}
+		entries = append(entries, items...)
+	}
+	slices.SortFunc(entries, func(a, b *trashEntry) int {
+		return cmp.Compare(b.DeletedAt, a.DeletedAt)
+	})
+	return entries, nil
+}
+
+// Restore implements fileSystem.
+func (s *SFTPFileSystem) Restore(id string) (string, error) {
+	trashes, err := s.trashes()
+	if err != nil {
+		return "", err
+	}
+	st := sftpStore{s}
+	trash, name, ok := trashItem(st, trashes, path.Clean(s.jailPath(id)))
+	if !ok {
+		return "", fmt.Errorf("not in the trash: %s", id)
+	}
+	orig, err := restoreFromTrash(st, trash, name)
+	if err != nil {
+		return "", err
+	}
+	return s.clientPath(orig), nil
+}
+
+// EmptyTrash implements fileSystem.
+func (s *SFTPFileSystem) EmptyTrash(ctx context.Context, before time.Time, match func(string) bool, p *progress) error {
+	trashes, err := s.trashes()
+	if err != nil {
+		return err
+	}
+	if match != nil {
+		// 回收站记录的是远程路径
+		clientMatch := match
+		match = func(p string) bool { return clientMatch(s.clientPath(p)) }
+	}
+	for _, trash := range trashes {
+		if err := purgeTrash(ctx, sftpStore{s}, trash, before, match, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpStore 通过 SFTP 访问回收站和复制移动的文件, 路径均为 / 分隔的远程路径
+type sftpStore struct {
+	s *SFTPFileSystem
+}
+
+func (t sftpStore) lstat(p string) (os.FileInfo, error) {
+	return t.s.Client.Lstat(p)
+}
+
+func (t sftpStore) mkdirAll(p string) error {
+	return t.s.Client.MkdirAll(p)
+}
+
+func (t sftpStore) writeNew(p string, data []byte) error {
+	f, err := t.s.Client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// 服务器返回的错误码不统一
+		if _, statErr := t.s.Client.Lstat(p); statErr == nil {
+			return fmt.Errorf("%s: %w", p, os.ErrExist)
+		}
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		t.s.Client.Remove(p)
+		return err
+	}
+	return f.Close()
+}
+
+func (t sftpStore) readFile(p string) ([]byte, error) {
+	f, err := t.s.Client.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (t sftpStore) readDir(dir string) ([]os.FileInfo, error) {
+	return t.s.Client.ReadDir(dir)
+}
+
+func (t sftpStore) move(ctx context.Context, oldPath, newPath string, p *progress) error {
+	p.addTotal(1, 0)
+	if err := t.s.Client.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	p.add(1, 0)
+	return nil
+}
+
+func (t sftpStore) copyTree(ctx context.Context, src, dst string, info os.FileInfo, p *progress) error {
+	return t.s.copyTree(ctx, src, dst, info, p)
+}
+
+func (t sftpStore) trash(ctx context.Context, p string) (func() error, error) {
+	trash, _, err := t.s.trashFor(p)
+	if err != nil {
+		return nil, err
+	}
+	return trashAside(ctx, t, trash, p)
+}
+
+func (t sftpStore) removeAll(ctx context.Context, p string, prog *progress) error {
+	info, err := t.s.Client.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if err := t.s.count(ctx, p, info, prog, nil); err != nil {
+		return err
+	}
+	return t.s.removeTree(ctx, p, info, prog)
+}
+
+func (t sftpStore) split(p string) (string, string) {
+	return path.Dir(p), path.Base(p)
+}
+
+func (t sftpStore) join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// NewSFTPService creates a new SFTP filesystem with both SFTP and SSH clients,
+// limited to the roots of jail.
+// encodingName is the charset of remote file names, UTF-8 when empty.
+func NewSFTPService(sshClient *ssh.Client, sftpClient *sftp.Client, jail *sandbox.Jail, encodingName string) (ws.Service, error) {
+	enc, err := utils.LookupEncoding(encodingName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create sftp client: %w", err)
+		return nil, err
 	}
 
 	logger := log.New(log.Writer(), "[fs] ", log.LstdFlags)
@@ -249,12 +1050,38 @@ func NewSFTPService(sshClient *ssh.Client) (ws.Service, error) {
 		sshClient: sshClient,
 		Logger:    logger,
 		separator: separator,
+		encoding:  enc,
+		roots:     jail.Roots(),
 	}
 
 	service := &FSService{
-		FS:     fs,
-		Logger: logger,
+		FS:       newJailFileSystem(fs, jail, fs.jailPath),
+		Encoding: encodingName,
+		Logger:   logger,
 	}
 
 	return service, nil
 }
+
+// Watch implements fileSystem. SFTP 没有变更通知, 定时列目录比较修改时间
+func (s *SFTPFileSystem) Watch(path string, notify func(watchEvent)) (io.Closer, error) {
+	list := func() (map[string]pollState, error) {
+		files, err := s.Client.ReadDir(s.remote(path))
+		if err != nil {
+			return nil, err
+		}
+		state := make(map[string]pollState, len(files))
+		for _, file := range files {
+			state[s.local(file.Name())] = pollState{modTime: file.ModTime(), size: file.Size(), mode: file.Mode()}
+		}
+		return state, nil
+	}
+	join := func(dir, name string) string {
+		return s.joinPath(dir, name)
+	}
+	w, err := newPollWatcher(path, list, join, notify)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	return w, nil
+}
@@ -0,0 +1,326 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP 协议 v3 中复制文件用到的包
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpExtended = 200
+
+	sshFxfRead  = 0x01
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfExcl  = 0x20
+
+	sshFxOK = 0
+
+	copyDataExtension = "copy-data"
+)
+
+// copySFTP 只通过 SFTP 复制 src 到不存在的 dst, 保留权限, 修改时间和链接.
+// 服务器支持 copy-data 扩展时文件内容在服务器上复制.
+func (s *SFTPFileSystem) copySFTP(ctx context.Context, src, dst string, info os.FileInfo, p *progress) error {
+	if err := s.count(ctx, src, info, p, nil); err != nil {
+		return err
+	}
+
+	var cd *copyDataConn
+	if _, ok := s.Client.HasExtension(copyDataExtension); ok && s.sshClient != nil {
+		var err error
+		if cd, err = dialCopyData(s.sshClient); err != nil {
+			s.Printf("error opening sftp session for copy-data: %v", err)
+			cd = nil
+		} else {
+			defer cd.Close()
+		}
+	}
+	return s.copySFTPTree(ctx, src, dst, info, cd, p)
+}
+
+func (s *SFTPFileSystem) copySFTPTree(ctx context.Context, src, dst string, info os.FileInfo, cd *copyDataConn, p *progress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := s.Client.ReadLink(src)
+		if err != nil {
+			return err
+		}
+		if err := s.Client.Symlink(target, dst); err != nil {
+			return err
+		}
+		p.add(1, 0)
+		return nil
+	case info.IsDir():
+		if err := s.Client.Mkdir(dst); err != nil {
+			return fmt.Errorf("failed to create destination directory: %w", err)
+		}
+		files, err := s.Client.ReadDir(src)
+		if err != nil {
+			return fmt.Errorf("failed to read source directory: %w", err)
+		}
+		for _, file := range files {
+			if err := s.copySFTPTree(ctx, path.Join(src, file.Name()), path.Join(dst, file.Name()), file, cd, p); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := s.copySFTPFile(ctx, src, dst, info, cd, p); err != nil {
+			return err
+		}
+	default:
+		// 设备文件和管道等不复制
+		p.add(1, 0)
+		return nil
+	}
+	p.add(1, 0)
+
+	// Windows 等服务器不一定支持设置属性, 此时只复制内容
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := s.Client.Chmod(dst, mode); err != nil {
+		s.Printf("error keeping mode of %s: %v", dst, err)
+	}
+	if err := s.Client.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		s.Printf("error keeping modification time of %s: %v", dst, err)
+	}
+	return nil
+}
+
+func (s *SFTPFileSystem) copySFTPFile(ctx context.Context, src, dst string, info os.FileInfo, cd *copyDataConn, p *progress) error {
+	if cd != nil && !cd.failed {
+		err := cd.copyFile(src, dst)
+		if err == nil {
+			p.add(0, info.Size())
+			return nil
+		}
+		// 不再尝试 copy-data, 改为读写复制
+		s.Printf("error copying %s with copy-data: %v", src, err)
+		cd.failed = true
+		s.Client.Remove(dst)
+	}
+
+	srcFile, err := s.Client.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer srcFile.Close()
+
+	destFile, err := s.Client.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	if err := copyContents(ctx, destFile, srcFile, p); err != nil {
+		destFile.Close()
+		return fmt.Errorf("failed to copy file contents: %w", err)
+	}
+	return destFile.Close()
+}
+
+// copyDataConn 是单独的 SFTP 会话, 用于 pkg/sftp 不支持的 copy-data 扩展.
+// 请求逐个发送, 不能并发使用.
+type copyDataConn struct {
+	r      *bufio.Reader
+	w      io.WriteCloser
+	closer io.Closer
+	id     uint32
+	// failed 表示 copy-data 出错过, 之后不再使用
+	failed bool
+}
+
+func dialCopyData(client *ssh.Client) (*copyDataConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+	c, err := newCopyDataConn(r, w)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	c.closer = session
+	return c, nil
+}
+
+// newCopyDataConn 初始化 r 和 w 上的 SFTP 会话, 服务器不支持 copy-data 时失败
+func newCopyDataConn(r io.Reader, w io.WriteCloser) (*copyDataConn, error) {
+	c := &copyDataConn{r: bufio.NewReader(r), w: w}
+	if err := c.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	typ, data, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if typ != sshFxpVersion || len(data) < 4 {
+		return nil, fmt.Errorf("unexpected sftp packet %d", typ)
+	}
+	for data = data[4:]; len(data) > 0; {
+		var name, value string
+		if name, data, err = sftpString(data); err != nil {
+			return nil, err
+		}
+		if value, data, err = sftpString(data); err != nil {
+			return nil, err
+		}
+		if name == copyDataExtension && value == "1" {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("sftp server does not support %s", copyDataExtension)
+}
+
+func (c *copyDataConn) Close() error {
+	c.w.Close()
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// copyFile 在服务器上复制 src 的内容到新建的 dst
+func (c *copyDataConn) copyFile(src, dst string) error {
+	srcHandle, err := c.open(src, sshFxfRead)
+	if err != nil {
+		return err
+	}
+	defer c.close(srcHandle)
+	dstHandle, err := c.open(dst, sshFxfWrite|sshFxfCreat|sshFxfExcl)
+	if err != nil {
+		return err
+	}
+
+	// 读取长度为 0 表示复制到文件末尾
+	req := appendSFTPString(nil, copyDataExtension)
+	req = appendSFTPString(req, srcHandle)
+	req = binary.BigEndian.AppendUint64(req, 0)
+	req = binary.BigEndian.AppendUint64(req, 0)
+	req = appendSFTPString(req, dstHandle)
+	req = binary.BigEndian.AppendUint64(req, 0)
+	_, err = c.request(sshFxpExtended, req)
+	if closeErr := c.close(dstHandle); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *copyDataConn) open(p string, flags uint32) (string, error) {
+	req := appendSFTPString(nil, p)
+	req = binary.BigEndian.AppendUint32(req, flags)
+	// 不设置属性
+	req = binary.BigEndian.AppendUint32(req, 0)
+	data, err := c.request(sshFxpOpen, req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", p, err)
+	}
+	handle, _, err := sftpString(data)
+	return handle, err
+}
+
+func (c *copyDataConn) close(handle string) error {
+	_, err := c.request(sshFxpClose, appendSFTPString(nil, handle))
+	return err
+}
+
+// request 发送带 id 的请求, 返回 HANDLE 的内容, STATUS 不为 OK 时返回错误
+func (c *copyDataConn) request(typ byte, payload []byte) ([]byte, error) {
+	c.id++
+	id := c.id
+	if err := c.send(typ, append(binary.BigEndian.AppendUint32(nil, id), payload...)); err != nil {
+		return nil, err
+	}
+	respType, data, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != id {
+		return nil, fmt.Errorf("unexpected sftp response to request %d", id)
+	}
+	data = data[4:]
+
+	switch respType {
+	case sshFxpHandle:
+		return data, nil
+	case sshFxpStatus:
+		if len(data) < 4 {
+			return nil, errors.New("short sftp status packet")
+		}
+		code := binary.BigEndian.Uint32(data)
+		if code == sshFxOK {
+			return nil, nil
+		}
+		msg, _, _ := sftpString(data[4:])
+		return nil, fmt.Errorf("sftp status %d: %s", code, msg)
+	}
+	return nil, fmt.Errorf("unexpected sftp packet %d", respType)
+}
+
+func (c *copyDataConn) send(typ byte, payload []byte) error {
+	pkt := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	pkt = append(pkt, typ)
+	_, err := c.w.Write(append(pkt, payload...))
+	return err
+}
+
+func (c *copyDataConn) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256<<10 {
+		return 0, nil, fmt.Errorf("bad sftp packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func sftpString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short sftp packet")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil, errors.New("short sftp packet")
+	}
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
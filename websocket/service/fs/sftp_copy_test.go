@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSFTPCopyFallback(t *testing.T) {
+	fs := newTestSFTPFileSystem(t)
+	src := newCopyTree(t)
+	dest := t.TempDir()
+
+	// no ssh client, so no cp either
+	var p progress
+	target, err := fs.Copy(context.Background(), src, dest, conflictFail, &p)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dest, "src"), target)
+	assert.Equal(t, int64(5), p.files.Load())
+	assert.Equal(t, p.filesTotal.Load(), p.files.Load())
+	assert.Equal(t, int64(5+3*copyChunkSize), p.bytes.Load())
+
+	info, err := os.Stat(filepath.Join(target, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.Equal(t, 2020, info.ModTime().Year())
+	info, err = os.Stat(filepath.Join(target, "sub"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	data, err := os.ReadFile(filepath.Join(target, "sub", "big"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", 3*copyChunkSize), string(data))
+	link, err := os.Readlink(filepath.Join(target, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", link)
+
+	// stopped copies leave nothing behind
+	dest = t.TempDir()
+	_, err = fs.Copy(newCountdownContext(3), src, dest, conflictFail, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	entries, err := os.ReadDir(dest)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// fakeCopyDataServer answers the requests of a copyDataConn with local
+// files, failing copy-data when fail is set.
+type fakeCopyDataServer struct {
+	r      io.Reader
+	w      io.Writer
+	fail   bool
+	copies int
+}
+
+func (s *fakeCopyDataServer) serve() {
+	handles := map[string]*os.File{}
+	next := 0
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(s.r, header[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return
+		}
+		if header[4] == sshFxpInit {
+			resp := binary.BigEndian.AppendUint32(nil, 3)
+			resp = appendSFTPString(resp, "other@example.com")
+			resp = appendSFTPString(resp, "1")
+			resp = appendSFTPString(resp, copyDataExtension)
+			s.reply(sshFxpVersion, appendSFTPString(resp, "1"))
+			continue
+		}
+
+		id, data := data[:4], data[4:]
+		status := func(code uint32) {
+			resp := binary.BigEndian.AppendUint32(append([]byte{}, id...), code)
+			s.reply(sshFxpStatus, appendSFTPString(appendSFTPString(resp, ""), ""))
+		}
+		switch header[4] {
+		case sshFxpOpen:
+			name, rest, _ := sftpString(data)
+			flag := os.O_RDONLY
+			if binary.BigEndian.Uint32(rest)&sshFxfWrite != 0 {
+				flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			}
+			f, err := os.OpenFile(name, flag, 0600)
+			if err != nil {
+				status(2)
+				continue
+			}
+			next++
+			handle := string(rune('a' + next))
+			handles[handle] = f
+			s.reply(sshFxpHandle, appendSFTPString(append([]byte{}, id...), handle))
+		case sshFxpClose:
+			handle, _, _ := sftpString(data)
+			handles[handle].Close()
+			delete(handles, handle)
+			status(sshFxOK)
+		case sshFxpExtended:
+			_, rest, _ := sftpString(data)
+			src, rest, _ := sftpString(rest)
+			dst, _, _ := sftpString(rest[16:])
+			if s.fail {
+				status(8)
+				continue
+			}
+			s.copies++
+			io.Copy(handles[dst], handles[src])
+			status(sshFxOK)
+		}
+	}
+}
+
+func (s *fakeCopyDataServer) reply(typ byte, payload []byte) {
+	pkt := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	s.w.Write(append(append(pkt, typ), payload...))
+}
+
+func TestSFTPCopyData(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		fs := newTestSFTPFileSystem(t)
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		server := &fakeCopyDataServer{r: sr, w: sw, fail: fail}
+		go server.serve()
+		cd, err := newCopyDataConn(cr, cw)
+		require.NoError(t, err)
+		t.Cleanup(func() { cd.Close() })
+
+		src := newCopyTree(t)
+		dst := filepath.Join(t.TempDir(), "copy")
+		info, err := os.Stat(src)
+		require.NoError(t, err)
+		var p progress
+		require.NoError(t, fs.copySFTPTree(context.Background(), src, dst, info, cd, &p))
+
+		if fail {
+			// one failure is enough to stop using copy-data
+			assert.True(t, cd.failed)
+			assert.Zero(t, server.copies)
+		} else {
+			assert.Equal(t, 2, server.copies)
+		}
+		data, err := os.ReadFile(filepath.Join(dst, "sub", "big"))
+		require.NoError(t, err)
+		assert.Len(t, data, 3*copyChunkSize)
+		data, err = os.ReadFile(filepath.Join(dst, "a"))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		assert.Equal(t, int64(5+3*copyChunkSize), p.bytes.Load())
+	}
+}
@@ -0,0 +1,397 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errNoRemoteSearch 表示远程没有可用的 find 或 grep, 需要通过 SFTP 遍历
+var errNoRemoteSearch = errors.New("remote find is not available")
+
+const (
+	// 每次 grep 的文件参数总长度, 远小于命令行长度限制
+	maxGrepArgsLength = 32 << 10
+)
+
+// Search implements fileSystem. 优先在远程执行 find/grep, 不可用时通过 SFTP 遍历
+func (s *SFTPFileSystem) Search(ctx context.Context, root string, q *searchQuery, found func(searchMatch) bool) error {
+	if _, err := s.Client.Stat(s.remote(root)); err != nil {
+		return err
+	}
+	if s.sshClient != nil && s.separator == "/" {
+		err := s.searchFind(ctx, root, q, found)
+		if !errors.Is(err, errNoRemoteSearch) {
+			return err
+		}
+		s.Printf("remote find failed, searching over sftp")
+	}
+	return s.searchWalk(ctx, root, q, found)
+}
+
+// findCommand 列出 root 下的所有文件: 类型, 大小, 修改时间和路径, 以 NUL 结尾
+func findCommand(root string, showHidden bool) string {
+	cmd := "find -P " + shellQuote(root) + " -mindepth 1"
+	if !showHidden {
+		cmd += ` -name '.*' -prune -o`
+	}
+	return cmd + ` -printf '%y\t%s\t%T@\t%p\0'`
+}
+
+// findEntry 是 find 输出的一项, path 为远程字符集
+type findEntry struct {
+	path    string
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+}
+
+// readFindEntries 解析 findCommand 的输出, fn 返回 false 时停止
+func readFindEntries(r io.Reader, fn func(findEntry) bool) error {
+	br := bufio.NewReader(r)
+	for {
+		record, err := br.ReadString(0)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields := strings.SplitN(strings.TrimSuffix(record, "\x00"), "\t", 4)
+		if len(fields) != 4 {
+			return fmt.Errorf("unexpected find output: %q", record)
+		}
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		secs, _ := strconv.ParseFloat(fields[2], 64)
+		e := findEntry{
+			path:    fields[3],
+			size:    size,
+			modTime: time.UnixMilli(int64(secs * 1000)),
+		}
+		switch fields[0] {
+		case "f":
+		case "d":
+			e.mode = os.ModeDir
+		case "l":
+			e.mode = os.ModeSymlink
+		default:
+			e.mode = os.ModeIrregular
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+}
+
+// grepCommand 在 files 中搜索固定字符串 pattern, 输出 "路径\0行号:行"
+func grepCommand(q *searchQuery, pattern string, files []string) string {
+	var b strings.Builder
+	b.WriteString("grep -nHIZsF")
+	if q.IgnoreCase {
+		b.WriteString("i")
+	}
+	b.WriteString(" -e " + shellQuote(pattern) + " --")
+	for _, f := range files {
+		b.WriteString(" " + shellQuote(f))
+	}
+	return b.String()
+}
+
+// readGrepMatches 解析 grepCommand 的输出, fn 返回 false 时停止
+func readGrepMatches(r io.Reader, fn func(path string, line int, text []byte) bool) error {
+	br := bufio.NewReader(r)
+	for {
+		p, err := br.ReadString(0)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rest, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		num, text, ok := strings.Cut(string(rest), ":")
+		line, convErr := strconv.Atoi(num)
+		if !ok || convErr != nil {
+			return fmt.Errorf("unexpected grep output: %q", rest)
+		}
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		if !fn(strings.TrimSuffix(p, "\x00"), line, []byte(text)) {
+			return nil
+		}
+	}
+}
+
+// runCommand 在远程执行 cmd, 由 read 读取输出, 返回错误输出; ctx 取消时关闭会话
+func (s *SFTPFileSystem) runCommand(ctx context.Context, cmd string, read func(io.Reader) error) ([]byte, error) {
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Start(cmd); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGTERM)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	out := &eofReader{r: stdout}
+	readErr := read(out)
+	if !out.eof {
+		// 提前停止读取时远程命令可能还在输出
+		session.Close()
+	}
+	err = session.Wait()
+	if readErr != nil {
+		return stderr.Bytes(), readErr
+	}
+	return stderr.Bytes(), err
+}
+
+// eofReader 记录是否读到了结尾
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// searchFind 通过远程 find 和 grep 搜索
+func (s *SFTPFileSystem) searchFind(ctx context.Context, root string, q *searchQuery, found func(searchMatch) bool) error {
+	var (
+		listed  bool
+		stopped bool
+		// 等待 grep 的文件
+		batch     []findEntry
+		batchSize int
+		grepErr   error
+	)
+	flush := func() bool {
+		files := batch
+		batch, batchSize = nil, 0
+		if len(files) == 0 {
+			return true
+		}
+		more, err := s.grepBatch(ctx, q, files, found)
+		if err != nil {
+			grepErr = err
+			return false
+		}
+		return more
+	}
+
+	_, err := s.runCommand(ctx, findCommand(s.remote(root), q.ShowHidden), func(r io.Reader) error {
+		return readFindEntries(r, func(e findEntry) bool {
+			listed = true
+			if ctx.Err() != nil {
+				stopped = true
+				return false
+			}
+			name := s.local(path.Base(e.path))
+			if !q.matchEntry(name, e.mode, e.size, e.modTime) {
+				return true
+			}
+			if q.content == nil {
+				if !found(e.match(s.local(e.path))) {
+					stopped = true
+					return false
+				}
+				return true
+			}
+			if e.size > searchMaxFileSize {
+				return true
+			}
+			batch = append(batch, e)
+			batchSize += len(e.path) + 3
+			if batchSize >= maxGrepArgsLength && !flush() {
+				stopped = true
+				return false
+			}
+			return true
+		})
+	})
+	if grepErr != nil {
+		return grepErr
+	}
+	if ctx.Err() != nil || stopped {
+		return ctx.Err()
+	}
+	if err != nil && !listed {
+		// find 不存在或不支持 -printf
+		return fmt.Errorf("%w: %v", errNoRemoteSearch, err)
+	}
+	// 部分目录无法读取时 find 也会失败, 已列出的结果仍然有效
+	flush()
+	if grepErr != nil {
+		return grepErr
+	}
+	return ctx.Err()
+}
+
+func (e findEntry) match(localPath string) searchMatch {
+	return searchMatch{
+		Path:    localPath,
+		IsDir:   e.mode.IsDir(),
+		Size:    e.size,
+		ModTime: e.modTime.UnixMilli(),
+	}
+}
+
+// grepBatch 在远程 grep files, grep 不可用时通过 SFTP 读取; 返回是否继续
+func (s *SFTPFileSystem) grepBatch(ctx context.Context, q *searchQuery, files []findEntry, found func(searchMatch) bool) (bool, error) {
+	if q.ContentRegex {
+		// grep -E 是 POSIX 语法, 与 Go 的正则结果不同
+		return s.grepFiles(ctx, q, files, found)
+	}
+
+	entries := make(map[string]findEntry, len(files))
+	paths := make([]string, len(files))
+	for i, e := range files {
+		entries[e.path] = e
+		paths[i] = e.path
+	}
+
+	more, matched := true, false
+	stderr, err := s.runCommand(ctx, grepCommand(q, s.remote(q.Content), paths), func(r io.Reader) error {
+		return readGrepMatches(r, func(p string, line int, text []byte) bool {
+			matched = true
+			e, ok := entries[p]
+			if !ok {
+				return true
+			}
+			m := e.match(s.local(p))
+			m.Line, m.Text = line, searchLine([]byte(s.local(string(text))))
+			more = ctx.Err() == nil && found(m)
+			return more
+		})
+	})
+	if !more || ctx.Err() != nil {
+		return false, nil
+	}
+
+	var exitErr interface{ ExitStatus() int }
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 && len(stderr) == 0:
+		// 没有匹配, 不认识的选项会输出错误
+		return true, nil
+	case matched:
+		// 部分文件无法读取
+		return true, nil
+	}
+
+	// grep 不存在或不支持这些选项
+	return s.grepFiles(ctx, q, files, found)
+}
+
+// grepFiles 通过 SFTP 逐个搜索 files, 返回是否继续
+func (s *SFTPFileSystem) grepFiles(ctx context.Context, q *searchQuery, files []findEntry, found func(searchMatch) bool) (bool, error) {
+	for _, e := range files {
+		more, err := s.grepFile(ctx, e.path, e.match(s.local(e.path)), q, found)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+	return true, nil
+}
+
+// grepFile 通过 SFTP 读取远程文件 p 并搜索内容, 返回是否继续
+func (s *SFTPFileSystem) grepFile(ctx context.Context, p string, m searchMatch, q *searchQuery, found func(searchMatch) bool) (bool, error) {
+	f, err := s.Client.Open(p)
+	if err != nil {
+		// 无法读取的文件不计入结果
+		return true, nil
+	}
+	defer f.Close()
+
+	more, _ := grepLines(f, q.content, func(line int, text string) bool {
+		m.Line, m.Text = line, s.local(text)
+		return ctx.Err() == nil && found(m)
+	})
+	return more, nil
+}
+
+// searchWalk 通过 SFTP 遍历目录搜索
+func (s *SFTPFileSystem) searchWalk(ctx context.Context, root string, q *searchQuery, found func(searchMatch) bool) error {
+	remoteRoot := s.remote(root)
+	walker := s.Client.Walk(remoteRoot)
+	for walker.Step() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if walker.Err() != nil || walker.Path() == remoteRoot {
+			continue
+		}
+
+		info := walker.Stat()
+		name := s.local(info.Name())
+		if !q.ShowHidden && strings.HasPrefix(name, ".") {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if !q.matchEntry(name, info.Mode(), info.Size(), info.ModTime()) {
+			continue
+		}
+
+		m := searchMatch{
+			Path:    s.clientPath(walker.Path()),
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixMilli(),
+		}
+		if q.content == nil {
+			if !found(m) {
+				return nil
+			}
+			continue
+		}
+		if info.Size() > searchMaxFileSize {
+			continue
+		}
+		more, err := s.grepFile(ctx, walker.Path(), m, q, found)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return ctx.Err()
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,523 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// replies with the trashEntry of every item in the trash
+	actionTrashList = "trash_list"
+	// id is the trashEntry to restore, replies with restoreData
+	actionTrashRestore = "trash_restore"
+	// data is an emptyTrashData, run as a job
+	actionTrashEmpty = "trash_empty"
+
+	// the trash layout of the freedesktop.org trash specification: items
+	// are kept in files, with a .trashinfo of the same name in info
+	trashFilesDir   = "files"
+	trashInfoDir    = "info"
+	trashInfoExt    = ".trashinfo"
+	trashTimeFormat = "2006-01-02T15:04:05"
+	// names tried for an item before giving up
+	maxTrashNames = 1000
+
+	CodeNoTrash = "no_trash"
+
+	// the trash is purged of old items at most this often per connection
+	trashPurgeInterval = time.Hour
+)
+
+type trashEntry struct {
+	// Id names the item for restores.
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Path is where the item was deleted from.
+	Path      string `json:"path"`
+	DeletedAt int64  `json:"deletedAt"`
+	IsDir     bool   `json:"isDir"`
+	Size      int64  `json:"size"`
+}
+
+type restoreData struct {
+	Path string `json:"path"`
+}
+
+type emptyTrashData struct {
+	// OlderThan keeps the items deleted in the last days, 0 empties the
+	// whole trash.
+	OlderThan int `json:"olderThan,omitempty"`
+	jobData
+}
+
+// NoTrashError reports a trash that cannot be written to, such as one in a
+// read-only root, so the user can delete permanently instead.
+type NoTrashError struct {
+	Code  string `json:"code"`
+	Trash string `json:"trash"`
+	Err   error  `json:"-"`
+}
+
+func (e *NoTrashError) Error() string {
+	return fmt.Sprintf("cannot use the trash %s: %v; delete permanently instead", e.Trash, e.Err)
+}
+
+func (e *NoTrashError) Unwrap() error {
+	return e.Err
+}
+
+// trashStore is what a file system offers to keep a trash.
+type trashStore interface {
+	lstat(p string) (os.FileInfo, error)
+	mkdirAll(p string) error
+	// writeNew creates p holding data, and fails with os.ErrExist if p
+	// exists.
+	writeNew(p string, data []byte) error
+	readFile(p string) ([]byte, error)
+	readDir(dir string) ([]os.FileInfo, error)
+	move(ctx context.Context, oldPath, newPath string, p *progress) error
+	removeAll(ctx context.Context, p string, prog *progress) error
+	split(p string) (dir, name string)
+	join(elem ...string) string
+}
+
+func formatTrashInfo(orig string, deletedAt time.Time) []byte {
+	u := url.URL{Path: orig}
+	return []byte(fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", u.EscapedPath(), deletedAt.Format(trashTimeFormat)))
+}
+
+func parseTrashInfo(data []byte) (orig string, deletedAt time.Time, err error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	section := false
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section = line == "[Trash Info]"
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !section || !ok {
+			continue
+		}
+		switch key {
+		case "Path":
+			if orig, err = url.PathUnescape(value); err != nil {
+				return "", time.Time{}, fmt.Errorf("invalid trash info path: %w", err)
+			}
+		case "DeletionDate":
+			if deletedAt, err = time.ParseInLocation(trashTimeFormat, value, time.Local); err != nil {
+				return "", time.Time{}, fmt.Errorf("invalid trash info date: %w", err)
+			}
+		}
+	}
+	if orig == "" {
+		return "", time.Time{}, fmt.Errorf("trash info without path")
+	}
+	return orig, deletedAt, nil
+}
+
+// moveToTrash moves p into trash, recording orig as where it came from, and
+// returns the name of the item.
+func moveToTrash(ctx context.Context, st trashStore, trash, p, orig string, now time.Time, prog *progress) (string, error) {
+	files, info := st.join(trash, trashFilesDir), st.join(trash, trashInfoDir)
+	if err := st.mkdirAll(files); err != nil {
+		return "", &NoTrashError{Code: CodeNoTrash, Trash: trash, Err: err}
+	}
+	if err := st.mkdirAll(info); err != nil {
+		return "", &NoTrashError{Code: CodeNoTrash, Trash: trash, Err: err}
+	}
+
+	_, base := st.split(p)
+	data := formatTrashInfo(orig, now)
+	for i := 1; i <= maxTrashNames; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s.%d", base, i)
+		}
+		// the info is created first, it reserves the name
+		infoPath := st.join(info, name+trashInfoExt)
+		if err := st.writeNew(infoPath, data); errors.Is(err, os.ErrExist) {
+			continue
+		} else if errors.Is(err, os.ErrPermission) {
+			return "", &NoTrashError{Code: CodeNoTrash, Trash: trash, Err: err}
+		} else if err != nil {
+			return "", err
+		}
+		dst := st.join(files, name)
+		if _, err := st.lstat(dst); err == nil {
+			// left without info
+			st.removeAll(context.Background(), infoPath, nil)
+			continue
+		}
+
+		if err := st.move(ctx, p, dst, prog); err != nil {
+			st.removeAll(context.Background(), infoPath, nil)
+			return "", err
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("no free name in the trash for %s", base)
+}
+
+// trashAside moves p into trash, and returns how to put it back.
+func trashAside(ctx context.Context, st trashStore, trash, p string) (func() error, error) {
+	name, err := moveToTrash(ctx, st, trash, p, p, time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := restoreFromTrash(st, trash, name)
+		return err
+	}, nil
+}
+
+// listTrash returns the items in trash, with ids of the store.
+func listTrash(st trashStore, trash string) ([]*trashEntry, error) {
+	infos, err := st.readDir(st.join(trash, trashInfoDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*trashEntry
+	for _, fi := range infos {
+		name, ok := strings.CutSuffix(fi.Name(), trashInfoExt)
+		if !ok {
+			continue
+		}
+		data, err := st.readFile(st.join(trash, trashInfoDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		orig, deletedAt, err := parseTrashInfo(data)
+		if err != nil {
+			continue
+		}
+		id := st.join(trash, trashFilesDir, name)
+		item, err := st.lstat(id)
+		if err != nil {
+			continue
+		}
+		_, origName := st.split(orig)
+		entries = append(entries, &trashEntry{
+			Id:        id,
+			Name:      origName,
+			Path:      orig,
+			DeletedAt: deletedAt.UnixMilli(),
+			IsDir:     item.IsDir(),
+			Size:      item.Size(),
+		})
+	}
+	return entries, nil
+}
+
+// trashItem returns the name of id in trash, if id is an item of one of
+// trashes.
+func trashItem(st trashStore, trashes []string, id string) (trash, name string, ok bool) {
+	dir, name := st.split(id)
+	trash, files := st.split(dir)
+	if files != trashFilesDir || name == "" || name == "." || name == ".." {
+		return "", "", false
+	}
+	return trash, name, slices.Contains(trashes, trash)
+}
+
+// restoreFromTrash moves the item name of trash back to where it was
+// deleted from, and returns that path.
+func restoreFromTrash(st trashStore, trash, name string) (string, error) {
+	infoPath := st.join(trash, trashInfoDir, name+trashInfoExt)
+	data, err := st.readFile(infoPath)
+	if err != nil {
+		return "", fmt.Errorf("not in the trash: %s: %w", name, err)
+	}
+	orig, _, err := parseTrashInfo(data)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := st.lstat(orig); err == nil {
+		return "", fmt.Errorf("目标路径已存在: %s", orig)
+	}
+	dir, _ := st.split(orig)
+	if err := st.mkdirAll(dir); err != nil {
+		return "", err
+	}
+	if err := st.move(context.Background(), st.join(trash, trashFilesDir, name), orig, nil); err != nil {
+		return "", err
+	}
+	return orig, st.removeAll(context.Background(), infoPath, nil)
+}
+
+// purgeTrash deletes the items of trash deleted before the given time, or
+// everything when it is zero. With match set, only the items whose original
+// path it accepts go; items without info are matched by where they lie.
+func purgeTrash(ctx context.Context, st trashStore, trash string, before time.Time, match func(string) bool, prog *progress) error {
+	infoDir, filesDir := st.join(trash, trashInfoDir), st.join(trash, trashFilesDir)
+	infos, err := st.readDir(infoDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, ok := strings.CutSuffix(fi.Name(), trashInfoExt)
+		if !ok {
+			continue
+		}
+		if !before.IsZero() || match != nil {
+			data, err := st.readFile(st.join(infoDir, fi.Name()))
+			if err != nil {
+				continue
+			}
+			orig, deletedAt, err := parseTrashInfo(data)
+			if err != nil || (!before.IsZero() && !deletedAt.Before(before)) || (match != nil && !match(orig)) {
+				continue
+			}
+		}
+		item := st.join(filesDir, name)
+		if _, err := st.lstat(item); err == nil {
+			if err := st.removeAll(ctx, item, prog); err != nil {
+				return err
+			}
+		}
+		if err := st.removeAll(ctx, st.join(infoDir, fi.Name()), nil); err != nil {
+			return err
+		}
+	}
+
+	if before.IsZero() {
+		// items left without info
+		files, err := st.readDir(filesDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, fi := range files {
+			item := st.join(filesDir, fi.Name())
+			if _, err := st.lstat(st.join(infoDir, fi.Name()+trashInfoExt)); err == nil {
+				continue
+			}
+			if match != nil && !match(item) {
+				continue
+			}
+			if err := st.removeAll(ctx, item, prog); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purgeBefore returns the time before which items are purged from the
+// trash without asking, zero when they are kept.
+func purgeBefore(now time.Time) time.Time {
+	if trashMaxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-trashMaxAge)
+}
+
+// localStore holds trashes and transfers on the local disk.
+type localStore struct{}
+
+func (localStore) lstat(p string) (os.FileInfo, error) {
+	return os.Lstat(p)
+}
+
+func (localStore) mkdirAll(p string) error {
+	return os.MkdirAll(p, 0700)
+}
+
+func (localStore) writeNew(p string, data []byte) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return f.Close()
+}
+
+func (localStore) readFile(p string) ([]byte, error) {
+	return os.ReadFile(p)
+}
+
+func (localStore) readDir(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (st localStore) move(ctx context.Context, oldPath, newPath string, p *progress) error {
+	p.addTotal(1, 0)
+	err := os.Rename(oldPath, newPath)
+	if err == nil {
+		p.add(1, 0)
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// 跨文件系统时先复制再删除
+	p.addTotal(-1, 0)
+	info, err := os.Lstat(oldPath)
+	if err != nil {
+		return err
+	}
+	if err := st.copyTree(ctx, oldPath, newPath, info, p); err != nil {
+		os.RemoveAll(newPath)
+		return err
+	}
+	return os.RemoveAll(oldPath)
+}
+
+func (st localStore) trash(ctx context.Context, p string) (func() error, error) {
+	trash, err := localTrashFor(p)
+	if err != nil {
+		return nil, err
+	}
+	return trashAside(ctx, st, trash, p)
+}
+
+func (localStore) copyTree(ctx context.Context, src, dst string, info os.FileInfo, p *progress) error {
+	if err := countLocal(ctx, src, info, p); err != nil {
+		return err
+	}
+	return copyLocal(ctx, src, dst, info, p)
+}
+
+func (localStore) removeAll(ctx context.Context, p string, prog *progress) error {
+	return (&LocalFileSystem{}).Delete(ctx, p, prog)
+}
+
+func (localStore) split(p string) (string, string) {
+	return filepath.Dir(p), filepath.Base(p)
+}
+
+func (localStore) join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+// purgeOldTrash deletes the items kept in the trash for too long, unless
+// it did so in the last trashPurgeInterval.
+func (s *FSService) purgeOldTrash(ctx context.Context) {
+	now := time.Now()
+	before := purgeBefore(now)
+	if before.IsZero() {
+		return
+	}
+	s.purgeMu.Lock()
+	if !s.purgedAt.IsZero() && now.Sub(s.purgedAt) < trashPurgeInterval {
+		s.purgeMu.Unlock()
+		return
+	}
+	s.purgedAt = now
+	s.purgeMu.Unlock()
+
+	if err := s.FS.EmptyTrash(ctx, before, nil, nil); err != nil {
+		s.Printf("error purging trash: %v", err)
+	}
+}
+
+func (s *FSService) handleTrashList(id string) {
+	s.purgeOldTrash(context.Background())
+	entries, err := s.FS.TrashList()
+	if err != nil {
+		s.handleError(id, actionTrashList, err)
+		return
+	}
+	if entries == nil {
+		entries = []*trashEntry{}
+	}
+
+	r, err := json.Marshal(entries)
+	if err != nil {
+		s.Printf("error marshalling trash list response: %v", err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionTrashList,
+		Data:    r,
+	})
+}
+
+func (s *FSService) handleTrashRestore(id string) {
+	p, err := s.FS.Restore(id)
+	if err != nil {
+		s.handleError(id, actionTrashRestore, err)
+		return
+	}
+
+	r, err := json.Marshal(restoreData{Path: p})
+	if err != nil {
+		s.Printf("error marshalling trash restore response: %v", err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionTrashRestore,
+		Data:    r,
+	})
+}
+
+func (s *FSService) handleTrashEmpty(id string, data json.RawMessage) {
+	var d emptyTrashData
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.Printf("error unmarshalling fs trash empty payload: %v", err)
+			return
+		}
+	}
+
+	var before time.Time
+	if d.OlderThan > 0 {
+		before = time.Now().AddDate(0, 0, -d.OlderThan)
+	}
+	err := s.runJob(actionTrashEmpty, id, d.jobData, func(ctx context.Context, p *progress) error {
+		return s.FS.EmptyTrash(ctx, before, nil, p)
+	})
+	if err != nil {
+		s.handleError(id, actionTrashEmpty, err)
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionTrashEmpty,
+	})
+}
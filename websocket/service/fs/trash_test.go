@@ -0,0 +1,247 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"webshell/service/sandbox"
+)
+
+func TestTrashInfo(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 0, time.Local)
+	data := formatTrashInfo("/home/a b/100%/中.txt", at)
+	assert.Equal(t, "[Trash Info]\nPath=/home/a%20b/100%25/%E4%B8%AD.txt\nDeletionDate=2026-03-04T05:06:07\n", string(data))
+
+	orig, deletedAt, err := parseTrashInfo(data)
+	require.NoError(t, err)
+	assert.Equal(t, "/home/a b/100%/中.txt", orig)
+	assert.True(t, at.Equal(deletedAt))
+
+	_, _, err = parseTrashInfo([]byte("[Other]\nPath=/a\n"))
+	assert.Error(t, err)
+}
+
+func TestTrash(t *testing.T) {
+	roots := sandbox.LocalRoots
+	t.Cleanup(func() { sandbox.LocalRoots = roots })
+
+	sftpFS := newTestSFTPFileSystem(t)
+	for name, tc := range map[string]struct {
+		fs    FileSystem
+		trash func(root string) string
+	}{
+		"local": {
+			fs: &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+			trash: func(root string) string {
+				sandbox.LocalRoots = []string{root}
+				return rootTrash(root)
+			},
+		},
+		"sftp": {
+			fs: sftpFS,
+			trash: func(root string) string {
+				sftpFS.roots = []string{root}
+				return filepath.Join(root, sftpTrashName)
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := tc.fs
+			root := t.TempDir()
+			trash := tc.trash(root)
+			ctx := context.Background()
+
+			dir := filepath.Join(root, "dir")
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "f"), []byte("data"), 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("first"), 0644))
+
+			var p progress
+			require.NoError(t, fs.Trash(ctx, dir, &p))
+			assert.Equal(t, int64(1), p.files.Load())
+			require.NoError(t, fs.Trash(ctx, filepath.Join(root, "a.txt"), nil))
+			require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("second"), 0644))
+			require.NoError(t, fs.Trash(ctx, filepath.Join(root, "a.txt"), nil))
+			assert.NoDirExists(t, dir)
+			assert.NoFileExists(t, filepath.Join(root, "a.txt"))
+			assert.FileExists(t, filepath.Join(trash, "info", "a.txt.2.trashinfo"))
+
+			entries, err := fs.TrashList()
+			require.NoError(t, err)
+			require.Len(t, entries, 3)
+			byId := map[string]*trashEntry{}
+			for _, e := range entries {
+				byId[e.Id] = e
+			}
+			first := byId[filepath.Join(trash, "files", "a.txt")]
+			require.NotNil(t, first)
+			assert.Equal(t, "a.txt", first.Name)
+			assert.Equal(t, filepath.Join(root, "a.txt"), first.Path)
+			assert.Equal(t, int64(5), first.Size)
+			assert.True(t, byId[filepath.Join(trash, "files", "dir")].IsDir)
+
+			// restores go back where they came from, without replacing
+			restored, err := fs.Restore(first.Id)
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(root, "a.txt"), restored)
+			data, _ := os.ReadFile(restored)
+			assert.Equal(t, "first", string(data))
+			_, err = fs.Restore(filepath.Join(trash, "files", "a.txt.2"))
+			assert.Error(t, err)
+			_, err = fs.Restore(filepath.Join(root, "a.txt"))
+			assert.Error(t, err)
+
+			// the parent is created again
+			_, err = fs.Restore(filepath.Join(trash, "files", "dir"))
+			require.NoError(t, err)
+			assert.FileExists(t, filepath.Join(dir, "sub", "f"))
+
+			// deleting from the trash is for good
+			require.NoError(t, fs.Trash(ctx, filepath.Join(trash, "files", "a.txt.2"), nil))
+			entries, err = fs.TrashList()
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+
+			require.NoError(t, fs.Trash(ctx, dir, nil))
+			require.NoError(t, fs.EmptyTrash(ctx, time.Now().Add(-time.Hour), nil, nil))
+			entries, err = fs.TrashList()
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+
+			p = progress{}
+			require.NoError(t, fs.EmptyTrash(ctx, time.Time{}, nil, &p))
+			assert.Equal(t, int64(3), p.files.Load())
+			entries, err = fs.TrashList()
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestTrashReadOnlyRoot(t *testing.T) {
+	roots := sandbox.LocalRoots
+	t.Cleanup(func() { sandbox.LocalRoots = roots })
+
+	sftpFS := newTestSFTPFileSystem(t)
+	for name, tc := range map[string]struct {
+		fs    FileSystem
+		trash func(root string) string
+	}{
+		"local": {
+			fs: &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+			trash: func(root string) string {
+				sandbox.LocalRoots = []string{root}
+				return rootTrash(root)
+			},
+		},
+		"sftp": {
+			fs: sftpFS,
+			trash: func(root string) string {
+				sftpFS.roots = []string{root}
+				return filepath.Join(root, sftpTrashName)
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			trash := tc.trash(root)
+			p := filepath.Join(root, "a.txt")
+			require.NoError(t, os.WriteFile(p, []byte("data"), 0644))
+			if os.Geteuid() == 0 {
+				// permissions do not hold root back
+				require.NoError(t, os.WriteFile(trash, nil, 0644))
+			}
+			require.NoError(t, os.Chmod(root, 0555))
+			t.Cleanup(func() { os.Chmod(root, 0755) })
+
+			err := tc.fs.Trash(context.Background(), p, nil)
+			var noTrashErr *NoTrashError
+			require.ErrorAs(t, err, &noTrashErr)
+			assert.Equal(t, CodeNoTrash, noTrashErr.Code)
+			assert.Equal(t, trash, noTrashErr.Trash)
+			assert.FileExists(t, p)
+		})
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	trash := t.TempDir()
+	st := localStore{}
+	now := time.Now()
+	for i, age := range []time.Duration{0, 40 * 24 * time.Hour} {
+		p := filepath.Join(t.TempDir(), string(rune('a'+i)))
+		require.NoError(t, os.WriteFile(p, nil, 0644))
+		_, err := moveToTrash(context.Background(), st, trash, p, p, now.Add(-age), nil)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, purgeTrash(context.Background(), st, trash, now.Add(-30*24*time.Hour), nil, nil))
+	entries, err := listTrash(st, trash)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Name)
+	assert.NoFileExists(t, filepath.Join(trash, "files", "b"))
+}
+
+// purgeCountingFS counts the calls of EmptyTrash.
+type purgeCountingFS struct {
+	FileSystem
+	purges int
+}
+
+func (f *purgeCountingFS) EmptyTrash(context.Context, time.Time, func(string) bool, *progress) error {
+	f.purges++
+	return nil
+}
+
+func TestPurgeOldTrashInterval(t *testing.T) {
+	fs := &purgeCountingFS{}
+	s := &FSService{FS: fs, Logger: log.New(io.Discard, "", 0)}
+
+	s.purgeOldTrash(context.Background())
+	s.purgeOldTrash(context.Background())
+	assert.Equal(t, 1, fs.purges)
+
+	s.purgedAt = s.purgedAt.Add(-trashPurgeInterval)
+	s.purgeOldTrash(context.Background())
+	assert.Equal(t, 2, fs.purges)
+}
+
+func TestJailEmptyTrash(t *testing.T) {
+	roots := sandbox.LocalRoots
+	t.Cleanup(func() { sandbox.LocalRoots = roots })
+	mine, other := t.TempDir(), t.TempDir()
+	sandbox.LocalRoots = []string{mine, other}
+
+	local := &LocalFileSystem{Logger: log.New(io.Discard, "", 0)}
+	ctx := context.Background()
+	for _, p := range []string{filepath.Join(mine, "a"), filepath.Join(other, "b")} {
+		require.NoError(t, os.WriteFile(p, nil, 0644))
+		require.NoError(t, local.Trash(ctx, p, nil))
+	}
+	// an item claiming to come from outside the roots
+	outside := filepath.Join(t.TempDir(), "c")
+	require.NoError(t, os.WriteFile(filepath.Join(mine, "c"), nil, 0644))
+	_, err := moveToTrash(ctx, localStore{}, rootTrash(mine), filepath.Join(mine, "c"), outside, time.Now(), nil)
+	require.NoError(t, err)
+
+	fs := newJailFileSystem(local, sandbox.NewLocal(mine), nil)
+	require.NoError(t, fs.EmptyTrash(ctx, time.Time{}, nil, nil))
+
+	entries, err := local.TrashList()
+	require.NoError(t, err)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Path)
+	}
+	assert.ElementsMatch(t, []string{filepath.Join(other, "b"), outside}, left)
+	assert.NoFileExists(t, filepath.Join(rootTrash(mine), "files", "a"))
+}
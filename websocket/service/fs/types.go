@@ -1,6 +1,11 @@
 package fs
 
-import "os"
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
 
 // FileSystemEntry represents common file metadata.
 type FileSystemEntry struct {
@@ -10,6 +15,12 @@ type FileSystemEntry struct {
 	Mode    os.FileMode `json:"mode"`
 	ModTime int64       `json:"modTime"`
 	IsDir   bool        `json:"isDir"`
+	// IsDir of a symlink tells whether it points to a directory.
+	IsSymlink  bool   `json:"isSymlink,omitempty"`
+	LinkTarget string `json:"linkTarget,omitempty"`
+	// names, or ids when the name is unknown
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
 }
 
 // FileSystem defines a common interface for file operations.
@@ -26,12 +37,57 @@ type FileSystem interface {
 	// Create creates a new file or directory (if isDir is true) with the given name under the specified parent path.
 	Create(parentPath, name string, isDir bool) error
 
+	// Delete, Copy and Move count their work in p and stop when ctx is done.
+	// A stopped copy leaves nothing behind.
+
 	// Delete removes the file or directory at the given path.
-	Delete(path string) error
+	Delete(ctx context.Context, path string, p *progress) error
+
+	// Copy and Move resolve an existing destination with policy, one of the
+	// conflict constants, and return where src ended up, "" when skipped.
+
+	// Copy duplicates the file or directory src into the directory dest.
+	Copy(ctx context.Context, src, dest, policy string, p *progress) (string, error)
+
+	// Move relocates the file or directory src into the directory dest.
+	Move(ctx context.Context, src, dest, policy string, p *progress) (string, error)
+
+	// ReadFile returns the content of the file at path. Files over maxSize bytes fail with a TooLargeError.
+	ReadFile(path string, maxSize int64) ([]byte, os.FileInfo, error)
+
+	// WriteFile replaces the content of the file at path, creating it if needed.
+	WriteFile(path string, data []byte) (os.FileInfo, error)
+
+	// Chmod sets the permission bits of path, and of everything below it if recursive. Symlinks are not followed.
+	// Every entry done is added to p; with recursive, the entries are counted into its total first.
+	Chmod(path string, mode os.FileMode, recursive bool, p *progress) error
+
+	// Chown sets the owner and group of path, by name or id. An empty owner or group is left unchanged.
+	Chown(path, owner, group string, recursive bool) error
+
+	// Symlink creates a symlink at linkPath pointing to target.
+	Symlink(target, linkPath string) error
+
+	// ReadLink returns the target of the symlink at path.
+	ReadLink(path string) (string, error)
+
+	// Watch calls notify with the changes in the directory at path until closed. A deleted event for path itself is the last one.
+	Watch(path string, notify func(watchEvent)) (io.Closer, error)
+
+	// Trash moves path to the trash of its root. Paths in a trash are deleted.
+	Trash(ctx context.Context, path string, p *progress) error
+
+	// TrashList returns the items in the trash of every root, newest first.
+	TrashList() ([]*trashEntry, error)
+
+	// Restore moves the trash item id back to where it was deleted from, and returns that path.
+	Restore(id string) (string, error)
 
-	// Copy duplicates the file or directory from src to dest.
-	Copy(src, dest string) error
+	// EmptyTrash deletes the trash items deleted before the given time, or every item when it is zero.
+	// Only items whose original path passes match are deleted, all of them when match is nil.
+	EmptyTrash(ctx context.Context, before time.Time, match func(path string) bool, p *progress) error
 
-	// Move relocates the file or directory from src to dest.
-	Move(src, dest string) error
+	// Search calls found with the entries below root matching q, until found
+	// returns false or ctx is done.
+	Search(ctx context.Context, root string, q *searchQuery, found func(searchMatch) bool) error
 }
@@ -0,0 +1,320 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"webshell/service/limits"
+	ws "webshell/websocket"
+)
+
+const (
+	actionWatch   = "watch"
+	actionUnwatch = "unwatch"
+
+	// server -> client, Id is the watched directory and data a watchEvent
+	watchChanged = "changed"
+	watchCreated = "created"
+	watchDeleted = "deleted"
+	watchRenamed = "renamed"
+
+	// events are gathered this long before they are sent
+	watchDebounce = 200 * time.Millisecond
+	// more events than this in one batch are sent as a change of the
+	// directory itself
+	maxWatchBatch = 100
+)
+
+type watchEvent struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// OldPath is set on renamed events.
+	OldPath string `json:"oldPath,omitempty"`
+}
+
+// watchBatch coalesces the events of a watch until they are sent.
+type watchBatch struct {
+	dir   string
+	flush func([]watchEvent)
+
+	mu     sync.Mutex
+	events []watchEvent
+	// position of the last event of each path in events
+	index   map[string]int
+	timer   *time.Timer
+	stopped bool
+}
+
+func newWatchBatch(dir string, flush func([]watchEvent)) *watchBatch {
+	return &watchBatch{dir: dir, flush: flush, index: make(map[string]int)}
+}
+
+func (b *watchBatch) add(ev watchEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return
+	}
+
+	if i, ok := b.index[ev.Path]; ok && ev.Type != watchRenamed {
+		prev := &b.events[i]
+		switch {
+		case prev.Type == watchCreated && ev.Type == watchDeleted:
+			// never seen by the client
+			prev.Type = ""
+			delete(b.index, ev.Path)
+		case prev.Type == watchDeleted && ev.Type == watchCreated:
+			prev.Type = watchChanged
+		case prev.Type == watchCreated && ev.Type == watchChanged:
+		case prev.Type == watchChanged || prev.Type == watchDeleted:
+			prev.Type = ev.Type
+		default:
+			b.append(ev)
+		}
+	} else {
+		b.append(ev)
+	}
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(watchDebounce, b.send)
+	}
+}
+
+func (b *watchBatch) append(ev watchEvent) {
+	b.events = append(b.events, ev)
+	b.index[ev.Path] = len(b.events) - 1
+}
+
+func (b *watchBatch) send() {
+	b.mu.Lock()
+	events := make([]watchEvent, 0, len(b.events))
+	for _, ev := range b.events {
+		if ev.Type != "" {
+			events = append(events, ev)
+		}
+	}
+	b.events, b.index, b.timer = nil, make(map[string]int), nil
+	b.mu.Unlock()
+
+	if len(events) > maxWatchBatch {
+		events = []watchEvent{{Type: watchChanged, Path: b.dir}}
+	}
+	if len(events) > 0 {
+		b.flush(events)
+	}
+}
+
+func (b *watchBatch) stop() {
+	b.mu.Lock()
+	b.stopped = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.mu.Unlock()
+}
+
+// pollState is what polling compares between two listings.
+type pollState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// pollWatcher lists a directory at an interval and reports the differences,
+// for file systems that cannot tell about changes.
+type pollWatcher struct {
+	dir    string
+	list   func() (map[string]pollState, error)
+	join   func(dir, name string) string
+	notify func(watchEvent)
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newPollWatcher(dir string, list func() (map[string]pollState, error), join func(dir, name string) string, notify func(watchEvent)) (*pollWatcher, error) {
+	state, err := list()
+	if err != nil {
+		return nil, err
+	}
+	w := &pollWatcher{dir: dir, list: list, join: join, notify: notify, done: make(chan struct{})}
+	go w.run(state)
+	return w, nil
+}
+
+func (w *pollWatcher) run(state map[string]pollState) {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		next, err := w.list()
+		if err != nil {
+			// the directory is gone
+			w.notify(watchEvent{Type: watchDeleted, Path: w.dir})
+			return
+		}
+		for name, st := range next {
+			old, ok := state[name]
+			switch {
+			case !ok:
+				w.notify(watchEvent{Type: watchCreated, Path: w.join(w.dir, name)})
+			case old != st:
+				w.notify(watchEvent{Type: watchChanged, Path: w.join(w.dir, name)})
+			}
+		}
+		for name := range state {
+			if _, ok := next[name]; !ok {
+				w.notify(watchEvent{Type: watchDeleted, Path: w.join(w.dir, name)})
+			}
+		}
+		state = next
+	}
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+// watch is a directory watched for the client.
+type watch struct {
+	closer io.Closer
+	batch  *watchBatch
+	// the watcher stopped on its own
+	ended bool
+}
+
+func (s *FSService) handleWatch(id string) {
+	ok, err := s.startWatch(id)
+	if err != nil {
+		s.handleError(id, actionWatch, err)
+		return
+	}
+	if ok {
+		s.conn.WriteJSON(&ws.ServiceMessage{Service: s.Name(), Id: id, Action: actionWatch})
+	}
+}
+
+// startWatch watches the directory id unless it already is. It reports
+// false when the connection closed meanwhile.
+func (s *FSService) startWatch(id string) (bool, error) {
+	s.watchMu.Lock()
+	if _, ok := s.watches[id]; ok {
+		s.watchMu.Unlock()
+		return true, nil
+	}
+	if maxWatches > 0 && len(s.watches) >= maxWatches {
+		s.watchMu.Unlock()
+		return false, &limits.LimitError{
+			Code:  limits.CodeLimitExceeded,
+			Limit: "watches_per_connection",
+			Max:   maxWatches,
+		}
+	}
+	if s.watches == nil {
+		s.watches = make(map[string]*watch)
+	}
+	// reserve the slot while the watch starts
+	s.watches[id] = nil
+	s.watchMu.Unlock()
+
+	batch := newWatchBatch(id, func(events []watchEvent) {
+		s.sendWatchEvents(id, events)
+	})
+	w := &watch{batch: batch}
+	closer, err := s.FS.Watch(id, func(ev watchEvent) {
+		batch.add(ev)
+		if ev.Type == watchDeleted && ev.Path == id {
+			s.endWatch(id, w)
+		}
+	})
+
+	s.watchMu.Lock()
+	current, reserved := s.watches[id]
+	reserved = reserved && current == nil
+	if reserved && (err != nil || w.ended) {
+		delete(s.watches, id)
+	} else if reserved {
+		w.closer = closer
+		s.watches[id] = w
+	}
+	s.watchMu.Unlock()
+
+	if err != nil {
+		return false, fmt.Errorf("failed to watch directory: %w", err)
+	}
+	if !reserved {
+		// closed while the watch started
+		closer.Close()
+		batch.stop()
+		return false, nil
+	}
+	return true, nil
+}
+
+// endWatch frees the slot of a watcher that stopped because its directory
+// is gone.
+func (s *FSService) endWatch(id string, w *watch) {
+	s.watchMu.Lock()
+	w.ended = true
+	if s.watches[id] == w {
+		delete(s.watches, id)
+	}
+	s.watchMu.Unlock()
+}
+
+func (s *FSService) handleUnwatch(id string) {
+	s.watchMu.Lock()
+	w, ok := s.watches[id]
+	if w != nil {
+		delete(s.watches, id)
+	}
+	s.watchMu.Unlock()
+
+	if w != nil {
+		w.closer.Close()
+		w.batch.stop()
+	}
+	if ok {
+		s.conn.WriteJSON(&ws.ServiceMessage{Service: s.Name(), Id: id, Action: actionUnwatch})
+	}
+}
+
+func (s *FSService) closeWatches() {
+	s.watchMu.Lock()
+	watches := s.watches
+	s.watches = nil
+	s.watchMu.Unlock()
+
+	for _, w := range watches {
+		if w != nil {
+			w.closer.Close()
+			w.batch.stop()
+		}
+	}
+}
+
+func (s *FSService) sendWatchEvents(id string, events []watchEvent) {
+	for _, ev := range events {
+		r, err := json.Marshal(ev)
+		if err != nil {
+			s.Printf("error marshalling watch event: %v", err)
+			continue
+		}
+		s.conn.WriteJSON(&ws.ServiceMessage{
+			Service: s.Name(),
+			Id:      id,
+			Action:  ev.Type,
+			Data:    r,
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// a move reports the old name, then the new one; a move out of the
+// directory has no new name and is reported as a deletion after this long
+const watchRenamePairing = 50 * time.Millisecond
+
+// localWatcher is the one fsnotify watcher of the process, shared by every
+// watch so that connections do not run into max_user_instances.
+type localWatcher struct {
+	fsw *fsnotify.Watcher
+
+	mu sync.Mutex
+	// watches by cleaned directory
+	dirs map[string][]*localWatch
+}
+
+var (
+	localWatcherOnce   sync.Once
+	sharedLocalWatcher *localWatcher
+	localWatcherErr    error
+)
+
+func getLocalWatcher() (*localWatcher, error) {
+	localWatcherOnce.Do(func() {
+		fsw, err := fsnotify.NewWatcher()
+		if err != nil {
+			localWatcherErr = err
+			return
+		}
+		sharedLocalWatcher = &localWatcher{fsw: fsw, dirs: make(map[string][]*localWatch)}
+		go sharedLocalWatcher.run()
+	})
+	return sharedLocalWatcher, localWatcherErr
+}
+
+func (lw *localWatcher) add(dir string, notify func(watchEvent)) (*localWatch, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "watch", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	key := filepath.Clean(dir)
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.dirs[key]) == 0 {
+		if err := lw.fsw.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	w := &localWatch{lw: lw, key: key, dir: dir, notify: notify}
+	lw.dirs[key] = append(lw.dirs[key], w)
+	return w, nil
+}
+
+// remove stops reporting to w, and drops the directory with its last
+// watch.
+func (lw *localWatcher) remove(w *localWatch) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	watches := slices.DeleteFunc(lw.dirs[w.key], func(other *localWatch) bool { return other == w })
+	if len(watches) > 0 {
+		lw.dirs[w.key] = watches
+		return
+	}
+	delete(lw.dirs, w.key)
+	// fails when the directory is already gone
+	lw.fsw.Remove(w.key)
+}
+
+// watchesOf returns the watches of dir, or every watch for an empty dir.
+func (lw *localWatcher) watchesOf(dir string) []*localWatch {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if dir != "" {
+		return slices.Clone(lw.dirs[dir])
+	}
+	var all []*localWatch
+	for _, watches := range lw.dirs {
+		all = append(all, watches...)
+	}
+	return all
+}
+
+func (lw *localWatcher) run() {
+	// watches holding back a move until the new name shows up
+	var pending []*localWatch
+	var pairing <-chan time.Time
+
+	for {
+		select {
+		case ev, ok := <-lw.fsw.Events:
+			if !ok {
+				return
+			}
+			for _, w := range lw.watchesOf(ev.Name) {
+				w.handleSelf(ev)
+			}
+			if parent := filepath.Dir(ev.Name); parent != ev.Name {
+				for _, w := range lw.watchesOf(parent) {
+					if w.handle(ev) {
+						pending = append(pending, w)
+					}
+				}
+			}
+		case err, ok := <-lw.fsw.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				for _, w := range lw.watchesOf("") {
+					w.changed()
+				}
+			}
+		case <-pairing:
+			for _, w := range pending {
+				w.flushRename()
+			}
+			pending, pairing = nil, nil
+		}
+
+		if len(pending) > 0 && pairing == nil {
+			pairing = time.After(watchRenamePairing)
+		}
+	}
+}
+
+// localWatch reports the changes in one directory. Apart from closed, its
+// state belongs to the goroutine of the localWatcher.
+type localWatch struct {
+	lw     *localWatcher
+	key    string
+	dir    string
+	notify func(watchEvent)
+	// old name of a move waiting for the new one
+	renamed string
+	once    sync.Once
+	// events read before Close are dropped
+	closed atomic.Bool
+}
+
+// Watch implements fileSystem.
+func (l *LocalFileSystem) Watch(dir string, notify func(watchEvent)) (io.Closer, error) {
+	lw, err := getLocalWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return lw.add(dir, notify)
+}
+
+// handleSelf handles an event of the directory itself.
+func (w *localWatch) handleSelf(ev fsnotify.Event) {
+	if w.closed.Load() || !ev.Has(fsnotify.Remove) && !ev.Has(fsnotify.Rename) {
+		return
+	}
+	w.flushRename()
+	w.notify(watchEvent{Type: watchDeleted, Path: w.dir})
+	w.Close()
+}
+
+// handle handles an event of an entry of the directory, and reports whether
+// it started holding back a move.
+func (w *localWatch) handle(ev fsnotify.Event) bool {
+	if w.closed.Load() {
+		return false
+	}
+
+	p := path.Join(w.dir, filepath.Base(ev.Name))
+	switch {
+	case ev.Has(fsnotify.Create):
+		if w.renamed != "" {
+			w.notify(watchEvent{Type: watchRenamed, Path: p, OldPath: w.renamed})
+			w.renamed = ""
+		} else {
+			w.notify(watchEvent{Type: watchCreated, Path: p})
+		}
+	case ev.Has(fsnotify.Rename):
+		pending := w.renamed != ""
+		w.flushRename()
+		w.renamed = p
+		return !pending
+	case ev.Has(fsnotify.Remove):
+		w.flushRename()
+		w.notify(watchEvent{Type: watchDeleted, Path: p})
+	default:
+		w.flushRename()
+		w.notify(watchEvent{Type: watchChanged, Path: p})
+	}
+	return false
+}
+
+// flushRename reports a move out of the directory, which had no new name.
+func (w *localWatch) flushRename() {
+	if w.renamed != "" && !w.closed.Load() {
+		w.notify(watchEvent{Type: watchDeleted, Path: w.renamed})
+	}
+	w.renamed = ""
+}
+
+// changed reports that events were lost.
+func (w *localWatch) changed() {
+	if !w.closed.Load() {
+		w.notify(watchEvent{Type: watchChanged, Path: w.dir})
+	}
+}
+
+func (w *localWatch) Close() error {
+	w.once.Do(func() {
+		w.closed.Store(true)
+		w.lw.remove(w)
+	})
+	return nil
+}
@@ -0,0 +1,57 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalWatchRename(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), nil, 0644))
+
+	var log eventLog
+	w, err := (&LocalFileSystem{}).Watch(dir, log.add)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")))
+	assert.Eventually(t, log.has(watchEvent{
+		Type:    watchRenamed,
+		Path:    filepath.Join(dir, "b"),
+		OldPath: filepath.Join(dir, "a"),
+	}), 2*time.Second, 10*time.Millisecond)
+
+	// a move out of the directory is a deletion
+	require.NoError(t, os.Rename(filepath.Join(dir, "b"), filepath.Join(t.TempDir(), "b")))
+	assert.Eventually(t, log.has(watchEvent{Type: watchDeleted, Path: filepath.Join(dir, "b")}), 2*time.Second, 10*time.Millisecond)
+}
+
+func TestLocalWatchShared(t *testing.T) {
+	fs := &LocalFileSystem{}
+	dir := t.TempDir()
+
+	// one watcher serves them all, past max_user_instances
+	for range 200 {
+		w, err := fs.Watch(t.TempDir(), func(watchEvent) {})
+		require.NoError(t, err)
+		defer w.Close()
+	}
+
+	// closing one watch of a directory keeps the other
+	var first, second eventLog
+	w1, err := fs.Watch(dir, first.add)
+	require.NoError(t, err)
+	w2, err := fs.Watch(dir, second.add)
+	require.NoError(t, err)
+	defer w2.Close()
+	require.NoError(t, w1.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), nil, 0644))
+	assert.Eventually(t, second.has(watchEvent{Type: watchCreated, Path: filepath.Join(dir, "a")}), 2*time.Second, 10*time.Millisecond)
+	assert.False(t, first.has(watchEvent{Type: watchCreated, Path: filepath.Join(dir, "a")})())
+}
@@ -0,0 +1,208 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ws "webshell/websocket"
+)
+
+func TestWatchBatch(t *testing.T) {
+	var sent []watchEvent
+	b := newWatchBatch("/d", func(events []watchEvent) { sent = events })
+	defer b.stop()
+
+	b.add(watchEvent{Type: watchCreated, Path: "/d/tmp"})
+	b.add(watchEvent{Type: watchChanged, Path: "/d/tmp"})
+	b.add(watchEvent{Type: watchDeleted, Path: "/d/tmp"})
+	b.add(watchEvent{Type: watchChanged, Path: "/d/a"})
+	b.add(watchEvent{Type: watchChanged, Path: "/d/a"})
+	b.add(watchEvent{Type: watchDeleted, Path: "/d/b"})
+	b.add(watchEvent{Type: watchCreated, Path: "/d/b"})
+	b.add(watchEvent{Type: watchRenamed, Path: "/d/c", OldPath: "/d/a"})
+	b.send()
+
+	assert.Equal(t, []watchEvent{
+		{Type: watchChanged, Path: "/d/a"},
+		{Type: watchChanged, Path: "/d/b"},
+		{Type: watchRenamed, Path: "/d/c", OldPath: "/d/a"},
+	}, sent)
+
+	for i := 0; i <= maxWatchBatch; i++ {
+		b.add(watchEvent{Type: watchCreated, Path: fmt.Sprintf("/d/%d", i)})
+	}
+	b.send()
+	assert.Equal(t, []watchEvent{{Type: watchChanged, Path: "/d"}}, sent)
+}
+
+// eventLog gathers the events of a watch.
+type eventLog struct {
+	mu     sync.Mutex
+	events []watchEvent
+}
+
+func (l *eventLog) add(ev watchEvent) {
+	l.mu.Lock()
+	l.events = append(l.events, ev)
+	l.mu.Unlock()
+}
+
+func (l *eventLog) has(want watchEvent) func() bool {
+	return func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, ev := range l.events {
+			if ev == want {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestWatch(t *testing.T) {
+	interval := watchPollInterval
+	watchPollInterval = 20 * time.Millisecond
+	t.Cleanup(func() { watchPollInterval = interval })
+
+	for name, fs := range map[string]FileSystem{
+		"local": &LocalFileSystem{Logger: log.New(io.Discard, "", 0)},
+		"sftp":  newTestSFTPFileSystem(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "old"), nil, 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "gone"), nil, 0644))
+
+			var log eventLog
+			w, err := fs.Watch(dir, log.add)
+			require.NoError(t, err)
+			defer w.Close()
+
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "new"), []byte("x"), 0644))
+			require.NoError(t, os.Remove(filepath.Join(dir, "gone")))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "old"), []byte("changed"), 0644))
+
+			wait := func(ev watchEvent) {
+				assert.Eventually(t, log.has(ev), 2*time.Second, 10*time.Millisecond, "%+v", ev)
+			}
+			wait(watchEvent{Type: watchCreated, Path: filepath.Join(dir, "new")})
+			wait(watchEvent{Type: watchDeleted, Path: filepath.Join(dir, "gone")})
+			wait(watchEvent{Type: watchChanged, Path: filepath.Join(dir, "old")})
+
+			require.NoError(t, os.RemoveAll(dir))
+			wait(watchEvent{Type: watchDeleted, Path: dir})
+		})
+	}
+
+	_, err := (&LocalFileSystem{}).Watch(filepath.Join(t.TempDir(), "missing"), func(watchEvent) {})
+	assert.Error(t, err)
+}
+
+// newTestConn returns the server side of a websocket, and the messages its
+// client receives.
+func newTestConn(t *testing.T) (*ws.Conn, <-chan *ws.ServiceMessage) {
+	conns := make(chan *ws.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.NewConn(w, r)
+		if err == nil {
+			conns <- conn
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	messages := make(chan *ws.ServiceMessage, 100)
+	go func() {
+		for {
+			var msg ws.ServiceMessage
+			if err := client.ReadJSON(&msg); err != nil {
+				return
+			}
+			messages <- &msg
+		}
+	}()
+	return <-conns, messages
+}
+
+// startingFS holds Watch until release is closed.
+type startingFS struct {
+	FileSystem
+	started, release chan struct{}
+	closed           atomic.Bool
+}
+
+func (f *startingFS) Watch(string, func(watchEvent)) (io.Closer, error) {
+	close(f.started)
+	<-f.release
+	return f, nil
+}
+
+func (f *startingFS) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+func TestWatchClosedWhileStarting(t *testing.T) {
+	fs := &startingFS{started: make(chan struct{}), release: make(chan struct{})}
+	s := &FSService{FS: fs, Logger: log.New(io.Discard, "", 0)}
+
+	done := make(chan bool)
+	go func() {
+		ok, err := s.startWatch("/d")
+		assert.NoError(t, err)
+		done <- ok
+	}()
+	<-fs.started
+	s.Cleanup(nil)
+	close(fs.release)
+
+	assert.False(t, <-done)
+	assert.True(t, fs.closed.Load())
+	assert.Nil(t, s.watches)
+}
+
+func TestWatchEnds(t *testing.T) {
+	conn, messages := newTestConn(t)
+	s := &FSService{conn: conn, FS: &LocalFileSystem{}, Logger: log.New(io.Discard, "", 0)}
+	defer s.Cleanup(nil)
+	dir := t.TempDir()
+
+	s.handleWatch(dir)
+	msg := <-messages
+	assert.Equal(t, actionWatch, msg.Action)
+	s.watchMu.Lock()
+	assert.Contains(t, s.watches, dir)
+	s.watchMu.Unlock()
+
+	// the slot is free once the directory is gone
+	require.NoError(t, os.Remove(dir))
+	select {
+	case msg = <-messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event for the deleted directory")
+	}
+	var ev watchEvent
+	require.NoError(t, json.Unmarshal(msg.Data, &ev))
+	assert.Equal(t, watchEvent{Type: watchDeleted, Path: dir}, ev)
+	s.watchMu.Lock()
+	assert.NotContains(t, s.watches, dir)
+	s.watchMu.Unlock()
+}
@@ -2,12 +2,29 @@ package heartbeat
 
 import (
 	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	ws "webshell/websocket"
 )
 
+const (
+	// 服务端发出 ping, 客户端原样回复 pong, 用于测量往返延迟
+	actionPing = "ping"
+	actionPong = "pong"
+
+	pingInterval = 5 * time.Second
+)
+
 type HeartbeatService struct {
 	conn *ws.Conn
+
+	// 最近一次测得的往返延迟, 单位纳秒
+	rtt      atomic.Int64
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 func (s *HeartbeatService) Name() string {
@@ -16,14 +33,60 @@ func (s *HeartbeatService) Name() string {
 
 func (s *HeartbeatService) Register(conn *ws.Conn) {
 	s.conn = conn
+	go s.ping()
 }
 
 func (s *HeartbeatService) HandleTextMessage(id, action string, data json.RawMessage) {
+	if action == actionPong {
+		s.handlePong(id)
+		return
+	}
 	s.conn.WriteJSON(&ws.ServiceMessage{Service: s.Name(), Action: action, Id: id})
 }
 
-func (s *HeartbeatService) Cleanup(err error) {}
+func (s *HeartbeatService) Cleanup(err error) {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// RTT returns the latest measured round-trip time of the websocket, or 0
+// when the client has not answered a ping yet.
+func (s *HeartbeatService) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+func (s *HeartbeatService) ping() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			// id 携带发送时间, 收到 pong 时无需再查表
+			s.conn.WriteJSON(&ws.ServiceMessage{
+				Service: s.Name(),
+				Action:  actionPing,
+				Id:      strconv.FormatInt(now.UnixNano(), 10),
+			})
+		}
+	}
+}
+
+func (s *HeartbeatService) handlePong(id string) {
+	sent, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	if rtt < 0 || rtt > time.Minute {
+		return
+	}
+	s.rtt.Store(int64(rtt))
+}
 
 func NewService() ws.Service {
-	return &HeartbeatService{}
+	return &HeartbeatService{
+		done: make(chan struct{}),
+	}
 }
@@ -0,0 +1,129 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// id is a shell, data a groupData naming the group
+	actionJoin  = "join"
+	actionLeave = "leave"
+	// id is a group, data a commandData typed into all of its shells
+	actionBroadcast = "broadcast"
+)
+
+type groupData struct {
+	// Group is empty in leave to leave every group.
+	Group string `json:"group"`
+	// Members are the shell ids left in the group, sent back on join and leave.
+	Members []string `json:"members,omitempty"`
+}
+
+func (s *ShellService) handleJoin(id, group string) {
+	if group == "" {
+		s.handleError(id, actionJoin, fmt.Errorf("group name is required"))
+		return
+	}
+
+	s.Lock()
+	if s.groups == nil {
+		// the connection is closing
+		s.Unlock()
+		return
+	}
+	if s.groups[group] == nil {
+		s.groups[group] = make(map[string]struct{})
+	}
+	s.groups[group][id] = struct{}{}
+	members := s.members(group)
+	s.Unlock()
+
+	s.sendGroup(id, actionJoin, &groupData{Group: group, Members: members})
+}
+
+func (s *ShellService) handleLeave(id, group string) {
+	var members []string
+
+	s.Lock()
+	if group == "" {
+		s.leaveGroups(id)
+	} else if m, ok := s.groups[group]; ok {
+		delete(m, id)
+		if len(m) == 0 {
+			delete(s.groups, group)
+		}
+		members = s.members(group)
+	}
+	s.Unlock()
+
+	s.sendGroup(id, actionLeave, &groupData{Group: group, Members: members})
+}
+
+func (s *ShellService) handleBroadcast(group string, data json.RawMessage) {
+	var command commandData
+	if err := json.Unmarshal(data, &command); err != nil {
+		s.Printf("(group: %s) error unmarshalling broadcast payload: %v", group, err)
+		return
+	}
+
+	s.RLock()
+	ids := s.members(group)
+	shells := make([]Shell, len(ids))
+	for i, id := range ids {
+		shells[i] = s.shells[id]
+	}
+	s.RUnlock()
+
+	if len(ids) == 0 {
+		s.handleError(group, actionBroadcast, fmt.Errorf("broadcast group %s has no shells", group))
+		return
+	}
+
+	// each shell still answers on its own id
+	for i, id := range ids {
+		if err := s.writeCommand(id, shells[i], command); err != nil {
+			s.handleError(id, actionBroadcast, fmt.Errorf("error writing to shell: %w", err))
+		}
+	}
+}
+
+// members lists the shells of group in a stable order. The caller holds the
+// lock.
+func (s *ShellService) members(group string) []string {
+	var ids []string
+	for id := range s.groups[group] {
+		if _, ok := s.shells[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// leaveGroups removes shell id from every group. The caller holds the lock.
+func (s *ShellService) leaveGroups(id string) {
+	for group, m := range s.groups {
+		delete(m, id)
+		if len(m) == 0 {
+			delete(s.groups, group)
+		}
+	}
+}
+
+func (s *ShellService) sendGroup(id, action string, d *groupData) {
+	r, err := json.Marshal(d)
+	if err != nil {
+		s.Printf("(id: %s) error marshalling %s data: %v", id, action, err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  action,
+		Data:    r,
+	})
+}
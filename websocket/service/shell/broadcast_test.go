@@ -0,0 +1,43 @@
+package shell
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellService_Broadcast(t *testing.T) {
+	shell1, shell2, shell3 := &mockShell{}, &mockShell{}, &mockShell{}
+	service := &ShellService{
+		shells: map[string]Shell{
+			"node-1": shell1,
+			"node-2": shell2,
+			"node-3": shell3,
+		},
+		groups:  make(map[string]map[string]struct{}),
+		RWMutex: &sync.RWMutex{},
+		Logger:  log.New(os.Stderr, "[test] ", log.LstdFlags),
+	}
+
+	service.groups["cluster"] = map[string]struct{}{"node-1": {}, "node-2": {}}
+	assert.Equal(t, []string{"node-1", "node-2"}, service.members("cluster"))
+
+	data, _ := json.Marshal(commandData("uptime\r"))
+	service.HandleTextMessage("cluster", actionBroadcast, data)
+
+	assert.Equal(t, []byte("uptime\r"), shell1.written)
+	assert.Equal(t, []byte("uptime\r"), shell2.written)
+	assert.Empty(t, shell3.written)
+
+	// terminated shells drop out of their groups
+	service.HandleTextMessage("node-1", actionTerminate, nil)
+	assert.True(t, shell1.closed)
+	assert.Equal(t, []string{"node-2"}, service.members("cluster"))
+
+	service.leaveGroups("node-2")
+	assert.Empty(t, service.groups)
+}
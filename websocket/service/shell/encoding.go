@@ -0,0 +1,48 @@
+package shell
+
+import (
+	"io"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// encodedShell transcodes between UTF-8 on the websocket side and a legacy
+// charset on the remote side.
+type encodedShell struct {
+	Shell
+
+	// buffers incomplete multi-byte sequences between reads
+	decoder io.Reader
+	encoder *encoding.Encoder
+}
+
+func newEncodedShell(sh Shell, enc encoding.Encoding) *encodedShell {
+	return &encodedShell{
+		Shell:   sh,
+		decoder: transform.NewReader(sh, enc.NewDecoder()),
+		encoder: encoding.ReplaceUnsupported(enc.NewEncoder()),
+	}
+}
+
+// Unwrap returns the shell being transcoded.
+func (e *encodedShell) Unwrap() Shell {
+	return e.Shell
+}
+
+// Read implements Shell.
+func (e *encodedShell) Read(p []byte) (int, error) {
+	return e.decoder.Read(p)
+}
+
+// Write implements Shell.
+func (e *encodedShell) Write(p []byte) (int, error) {
+	encoded, err := e.encoder.Bytes(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := e.Shell.Write(encoded); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
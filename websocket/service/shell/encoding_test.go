@@ -0,0 +1,48 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// chunkedShell returns its output a few bytes at a time.
+type chunkedShell struct {
+	mockShell
+	chunks [][]byte
+}
+
+func (c *chunkedShell) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, assert.AnError
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
+
+func TestEncodedShell(t *testing.T) {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte("你好"))
+	assert.NoError(t, err)
+
+	// split in the middle of a double-byte character
+	raw := &chunkedShell{chunks: [][]byte{gbk[:1], gbk[1:3], gbk[3:]}}
+	sh := newEncodedShell(raw, simplifiedchinese.GBK)
+
+	var out []byte
+	buf := make([]byte, 16)
+	for {
+		n, err := sh.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, "你好", string(out))
+
+	n, err := sh.Write([]byte("你好"))
+	assert.NoError(t, err)
+	assert.Equal(t, len("你好"), n)
+	assert.Equal(t, gbk, raw.written)
+}
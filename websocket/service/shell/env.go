@@ -3,16 +3,62 @@ package shell
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
 	ptyCWD = getEnvCWD()
+	// round-trip latency above which local echo predictions are sent
+	predictLatency = time.Duration(getEnvInt(predictLatencyName, 150)) * time.Millisecond
+	// whether OSC 52 sequences may set the browser clipboard
+	clipboardWrite = getEnvBool(clipboardWriteName, true)
+	// per-shell limits, 0 disables them
+	shellIdleTimeout    = time.Duration(getEnvInt(idleTimeoutName, 0)) * time.Minute
+	shellMaxDuration    = time.Duration(getEnvInt(maxDurationName, 0)) * time.Minute
+	shellTimeoutWarning = time.Duration(getEnvInt(timeoutWarningName, 60)) * time.Second
+	// lines of output kept per shell for search and export, 0 disables it
+	scrollbackLines = getEnvInt(scrollbackLinesName, 10000)
 )
 
 const (
-	envName = "WEBSHELL_PTY_CWD"
+	envName             = "WEBSHELL_PTY_CWD"
+	predictLatencyName  = "WEBSHELL_PREDICT_LATENCY"
+	clipboardWriteName  = "WEBSHELL_CLIPBOARD_WRITE"
+	idleTimeoutName     = "WEBSHELL_SHELL_IDLE_TIMEOUT"
+	maxDurationName     = "WEBSHELL_SHELL_MAX_DURATION"
+	timeoutWarningName  = "WEBSHELL_SHELL_TIMEOUT_WARNING"
+	scrollbackLinesName = "WEBSHELL_SCROLLBACK_LINES"
 )
 
+func getEnvInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value == "" {
+		log.Printf("$%s not set, default to %d", name, defaultValue)
+	} else {
+		n, err := strconv.Atoi(value)
+		if err == nil {
+			return n
+		}
+		log.Printf("$%s (%v) is not a valid integer, default to %d", name, value, defaultValue)
+	}
+
+	return defaultValue
+}
+
+func getEnvBool(name string, defaultValue bool) bool {
+	if value := os.Getenv(name); value == "" {
+		log.Printf("$%s not set, default to %t", name, defaultValue)
+	} else {
+		b, err := strconv.ParseBool(value)
+		if err == nil {
+			return b
+		}
+		log.Printf("$%s (%v) is not a valid boolean, default to %t", name, value, defaultValue)
+	}
+
+	return defaultValue
+}
+
 func getEnvCWD() string {
 	if cwd := os.Getenv(envName); cwd == "" {
 		log.Printf("$%s not set, using home directory", envName)
@@ -0,0 +1,285 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"time"
+
+	"webshell/service/snippet"
+	ws "webshell/websocket"
+)
+
+const (
+	defaultExpectTimeout = 10 * time.Second
+	// unmatched output kept for the next expect
+	maxExpectBuffer = 64 * 1024
+)
+
+// Script is a sequence of expect/send steps run against a shell.
+type Script struct {
+	Steps []Step `json:"steps"`
+	// Timeout of each expect in milliseconds, unless the step has its own.
+	Timeout int `json:"timeout,omitempty"`
+	// Vars are available to send as {{name}} along with captured ones.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// Step waits for output matching Expect, if set, then types Send, if set.
+// Named groups of Expect, like (?P<version>\S+), are captured as variables.
+type Step struct {
+	Expect  string `json:"expect,omitempty"`
+	Send    string `json:"send,omitempty"`
+	Timeout int    `json:"timeout,omitempty"`
+}
+
+// ScriptEvent reports the progress of a script.
+type ScriptEvent struct {
+	Step  int    `json:"step"`
+	Event string `json:"event"`
+	// Text is the output for output events and the matched text for match
+	// events. What is sent is not reported, as it often holds passwords.
+	Text string            `json:"text,omitempty"`
+	Vars map[string]string `json:"vars,omitempty"`
+	// Error is set on the error event that ends a failed script.
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	ScriptEventOutput = "output"
+	ScriptEventMatch  = "match"
+	ScriptEventSent   = "sent"
+	ScriptEventDone   = "done"
+	ScriptEventError  = "error"
+)
+
+type compiledStep struct {
+	Step
+	re      *regexp.Regexp
+	timeout time.Duration
+}
+
+func (sc *Script) compile() ([]compiledStep, error) {
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("script has no steps")
+	}
+
+	steps := make([]compiledStep, len(sc.Steps))
+	for i, st := range sc.Steps {
+		steps[i] = compiledStep{Step: st, timeout: defaultExpectTimeout}
+		if sc.Timeout > 0 {
+			steps[i].timeout = time.Duration(sc.Timeout) * time.Millisecond
+		}
+		if st.Timeout > 0 {
+			steps[i].timeout = time.Duration(st.Timeout) * time.Millisecond
+		}
+		if st.Expect == "" {
+			continue
+		}
+		re, err := regexp.Compile(st.Expect)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		steps[i].re = re
+	}
+	return steps, nil
+}
+
+// RunScript runs sc against sh, reading its output from output and
+// reporting progress to report. It returns the variables captured.
+func RunScript(ctx context.Context, sh Shell, output <-chan []byte, sc *Script, report func(*ScriptEvent)) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, v := range sc.Vars {
+		vars[k] = v
+	}
+
+	steps, err := sc.compile()
+	if err != nil {
+		report(&ScriptEvent{Step: -1, Event: ScriptEventError, Error: err.Error()})
+		return vars, err
+	}
+
+	var buf []byte
+	for i, st := range steps {
+		if st.re != nil {
+			var matched string
+			buf, matched, err = expect(ctx, output, buf, &st, vars, func(p []byte) {
+				report(&ScriptEvent{Step: i, Event: ScriptEventOutput, Text: string(p)})
+			})
+			if err != nil {
+				err = fmt.Errorf("step %d: %w", i, err)
+				report(&ScriptEvent{Step: i, Event: ScriptEventError, Error: err.Error()})
+				return vars, err
+			}
+			report(&ScriptEvent{Step: i, Event: ScriptEventMatch, Text: matched, Vars: maps.Clone(vars)})
+		}
+
+		if st.Send != "" {
+			text, err := snippet.Render(st.Send, vars)
+			if err == nil {
+				_, err = sh.Write([]byte(text))
+			}
+			if err != nil {
+				err = fmt.Errorf("step %d: %w", i, err)
+				report(&ScriptEvent{Step: i, Event: ScriptEventError, Error: err.Error()})
+				return vars, err
+			}
+			report(&ScriptEvent{Step: i, Event: ScriptEventSent})
+		}
+	}
+
+	report(&ScriptEvent{Step: len(steps), Event: ScriptEventDone, Vars: maps.Clone(vars)})
+	return vars, nil
+}
+
+// expect reads output until the step matches, returning the match and what
+// follows it.
+func expect(ctx context.Context, output <-chan []byte, buf []byte, st *compiledStep, vars map[string]string, onOutput func([]byte)) (rest []byte, matched string, err error) {
+	timer := time.NewTimer(st.timeout)
+	defer timer.Stop()
+
+	for {
+		if loc := st.re.FindSubmatchIndex(buf); loc != nil {
+			for i, name := range st.re.SubexpNames() {
+				if name != "" && loc[2*i] >= 0 {
+					vars[name] = string(buf[loc[2*i]:loc[2*i+1]])
+				}
+			}
+			return buf[loc[1]:], string(buf[loc[0]:loc[1]]), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return buf, "", ctx.Err()
+		case <-timer.C:
+			return buf, "", fmt.Errorf("timed out waiting for %q", st.Expect)
+		case p, ok := <-output:
+			if !ok {
+				return buf, "", fmt.Errorf("shell closed while waiting for %q", st.Expect)
+			}
+			onOutput(p)
+			buf = append(buf, p...)
+			if len(buf) > maxExpectBuffer {
+				buf = buf[len(buf)-maxExpectBuffer:]
+			}
+		}
+	}
+}
+
+// readOutput feeds the output of a shell nobody else reads into a channel,
+// until the shell fails or done is closed.
+func readOutput(sh Shell, done <-chan struct{}) <-chan []byte {
+	ch := make(chan []byte, 16)
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := sh.Read(buf)
+			if n > 0 {
+				select {
+				case ch <- bytes.Clone(buf[:n]):
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// RunScriptWith opens a new shell from sp, runs sc in it and closes it.
+func RunScriptWith(ctx context.Context, sp ShellProvider, cwd string, sc *Script, report func(*ScriptEvent)) (map[string]string, error) {
+	sh, err := sp.NewShell(cwd)
+	if err != nil {
+		report(&ScriptEvent{Step: -1, Event: ScriptEventError, Error: err.Error()})
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	defer sh.Close()
+
+	return RunScript(ctx, sh, readOutput(sh, done), sc, report)
+}
+
+const (
+	// id is a shell, data a Script to run in it; progress comes back as
+	// ScriptEvent data under the same action
+	actionExpect = "expect"
+	// stops the script running in shell id
+	actionExpectCancel = "expect_cancel"
+)
+
+// handleExpect runs a script in the live shell id. The output already goes
+// to the terminal, so it is left out of the events.
+func (s *ShellService) handleExpect(ss *session, data json.RawMessage) {
+	var sc Script
+	if err := json.Unmarshal(data, &sc); err != nil {
+		s.Printf("(id: %s) error unmarshalling expect payload: %v", ss.id, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ss.mu.Lock()
+	if ss.cancelScript != nil {
+		ss.mu.Unlock()
+		cancel()
+		s.handleError(ss.id, actionExpect, fmt.Errorf("a script is already running"))
+		return
+	}
+	ss.cancelScript = cancel
+	ss.mu.Unlock()
+
+	output, unsubscribe := ss.subscribe()
+
+	go func() {
+		defer func() {
+			unsubscribe()
+			cancel()
+			ss.mu.Lock()
+			ss.cancelScript = nil
+			ss.mu.Unlock()
+		}()
+
+		go func() {
+			select {
+			case <-ss.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		RunScript(ctx, ss.shell, output, &sc, func(ev *ScriptEvent) {
+			if ev.Event == ScriptEventOutput {
+				return
+			}
+			r, err := json.Marshal(ev)
+			if err != nil {
+				s.Printf("(id: %s) error marshalling expect event: %v", ss.id, err)
+				return
+			}
+			s.conn.WriteJSON(&ws.ServiceMessage{
+				Service: s.Name(),
+				Id:      ss.id,
+				Action:  actionExpect,
+				Data:    r,
+			})
+		})
+	}()
+}
+
+func (ss *session) stopScript() {
+	ss.mu.Lock()
+	cancel := ss.cancelScript
+	ss.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -0,0 +1,59 @@
+package shell
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunScript(t *testing.T) {
+	sh := &mockShell{}
+	output := make(chan []byte, 3)
+	output <- []byte("Vendor CLI\r\nlog")
+	output <- []byte("in: ")
+	output <- []byte("ok, version 1.2.3\r\n> ")
+
+	var events []string
+	vars, err := RunScript(context.Background(), sh, output, &Script{
+		Steps: []Step{
+			{Expect: `login:\s*`, Send: "{{user}}\r"},
+			{Expect: `version (?P<version>\S+)`},
+			{Expect: `> $`, Send: "echo {{version}}\r"},
+		},
+		Vars: map[string]string{"user": "admin"},
+	}, func(ev *ScriptEvent) {
+		events = append(events, ev.Event)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3", vars["version"])
+	assert.Equal(t, "admin\recho 1.2.3\r", string(sh.written))
+	assert.Equal(t, []string{
+		ScriptEventOutput, ScriptEventOutput, ScriptEventMatch, ScriptEventSent,
+		ScriptEventOutput, ScriptEventMatch,
+		ScriptEventMatch, ScriptEventSent,
+		ScriptEventDone,
+	}, events)
+}
+
+func TestRunScript_Errors(t *testing.T) {
+	var last *ScriptEvent
+	report := func(ev *ScriptEvent) { last = ev }
+
+	_, err := RunScript(context.Background(), &mockShell{}, make(chan []byte), &Script{
+		Steps: []Step{{Expect: "never", Timeout: 20}},
+	}, report)
+	assert.ErrorContains(t, err, "timed out")
+	assert.Equal(t, ScriptEventError, last.Event)
+
+	_, err = RunScript(context.Background(), &mockShell{}, nil, &Script{
+		Steps: []Step{{Expect: "("}},
+	}, report)
+	assert.ErrorContains(t, err, "step 0")
+
+	_, err = RunScript(context.Background(), &mockShell{}, nil, &Script{
+		Steps: []Step{{Send: "{{missing}}"}},
+	}, report)
+	assert.ErrorContains(t, err, "missing")
+}
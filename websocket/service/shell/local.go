@@ -5,7 +5,6 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"sync"
 	ws "webshell/websocket"
 
 	"github.com/creack/pty"
@@ -72,10 +71,5 @@ func NewLocalService() ws.Service {
 		Logger: logger,
 	}
 
-	return &ShellService{
-		ShellProvider: sp,
-		shells:        make(map[string]Shell),
-		Logger:        logger,
-		RWMutex:       &sync.RWMutex{},
-	}
+	return newShellService(sp, logger)
 }
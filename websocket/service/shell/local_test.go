@@ -3,9 +3,12 @@ package shell
 import (
 	"log"
 	"os"
+	"os/exec"
 	"testing"
 
+	"github.com/creack/pty"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLocalShellProvider_NewShell(t *testing.T) {
@@ -52,3 +55,37 @@ func TestNewLocalService(t *testing.T) {
 	assert.NotNil(t, service)
 	assert.IsType(t, &ShellService{}, service)
 }
+
+func TestPTYShell_EchoEnabled(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("Skipping test: cannot open PTY: %v", err)
+	}
+	defer tty.Close()
+	shell := &PTYShell{File: ptmx, terminate: func() {}}
+	defer shell.Close()
+
+	stty := func(args ...string) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = tty
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("Skipping test: stty %v: %v: %s", args, err, out)
+		}
+	}
+
+	// cooked mode with echo on
+	stty("echo", "icanon")
+	echo, err := shell.EchoEnabled()
+	require.NoError(t, err)
+	assert.True(t, echo)
+
+	stty("-echo")
+	echo, err = shell.EchoEnabled()
+	require.NoError(t, err)
+	assert.False(t, echo)
+
+	// raw mode leaves echoing to the program
+	stty("-icanon")
+	_, err = shell.EchoEnabled()
+	assert.ErrorIs(t, err, errEchoUnknown)
+}
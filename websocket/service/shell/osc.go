@@ -0,0 +1,202 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// server -> client events decoded from OSC sequences
+	actionClipboard = "clipboard"
+	actionTitle     = "title"
+	actionNotify    = "notify"
+
+	// longer OSC sequences are passed through untouched
+	maxOSCLength = 1 << 20
+)
+
+const (
+	ansiESC byte = 0x1b
+	ansiBEL byte = 0x07
+	ansiCAN byte = 0x18
+	ansiSUB byte = 0x1a
+)
+
+type clipboardData struct {
+	// Selection is the OSC 52 target, usually "c" for the clipboard.
+	Selection string `json:"selection,omitempty"`
+	Text      string `json:"text"`
+}
+type titleData struct {
+	Title string `json:"title"`
+}
+type notifyData struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body"`
+}
+
+// oscEvent is an OSC sequence turned into a shell service message.
+type oscEvent struct {
+	action string
+	data   any
+}
+
+type oscState int
+
+const (
+	oscGround       oscState = iota
+	oscEscape                // ESC seen
+	oscString                // inside ESC ]
+	oscStringEscape          // ESC seen inside ESC ], expecting the backslash of ST
+)
+
+// oscFilter takes the OSC sequences it understands out of the terminal
+// output. Sequences may be split across reads, so it keeps state between
+// calls.
+type oscFilter struct {
+	state oscState
+	body  []byte
+}
+
+// filter returns p without the recognised sequences, and the events they
+// stand for.
+func (f *oscFilter) filter(p []byte) ([]byte, []oscEvent) {
+	if f.state == oscGround && bytes.IndexByte(p, ansiESC) < 0 {
+		return p, nil
+	}
+
+	var (
+		out    = make([]byte, 0, len(p))
+		events []oscEvent
+	)
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch f.state {
+		case oscGround:
+			if b == ansiESC {
+				f.state = oscEscape
+			} else {
+				out = append(out, b)
+			}
+		case oscEscape:
+			if b == ']' {
+				f.state = oscString
+				f.body = f.body[:0]
+				continue
+			}
+			out = append(out, ansiESC)
+			f.state = oscGround
+			i-- // handle b again, it may start another sequence
+		case oscString:
+			switch b {
+			case ansiBEL:
+				out, events = f.finish(out, events, []byte{ansiBEL})
+			case ansiESC:
+				f.state = oscStringEscape
+			case ansiCAN, ansiSUB:
+				// aborted: hand what we held back to the terminal, which
+				// cancels the sequence itself
+				out = append(append(out, ansiESC, ']'), f.body...)
+				out = append(out, b)
+				f.state = oscGround
+			default:
+				f.body = append(f.body, b)
+				if len(f.body) > maxOSCLength {
+					out = append(append(out, ansiESC, ']'), f.body...)
+					f.state = oscGround
+				}
+			}
+		case oscStringEscape:
+			if b == '\\' {
+				out, events = f.finish(out, events, []byte{ansiESC, '\\'})
+				continue
+			}
+			// not a terminated sequence after all
+			out = append(append(out, ansiESC, ']'), f.body...)
+			f.state = oscEscape
+			i--
+		}
+	}
+	return out, events
+}
+
+func (f *oscFilter) finish(out []byte, events []oscEvent, terminator []byte) ([]byte, []oscEvent) {
+	f.state = oscGround
+
+	ev, handled := parseOSC(string(f.body))
+	if !handled {
+		out = append(append(out, ansiESC, ']'), f.body...)
+		return append(out, terminator...), events
+	}
+	if ev != nil {
+		events = append(events, *ev)
+	}
+	return out, events
+}
+
+// parseOSC decodes the body of an OSC sequence. handled is false for
+// sequences the terminal should still see; a nil event with handled set
+// drops the sequence.
+func parseOSC(body string) (ev *oscEvent, handled bool) {
+	ps, pt, _ := strings.Cut(body, ";")
+
+	switch ps {
+	case "0", "2":
+		return &oscEvent{actionTitle, titleData{Title: pt}}, true
+	case "52":
+		selection, payload, _ := strings.Cut(pt, ";")
+		if payload == "?" {
+			// reading the clipboard is never allowed
+			return nil, true
+		}
+		text, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, true
+		}
+		return &oscEvent{actionClipboard, clipboardData{Selection: selection, Text: string(text)}}, true
+	case "9":
+		if strings.HasPrefix(pt, "4;") {
+			// ConEmu progress reports share the number
+			return nil, false
+		}
+		return &oscEvent{actionNotify, notifyData{Body: pt}}, true
+	case "777":
+		parts := strings.SplitN(pt, ";", 3)
+		if parts[0] != "notify" || len(parts) < 2 {
+			return nil, false
+		}
+		d := notifyData{Title: parts[1]}
+		if len(parts) == 3 {
+			d.Body = parts[2]
+		}
+		return &oscEvent{actionNotify, d}, true
+	}
+	return nil, false
+}
+
+// sendOSCEvents forwards the events of shell id, applying the clipboard
+// policy.
+func (s *ShellService) sendOSCEvents(id string, events []oscEvent) {
+	for _, ev := range events {
+		if ev.action == actionClipboard && !clipboardWrite {
+			s.Printf("(id: %s) clipboard write blocked by policy", id)
+			continue
+		}
+
+		r, err := json.Marshal(ev.data)
+		if err != nil {
+			s.Printf("(id: %s) error marshalling %s data: %v", id, ev.action, err)
+			continue
+		}
+		s.conn.WriteJSON(&ws.ServiceMessage{
+			Service: s.Name(),
+			Id:      id,
+			Action:  ev.action,
+			Data:    r,
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOSCFilter(t *testing.T) {
+	f := &oscFilter{}
+
+	out, events := f.filter([]byte("plain \x1b[1mbold\x1b[0m"))
+	assert.Equal(t, "plain \x1b[1mbold\x1b[0m", string(out))
+	assert.Empty(t, events)
+
+	// title terminated by BEL, clipboard by ST
+	out, events = f.filter([]byte("a\x1b]2;vim\x07b\x1b]52;c;aGVsbG8=\x1b\\c"))
+	assert.Equal(t, "abc", string(out))
+	assert.Equal(t, []oscEvent{
+		{actionTitle, titleData{Title: "vim"}},
+		{actionClipboard, clipboardData{Selection: "c", Text: "hello"}},
+	}, events)
+
+	// notification split across reads
+	out, events = f.filter([]byte("x\x1b]777;notify;build"))
+	assert.Equal(t, "x", string(out))
+	assert.Empty(t, events)
+	out, events = f.filter([]byte(";done\x1b"))
+	assert.Empty(t, out)
+	assert.Empty(t, events)
+	out, events = f.filter([]byte("\\y"))
+	assert.Equal(t, "y", string(out))
+	assert.Equal(t, []oscEvent{{actionNotify, notifyData{Title: "build", Body: "done"}}}, events)
+
+	// unknown sequences and clipboard queries
+	out, events = f.filter([]byte("\x1b]8;;http://example.com\x1b\\link\x1b]52;c;?\x07"))
+	assert.Equal(t, "\x1b]8;;http://example.com\x1b\\link", string(out))
+	assert.Empty(t, events)
+
+	// a sequence cancelled by CAN is not held back any longer
+	out, events = f.filter([]byte("a\x1b]2;vim"))
+	assert.Equal(t, "a", string(out))
+	out, events = f.filter([]byte("\x18b"))
+	assert.Equal(t, "\x1b]2;vim\x18b", string(out))
+	assert.Empty(t, events)
+
+	// an escape sequence that is not an OSC after all
+	out, events = f.filter([]byte("\x1b"))
+	assert.Empty(t, out)
+	out, _ = f.filter([]byte("[K"))
+	assert.Equal(t, "\x1b[K", string(out))
+}
@@ -0,0 +1,183 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	ws "webshell/websocket"
+)
+
+const (
+	actionPredict = "predict"
+
+	predictInterval = 2 * time.Second
+	// typed text that is not echoed within this time counts as no echo
+	echoTimeout = 2 * time.Second
+	// consecutive outputs without the typed text before echo is considered off
+	echoMaxMisses = 3
+	// longer input is a paste rather than typing and is not tracked
+	maxTrackedInput = 16
+)
+
+// predictData tells the client whether it may echo keystrokes locally.
+type predictData struct {
+	// Enabled is set when latency is high and the echo state is known.
+	Enabled bool `json:"enabled"`
+	// Echo reports whether the remote side echoes input.
+	Echo bool `json:"echo"`
+	// Latency is the measured round trip in milliseconds.
+	Latency int64 `json:"latency"`
+}
+
+// errEchoUnknown is returned by echoReporter when the terminal modes do not
+// tell whether input is echoed.
+var errEchoUnknown = errors.New("echo mode unknown")
+
+// echoReporter is implemented by shells that know their terminal modes.
+type echoReporter interface {
+	EchoEnabled() (bool, error)
+}
+
+// latencyProber is implemented by shells with a network hop of their own,
+// which adds to the websocket round trip.
+type latencyProber interface {
+	RTT() (time.Duration, error)
+}
+
+// echoTracker infers whether the remote side echoes by watching whether
+// typed text comes back as the start of the next output.
+type echoTracker struct {
+	mu        sync.Mutex
+	echo      bool
+	known     bool
+	pending   []byte
+	pendingAt time.Time
+	misses    int
+}
+
+func (e *echoTracker) observeInput(p []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !isTypedText(p) {
+		e.pending = nil
+		return
+	}
+	e.pending = append(e.pending[:0], p...)
+	e.pendingAt = time.Now()
+	e.misses = 0
+}
+
+func (e *echoTracker) observeOutput(data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil {
+		return
+	}
+	if bytes.HasPrefix(data, e.pending) {
+		e.echo, e.known = true, true
+		e.pending = nil
+		return
+	}
+	e.misses++
+	if e.misses >= echoMaxMisses {
+		e.echo, e.known = false, true
+		e.pending = nil
+	}
+}
+
+// state returns the inferred echo mode and whether there is enough evidence
+// for it.
+func (e *echoTracker) state(now time.Time) (echo, known bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending != nil && now.Sub(e.pendingAt) > echoTimeout {
+		e.echo, e.known = false, true
+		e.pending = nil
+	}
+	return e.echo, e.known
+}
+
+// isTypedText reports whether p looks like keystrokes of printable text.
+func isTypedText(p []byte) bool {
+	if len(p) == 0 || len(p) > maxTrackedInput || !utf8.Valid(p) {
+		return false
+	}
+	for _, b := range p {
+		if b < 0x20 || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// predict periodically tells the client whether local echo is safe while the
+// round trip to the shell is slow.
+func (s *ShellService) predict(ss *session) {
+	if s.Latency == nil {
+		return
+	}
+
+	ticker := time.NewTicker(predictInterval)
+	defer ticker.Stop()
+
+	var last *predictData
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ticker.C:
+		}
+
+		latency := s.Latency()
+		if latency == 0 {
+			// the client has not answered a heartbeat ping yet
+			continue
+		}
+		if p, ok := shellAs[latencyProber](ss.shell); ok {
+			if rtt, err := p.RTT(); err == nil {
+				latency += rtt
+			}
+		}
+
+		d := predictData{Latency: latency.Milliseconds()}
+		if latency >= predictLatency {
+			d.Echo, d.Enabled = s.echoState(ss)
+		}
+
+		// only report changes, and nothing until there is something to enable
+		if last == nil && !d.Enabled || last != nil && last.Enabled == d.Enabled && last.Echo == d.Echo {
+			continue
+		}
+		last = &d
+
+		r, err := json.Marshal(d)
+		if err != nil {
+			s.Printf("(id: %s) error marshalling predict data: %v", ss.id, err)
+			continue
+		}
+		s.conn.WriteJSON(&ws.ServiceMessage{
+			Service: s.Name(),
+			Id:      ss.id,
+			Action:  actionPredict,
+			Data:    r,
+		})
+	}
+}
+
+// echoState prefers the terminal modes of the shell and falls back to echo
+// observed on the stream.
+func (s *ShellService) echoState(ss *session) (echo, known bool) {
+	if r, ok := shellAs[echoReporter](ss.shell); ok {
+		if echo, err := r.EchoEnabled(); err == nil {
+			return echo, true
+		}
+	}
+	return ss.echo.state(time.Now())
+}
@@ -0,0 +1,56 @@
+package shell
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEchoTracker(t *testing.T) {
+	t.Run("echoed input", func(t *testing.T) {
+		e := &echoTracker{}
+		_, known := e.state(time.Now())
+		assert.False(t, known)
+
+		e.observeInput([]byte("l"))
+		e.observeOutput([]byte("l"))
+
+		echo, known := e.state(time.Now())
+		assert.True(t, known)
+		assert.True(t, echo)
+	})
+
+	t.Run("password prompt", func(t *testing.T) {
+		e := &echoTracker{}
+		e.observeInput([]byte("s"))
+
+		_, known := e.state(time.Now())
+		assert.False(t, known)
+
+		echo, known := e.state(time.Now().Add(2 * echoTimeout))
+		assert.True(t, known)
+		assert.False(t, echo)
+	})
+
+	t.Run("unrelated output", func(t *testing.T) {
+		e := &echoTracker{}
+		e.observeInput([]byte("q"))
+		for i := 0; i < echoMaxMisses; i++ {
+			e.observeOutput([]byte("\x1b[2J"))
+		}
+
+		echo, known := e.state(time.Now())
+		assert.True(t, known)
+		assert.False(t, echo)
+	})
+
+	t.Run("control input is ignored", func(t *testing.T) {
+		e := &echoTracker{}
+		e.observeInput([]byte("\r"))
+		e.observeOutput([]byte("\r\n"))
+
+		_, known := e.state(time.Now().Add(2 * echoTimeout))
+		assert.False(t, known)
+	})
+}
@@ -0,0 +1,272 @@
+package shell
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	ws "webshell/websocket"
+)
+
+// Telnet COM Port Control option (RFC 2217).
+const optComPort byte = 44
+
+// Client to server commands. The server answers with the same command plus
+// comPortServerOffset.
+const (
+	comPortSetBaudRate byte = 1
+	comPortSetDataSize byte = 2
+	comPortSetParity   byte = 3
+	comPortSetStopSize byte = 4
+	comPortSetControl  byte = 5
+
+	comPortServerOffset byte = 100
+)
+
+const (
+	controlBreakOn  byte = 5
+	controlBreakOff byte = 6
+
+	defaultBreakDuration = 250 * time.Millisecond
+)
+
+var (
+	parityValues = map[string]byte{
+		"none":  1,
+		"odd":   2,
+		"even":  3,
+		"mark":  4,
+		"space": 5,
+	}
+	stopBitsValues = map[string]byte{
+		"1":   1,
+		"2":   2,
+		"1.5": 3,
+	}
+)
+
+// SerialConfig describes the line settings of a serial console. Zero values
+// leave the current setting of the port untouched.
+type SerialConfig struct {
+	BaudRate int    `json:"baudRate,omitempty"`
+	DataBits int    `json:"dataBits,omitempty"`
+	Parity   string `json:"parity,omitempty"`   // none, odd, even, mark or space
+	StopBits string `json:"stopBits,omitempty"` // 1, 1.5 or 2
+}
+
+// Validate checks that every setting is one RFC 2217 can express.
+func (c *SerialConfig) Validate() error {
+	if c.BaudRate < 0 {
+		return fmt.Errorf("invalid baud rate: %d", c.BaudRate)
+	}
+	if c.DataBits != 0 && (c.DataBits < 5 || c.DataBits > 8) {
+		return fmt.Errorf("invalid data bits: %d", c.DataBits)
+	}
+	if _, ok := parityValues[c.Parity]; c.Parity != "" && !ok {
+		return fmt.Errorf("invalid parity: %s", c.Parity)
+	}
+	if _, ok := stopBitsValues[c.StopBits]; c.StopBits != "" && !ok {
+		return fmt.Errorf("invalid stop bits: %s", c.StopBits)
+	}
+	return nil
+}
+
+// merge fills the zero fields of c from defaults.
+func (c SerialConfig) merge(defaults SerialConfig) SerialConfig {
+	if c.BaudRate == 0 {
+		c.BaudRate = defaults.BaudRate
+	}
+	if c.DataBits == 0 {
+		c.DataBits = defaults.DataBits
+	}
+	if c.Parity == "" {
+		c.Parity = defaults.Parity
+	}
+	if c.StopBits == "" {
+		c.StopBits = defaults.StopBits
+	}
+	return c
+}
+
+// serialPort is implemented by shells attached to a serial line.
+type serialPort interface {
+	Configure(config SerialConfig) error
+}
+
+// breaker is implemented by shells that can send a BREAK condition.
+type breaker interface {
+	Break(d time.Duration) error
+}
+
+// rfc2217Shell is a telnet shell driving a remote serial port.
+type rfc2217Shell struct {
+	*telnetShell
+
+	// guards config and enabled
+	configMu sync.Mutex
+	config   SerialConfig
+	enabled  bool
+}
+
+func newRFC2217Shell(t *telnetShell, config SerialConfig) *rfc2217Shell {
+	r := &rfc2217Shell{
+		telnetShell: t,
+		config:      config,
+	}
+
+	t.mu.Lock()
+	t.supportLocal[optComPort] = true
+	t.subHandlers[optComPort] = r.handleComPort
+	t.onLocalEnabled[optComPort] = r.comPortEnabled
+	t.mu.Unlock()
+
+	return r
+}
+
+// Configure implements serialPort. Settings are sent right away when the
+// server already accepted COM-PORT-OPTION, otherwise once it does.
+func (r *rfc2217Shell) Configure(config SerialConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	r.configMu.Lock()
+	r.config = config.merge(r.config)
+	enabled := r.enabled
+	r.configMu.Unlock()
+
+	if enabled {
+		return r.sendConfig()
+	}
+	return nil
+}
+
+// Break implements breaker.
+func (r *rfc2217Shell) Break(d time.Duration) error {
+	if d <= 0 {
+		d = defaultBreakDuration
+	}
+
+	r.configMu.Lock()
+	enabled := r.enabled
+	r.configMu.Unlock()
+
+	if !enabled {
+		// fall back to the plain telnet BREAK command
+		return r.writeRaw([]byte{telnetIAC, telnetBRK})
+	}
+
+	if err := r.writeSub(optComPort, []byte{comPortSetControl, controlBreakOn}); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return r.writeSub(optComPort, []byte{comPortSetControl, controlBreakOff})
+}
+
+func (r *rfc2217Shell) comPortEnabled() {
+	r.configMu.Lock()
+	r.enabled = true
+	r.configMu.Unlock()
+
+	if err := r.sendConfig(); err != nil {
+		r.Printf("rfc2217 configure error: %v", err)
+	}
+}
+
+func (r *rfc2217Shell) sendConfig() error {
+	r.configMu.Lock()
+	config := r.config
+	r.configMu.Unlock()
+
+	if config.BaudRate > 0 {
+		payload := make([]byte, 5)
+		payload[0] = comPortSetBaudRate
+		binary.BigEndian.PutUint32(payload[1:], uint32(config.BaudRate))
+		if err := r.writeSub(optComPort, payload); err != nil {
+			return err
+		}
+	}
+	if config.DataBits > 0 {
+		if err := r.writeSub(optComPort, []byte{comPortSetDataSize, byte(config.DataBits)}); err != nil {
+			return err
+		}
+	}
+	if v, ok := parityValues[config.Parity]; ok {
+		if err := r.writeSub(optComPort, []byte{comPortSetParity, v}); err != nil {
+			return err
+		}
+	}
+	if v, ok := stopBitsValues[config.StopBits]; ok {
+		if err := r.writeSub(optComPort, []byte{comPortSetStopSize, v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleComPort logs the settings the server reports back, which may differ
+// from what was asked for when the hardware does not support them.
+func (r *rfc2217Shell) handleComPort(data []byte) {
+	if len(data) < 2 || data[0] <= comPortServerOffset {
+		return
+	}
+
+	switch data[0] - comPortServerOffset {
+	case comPortSetBaudRate:
+		if len(data) >= 5 {
+			r.Printf("serial port baud rate: %d", binary.BigEndian.Uint32(data[1:5]))
+		}
+	case comPortSetDataSize:
+		r.Printf("serial port data bits: %d", data[1])
+	case comPortSetParity:
+		r.Printf("serial port parity: %d", data[1])
+	case comPortSetStopSize:
+		r.Printf("serial port stop bits: %d", data[1])
+	}
+}
+
+// RFC2217ShellProvider opens telnet shells that control a remote serial port.
+type RFC2217ShellProvider struct {
+	TCPShellProvider
+	// Serial holds the defaults used when start does not specify them.
+	Serial SerialConfig
+}
+
+// NewShell implements ShellProvider.
+func (r *RFC2217ShellProvider) NewShell(cwd string) (Shell, error) {
+	base, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	sh := newRFC2217Shell(newTelnetShell(base), r.Serial)
+	if err := sh.request(telnetWILL, optComPort); err != nil {
+		sh.Close()
+		return nil, err
+	}
+	if err := sh.request(telnetDO, optSGA); err != nil {
+		sh.Close()
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+func NewRFC2217Service(host string, port int, opts TCPOptions, serial SerialConfig) ws.Service {
+	logger := log.New(log.Writer(), "[serial-shell] ", log.LstdFlags)
+
+	opts.Mode = TCPModeTelnet
+
+	sp := &RFC2217ShellProvider{
+		TCPShellProvider: TCPShellProvider{
+			Host:       host,
+			Port:       port,
+			TCPOptions: opts,
+			Logger:     logger,
+		},
+		Serial: serial,
+	}
+
+	return newShellService(sp, logger)
+}
@@ -0,0 +1,138 @@
+package shell
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// comPortServer is a minimal RFC 2217 access server: it accepts
+// COM-PORT-OPTION and acknowledges every subnegotiation it receives.
+type comPortServer struct {
+	net.Listener
+	mu       sync.Mutex
+	received []byte
+}
+
+func newComPortServer(t *testing.T) *comPortServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Skipping test: cannot listen: %v", err)
+	}
+	s := &comPortServer{Listener: l}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, buf[:n]...)
+			s.mu.Unlock()
+
+			chunk := buf[:n]
+			if bytes.Contains(chunk, []byte{telnetIAC, telnetWILL, optComPort}) {
+				conn.Write([]byte{telnetIAC, telnetDO, optComPort})
+			}
+			if i := bytes.Index(chunk, []byte{telnetIAC, telnetSB, optComPort}); i >= 0 && i+4 < len(chunk) {
+				// acknowledge with the server variant of the command
+				conn.Write([]byte{telnetIAC, telnetSB, optComPort, chunk[i+3] + comPortServerOffset, chunk[i+4], telnetIAC, telnetSE})
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *comPortServer) waitFor(t *testing.T, want []byte) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return bytes.Contains(s.received, want)
+	}, 2*time.Second, 10*time.Millisecond, "server never received %v", want)
+}
+
+func TestRFC2217Shell(t *testing.T) {
+	server := newComPortServer(t)
+	addr := server.Addr().(*net.TCPAddr)
+
+	provider := &RFC2217ShellProvider{
+		TCPShellProvider: TCPShellProvider{
+			Host:       addr.IP.String(),
+			Port:       addr.Port,
+			TCPOptions: TCPOptions{Mode: TCPModeTelnet},
+			Logger:     log.New(os.Stderr, "[test] ", log.LstdFlags),
+		},
+		Serial: SerialConfig{BaudRate: 9600, DataBits: 8, Parity: "none", StopBits: "1"},
+	}
+
+	sh, err := provider.NewShell("")
+	assert.NoError(t, err)
+	defer sh.Close()
+
+	// negotiation is answered while reading
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := sh.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	server.waitFor(t, []byte{telnetIAC, telnetWILL, optComPort})
+	server.waitFor(t, []byte{telnetIAC, telnetSB, optComPort, comPortSetBaudRate, 0, 0, 0x25, 0x80, telnetIAC, telnetSE})
+	server.waitFor(t, []byte{telnetIAC, telnetSB, optComPort, comPortSetDataSize, 8, telnetIAC, telnetSE})
+	server.waitFor(t, []byte{telnetIAC, telnetSB, optComPort, comPortSetParity, 1, telnetIAC, telnetSE})
+	server.waitFor(t, []byte{telnetIAC, telnetSB, optComPort, comPortSetStopSize, 1, telnetIAC, telnetSE})
+
+	sp, ok := shellAs[serialPort](sh)
+	assert.True(t, ok)
+	assert.NoError(t, sp.Configure(SerialConfig{BaudRate: 115200, Parity: "even"}))
+	server.waitFor(t, []byte{telnetIAC, telnetSB, optComPort, comPortSetBaudRate, 0, 1, 0xc2, 0x00, telnetIAC, telnetSE})
+	server.waitFor(t, []byte{telnetIAC, telnetSB, optComPort, comPortSetParity, 3, telnetIAC, telnetSE})
+
+	b, ok := shellAs[breaker](sh)
+	assert.True(t, ok)
+	assert.NoError(t, b.Break(time.Millisecond))
+	server.waitFor(t, []byte{
+		telnetIAC, telnetSB, optComPort, comPortSetControl, controlBreakOn, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, optComPort, comPortSetControl, controlBreakOff, telnetIAC, telnetSE,
+	})
+}
+
+func TestSerialConfig_Validate(t *testing.T) {
+	valid := []SerialConfig{
+		{},
+		{BaudRate: 9600, DataBits: 7, Parity: "odd", StopBits: "1.5"},
+	}
+	for _, c := range valid {
+		assert.NoError(t, c.Validate())
+	}
+
+	invalid := []SerialConfig{
+		{BaudRate: -1},
+		{DataBits: 9},
+		{Parity: "sometimes"},
+		{StopBits: "3"},
+	}
+	for _, c := range invalid {
+		assert.Error(t, c.Validate())
+	}
+}
@@ -0,0 +1,548 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	ws "webshell/websocket"
+)
+
+const (
+	actionScrollbackSearch = "scrollback_search"
+	actionScrollbackExport = "scrollback_export"
+
+	exportFormatText = "text"
+	exportFormatHTML = "html"
+
+	defaultSearchContext = 2
+	defaultSearchLimit   = 100
+	// longer lines are cut, output without newlines must not grow forever
+	maxScrollbackLine = 64 * 1024
+)
+
+type scrollbackSearchData struct {
+	Pattern    string `json:"pattern"`
+	IgnoreCase bool   `json:"ignoreCase,omitempty"`
+	// Context is the number of lines returned around each match.
+	Context *int `json:"context,omitempty"`
+	Limit   int  `json:"limit,omitempty"`
+}
+type scrollbackMatch struct {
+	// Line counts from the first line the shell printed, including the ones
+	// that were dropped from the buffer since.
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+type scrollbackSearchResult struct {
+	Matches []scrollbackMatch `json:"matches"`
+	// Truncated is set when there were more matches than the limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+type scrollbackExportData struct {
+	Format string `json:"format"`
+}
+
+// cellStyle is the SGR state of a piece of text. Colors are -1 for the
+// default, 0-255 for the palette, or rgbColor|0xrrggbb.
+type cellStyle struct {
+	fg, bg                           int
+	bold, italic, underline, inverse bool
+}
+
+const rgbColor = 1 << 24
+
+var defaultStyle = cellStyle{fg: -1, bg: -1}
+
+type styledText struct {
+	style cellStyle
+	text  []byte
+}
+
+type scrollbackLine []styledText
+
+func (l scrollbackLine) String() string {
+	var sb strings.Builder
+	for _, t := range l {
+		sb.Write(t.text)
+	}
+	return sb.String()
+}
+
+type ansiState int
+
+const (
+	ansiGround ansiState = iota
+	ansiEscape
+	ansiCSI
+	ansiString       // OSC, DCS and the like, up to BEL or ST
+	ansiStringEscape // ESC inside a string
+)
+
+// ansiParser follows escape sequences through terminal output, keeping state
+// between reads.
+type ansiParser struct {
+	state  ansiState
+	params []byte
+}
+
+// feed passes the bytes of p outside escape sequences to text, and the
+// parameters of SGR sequences to sgr if set.
+func (a *ansiParser) feed(p []byte, text func(byte), sgr func(string)) {
+	for _, b := range p {
+		switch a.state {
+		case ansiGround:
+			if b == ansiESC {
+				a.state = ansiEscape
+			} else {
+				text(b)
+			}
+		case ansiEscape:
+			switch b {
+			case '[':
+				a.state = ansiCSI
+				a.params = a.params[:0]
+			case ']', 'P', '_', '^', 'X':
+				a.state = ansiString
+			default:
+				// two-byte sequences such as ESC = or ESC 7
+				a.state = ansiGround
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				if b == 'm' && sgr != nil {
+					sgr(string(a.params))
+				}
+				a.state = ansiGround
+			} else {
+				a.params = append(a.params, b)
+			}
+		case ansiString:
+			if b == ansiBEL {
+				a.state = ansiGround
+			} else if b == ansiESC {
+				a.state = ansiStringEscape
+			}
+		case ansiStringEscape:
+			if b == '\\' {
+				a.state = ansiGround
+			} else {
+				a.state = ansiString
+			}
+		}
+	}
+}
+
+// scrollback keeps the last lines a shell printed, without escape sequences
+// but with their colors.
+type scrollback struct {
+	mu sync.Mutex
+
+	max int
+	// ring of complete lines, oldest at start
+	lines []scrollbackLine
+	start int
+	// lines dropped off the front
+	dropped int
+	current scrollbackLine
+	// bytes in current
+	currentLen int
+
+	style  cellStyle
+	parser ansiParser
+	// a CR not yet known to start a CRLF
+	pendingCR bool
+}
+
+func newScrollback(max int) *scrollback {
+	return &scrollback{max: max, style: defaultStyle}
+}
+
+func (sb *scrollback) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.parser.feed(p, sb.ground, sb.sgr)
+	return len(p), nil
+}
+
+func (sb *scrollback) ground(b byte) {
+	switch b {
+	case '\r':
+		sb.pendingCR = true
+	case '\n':
+		sb.pendingCR = false
+		sb.newline()
+	case '\b':
+		if !sb.pendingCR {
+			sb.backspace()
+		}
+	case '\t':
+		sb.print('\t')
+	default:
+		if b >= 0x20 && b != 0x7f {
+			sb.print(b)
+		}
+	}
+}
+
+// print adds b to the line, rewriting it when a lone CR came first, as
+// progress bars do. CR CR LF, which ONLCR makes of CR LF, keeps the line.
+func (sb *scrollback) print(b byte) {
+	if sb.pendingCR {
+		sb.pendingCR = false
+		sb.current, sb.currentLen = nil, 0
+	}
+	sb.text(b)
+}
+
+func (sb *scrollback) text(b byte) {
+	if sb.currentLen >= maxScrollbackLine {
+		return
+	}
+	sb.currentLen++
+
+	if last := len(sb.current) - 1; last >= 0 && sb.current[last].style == sb.style {
+		sb.current[last].text = append(sb.current[last].text, b)
+		return
+	}
+	sb.current = append(sb.current, styledText{style: sb.style, text: []byte{b}})
+}
+
+// backspace removes the last character of the line.
+func (sb *scrollback) backspace() {
+	for last := len(sb.current) - 1; last >= 0; last-- {
+		t := sb.current[last].text
+		if len(t) == 0 {
+			sb.current = sb.current[:last]
+			continue
+		}
+		i := len(t) - 1
+		for i > 0 && t[i]&0xc0 == 0x80 {
+			i-- // keep multi-byte characters whole
+		}
+		sb.current[last].text = t[:i]
+		sb.currentLen -= len(t) - i
+		if i == 0 {
+			sb.current = sb.current[:last]
+		}
+		return
+	}
+}
+
+func (sb *scrollback) newline() {
+	if len(sb.lines) < sb.max {
+		sb.lines = append(sb.lines, sb.current)
+	} else {
+		sb.lines[sb.start] = sb.current
+		sb.start = (sb.start + 1) % sb.max
+		sb.dropped++
+	}
+	sb.current, sb.currentLen = nil, 0
+}
+
+// sgr applies Select Graphic Rendition parameters.
+func (sb *scrollback) sgr(params string) {
+	if params == "" {
+		sb.style = defaultStyle
+		return
+	}
+
+	codes := strings.FieldsFunc(params, func(r rune) bool { return r == ';' || r == ':' })
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case code == 0:
+			sb.style = defaultStyle
+		case code == 1:
+			sb.style.bold = true
+		case code == 3:
+			sb.style.italic = true
+		case code == 4:
+			sb.style.underline = true
+		case code == 7:
+			sb.style.inverse = true
+		case code == 22:
+			sb.style.bold = false
+		case code == 23:
+			sb.style.italic = false
+		case code == 24:
+			sb.style.underline = false
+		case code == 27:
+			sb.style.inverse = false
+		case code >= 30 && code <= 37:
+			sb.style.fg = code - 30
+		case code == 39:
+			sb.style.fg = -1
+		case code >= 40 && code <= 47:
+			sb.style.bg = code - 40
+		case code == 49:
+			sb.style.bg = -1
+		case code >= 90 && code <= 97:
+			sb.style.fg = code - 90 + 8
+		case code >= 100 && code <= 107:
+			sb.style.bg = code - 100 + 8
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if color == -1 {
+				continue
+			}
+			if code == 38 {
+				sb.style.fg = color
+			} else {
+				sb.style.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor parses the arguments of SGR 38 and 48, returning the color
+// and the number of arguments used.
+func extendedColor(args []string) (int, int) {
+	if len(args) == 0 {
+		return -1, 0
+	}
+	switch args[0] {
+	case "5":
+		if len(args) < 2 {
+			return -1, len(args)
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > 255 {
+			return -1, 2
+		}
+		return n, 2
+	case "2":
+		if len(args) < 4 {
+			return -1, len(args)
+		}
+		rgb := 0
+		for _, a := range args[1:4] {
+			v, err := strconv.Atoi(a)
+			if err != nil || v < 0 || v > 255 {
+				return -1, 4
+			}
+			rgb = rgb<<8 | v
+		}
+		return rgbColor | rgb, 4
+	}
+	return -1, 1
+}
+
+// snapshot returns the buffered lines, including the unfinished last one,
+// and the number of the first.
+func (sb *scrollback) snapshot() ([]scrollbackLine, int) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	lines := make([]scrollbackLine, 0, len(sb.lines)+1)
+	lines = append(lines, sb.lines[sb.start:]...)
+	lines = append(lines, sb.lines[:sb.start]...)
+	if len(sb.current) > 0 {
+		// the unfinished line still changes in place
+		current := make(scrollbackLine, len(sb.current))
+		for i, t := range sb.current {
+			current[i] = styledText{style: t.style, text: bytes.Clone(t.text)}
+		}
+		lines = append(lines, current)
+	}
+	return lines, sb.dropped
+}
+
+func (sb *scrollback) search(d *scrollbackSearchData) (*scrollbackSearchResult, error) {
+	pattern := d.Pattern
+	if d.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	context := defaultSearchContext
+	if d.Context != nil && *d.Context >= 0 {
+		context = *d.Context
+	}
+	limit := defaultSearchLimit
+	if d.Limit > 0 {
+		limit = d.Limit
+	}
+
+	lines, first := sb.snapshot()
+	text := make([]string, len(lines))
+	for i, l := range lines {
+		text[i] = l.String()
+	}
+
+	result := &scrollbackSearchResult{Matches: []scrollbackMatch{}}
+	for i, t := range text {
+		if !re.MatchString(t) {
+			continue
+		}
+		if len(result.Matches) == limit {
+			result.Truncated = true
+			break
+		}
+		result.Matches = append(result.Matches, scrollbackMatch{
+			Line:   first + i,
+			Text:   t,
+			Before: text[max(0, i-context):i],
+			After:  text[i+1 : min(len(text), i+1+context)],
+		})
+	}
+	return result, nil
+}
+
+func (sb *scrollback) export(format string) (string, error) {
+	lines, _ := sb.snapshot()
+
+	var out strings.Builder
+	switch format {
+	case exportFormatText, "":
+		for _, l := range lines {
+			out.WriteString(l.String())
+			out.WriteByte('\n')
+		}
+	case exportFormatHTML:
+		out.WriteString(`<pre class="webshell-scrollback">`)
+		for _, l := range lines {
+			for _, t := range l {
+				writeHTMLText(&out, t)
+			}
+			out.WriteByte('\n')
+		}
+		out.WriteString("</pre>\n")
+	default:
+		return "", fmt.Errorf("unsupported export format: %s", format)
+	}
+	return out.String(), nil
+}
+
+func writeHTMLText(out *strings.Builder, t styledText) {
+	text := html.EscapeString(string(t.text))
+	if t.style == defaultStyle {
+		out.WriteString(text)
+		return
+	}
+
+	fg, bg := t.style.fg, t.style.bg
+	if t.style.inverse {
+		fg, bg = bg, fg
+		// the defaults of the page are unknown, assume light on dark
+		if fg == -1 {
+			fg = 0
+		}
+		if bg == -1 {
+			bg = 7
+		}
+	}
+
+	var css []string
+	if fg != -1 {
+		css = append(css, "color:"+cssColor(fg))
+	}
+	if bg != -1 {
+		css = append(css, "background-color:"+cssColor(bg))
+	}
+	if t.style.bold {
+		css = append(css, "font-weight:bold")
+	}
+	if t.style.italic {
+		css = append(css, "font-style:italic")
+	}
+	if t.style.underline {
+		css = append(css, "text-decoration:underline")
+	}
+	fmt.Fprintf(out, `<span style="%s">%s</span>`, strings.Join(css, ";"), text)
+}
+
+// the 16 colors of xterm
+var basePalette = [16]int{
+	0x000000, 0xcd0000, 0x00cd00, 0xcdcd00, 0x0000ee, 0xcd00cd, 0x00cdcd, 0xe5e5e5,
+	0x7f7f7f, 0xff0000, 0x00ff00, 0xffff00, 0x5c5cff, 0xff00ff, 0x00ffff, 0xffffff,
+}
+
+func cssColor(c int) string {
+	var rgb int
+	switch {
+	case c&rgbColor != 0:
+		rgb = c &^ rgbColor
+	case c < 16:
+		rgb = basePalette[c]
+	case c < 232:
+		// 6x6x6 color cube
+		c -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + v*40
+		}
+		rgb = level(c/36)<<16 | level(c/6%6)<<8 | level(c%6)
+	default:
+		gray := 8 + (c-232)*10
+		rgb = gray<<16 | gray<<8 | gray
+	}
+	return fmt.Sprintf("#%06x", rgb)
+}
+
+// handleScrollback answers search and export requests for shell id.
+func (s *ShellService) handleScrollback(ss *session, action string, data json.RawMessage) {
+	if ss.scrollback == nil {
+		s.handleError(ss.id, action, fmt.Errorf("scrollback is disabled"))
+		return
+	}
+
+	var result any
+	switch action {
+	case actionScrollbackSearch:
+		var d scrollbackSearchData
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.Printf("(id: %s) error unmarshalling %s payload: %v", ss.id, action, err)
+			return
+		}
+		r, err := ss.scrollback.search(&d)
+		if err != nil {
+			s.handleError(ss.id, action, err)
+			return
+		}
+		result = r
+	case actionScrollbackExport:
+		var d scrollbackExportData
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &d); err != nil {
+				s.Printf("(id: %s) error unmarshalling %s payload: %v", ss.id, action, err)
+				return
+			}
+		}
+		r, err := ss.scrollback.export(d.Format)
+		if err != nil {
+			s.handleError(ss.id, action, err)
+			return
+		}
+		result = r
+	}
+
+	r, err := json.Marshal(result)
+	if err != nil {
+		s.Printf("(id: %s) error marshalling %s result: %v", ss.id, action, err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      ss.id,
+		Action:  action,
+		Data:    r,
+	})
+}
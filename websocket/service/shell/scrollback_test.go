@@ -0,0 +1,64 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrollback(t *testing.T) {
+	sb := newScrollback(2)
+	sb.Write([]byte("\x1b]0;title\x07$ make\r\n"))
+	sb.Write([]byte("building 10%\rbuilding 100%\r\n\x1b[1;31merr"))
+	sb.Write([]byte("or\x1b[0m: missing file\r\n"))
+	sb.Write([]byte("$ lx\bs"))
+
+	lines, first := sb.snapshot()
+	assert.Equal(t, 1, first)
+	var text []string
+	for _, l := range lines {
+		text = append(text, l.String())
+	}
+	assert.Equal(t, []string{"building 100%", "error: missing file", "$ ls"}, text)
+
+	context := 1
+	result, err := sb.search(&scrollbackSearchData{Pattern: "ERROR", IgnoreCase: true, Context: &context})
+	assert.NoError(t, err)
+	assert.Equal(t, []scrollbackMatch{{
+		Line:   2,
+		Text:   "error: missing file",
+		Before: []string{"building 100%"},
+		After:  []string{"$ ls"},
+	}}, result.Matches)
+
+	out, err := sb.export(exportFormatText)
+	assert.NoError(t, err)
+	assert.Equal(t, "building 100%\nerror: missing file\n$ ls\n", out)
+
+	out, err = sb.export(exportFormatHTML)
+	assert.NoError(t, err)
+	assert.Contains(t, out, `<span style="color:#cd0000;font-weight:bold">error</span>: missing file`)
+
+	_, err = sb.export("pdf")
+	assert.Error(t, err)
+}
+
+func TestCSSColor(t *testing.T) {
+	assert.Equal(t, "#ff0000", cssColor(9))
+	assert.Equal(t, "#5f87af", cssColor(67))
+	assert.Equal(t, "#080808", cssColor(232))
+	assert.Equal(t, "#123456", cssColor(rgbColor|0x123456))
+}
+
+func TestScrollbackCRCRLF(t *testing.T) {
+	sb := newScrollback(10)
+	// a PTY with ONLCR turns CR LF into CR CR LF
+	sb.Write([]byte("a\r\r\nb\r\rc\r\n"))
+
+	lines, _ := sb.snapshot()
+	var text []string
+	for _, l := range lines {
+		text = append(text, l.String())
+	}
+	assert.Equal(t, []string{"a", "c"}, text)
+}
@@ -2,10 +2,17 @@ package shell
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
+
+	"webshell/service/limits"
+	"webshell/service/snippet"
 	"webshell/utils"
 	ws "webshell/websocket"
 )
@@ -15,6 +22,7 @@ const (
 	actionResize    = "resize"
 	actionStart     = "start"
 	actionTerminate = "terminate"
+	actionBreak     = "break"
 )
 
 type commandData string
@@ -24,18 +32,57 @@ type resizeData struct {
 }
 type startData struct {
 	Cwd string `json:"cwd"`
+	// Encoding is the charset of the remote side, UTF-8 when empty.
+	Encoding string `json:"encoding,omitempty"`
+	// Serial overrides the line settings of serial console shells.
+	Serial *SerialConfig `json:"serial,omitempty"`
+	// IdleTimeout and MaxDuration in minutes close the shell after that long
+	// without input or output, or after that long at all. They can only be
+	// shorter than the server limits.
+	IdleTimeout int `json:"idleTimeout,omitempty"`
+	MaxDuration int `json:"maxDuration,omitempty"`
+}
+type breakData struct {
+	// Duration of the BREAK condition in milliseconds.
+	Duration int `json:"duration,omitempty"`
 }
 
 type ShellService struct {
-	conn   *ws.Conn
+	conn *ws.Conn
+	// id keys the shells of this connection in limits.Shells
+	id     string
 	shells map[string]Shell
+	// per-shell state, keyed like shells
+	sessions map[string]*session
+	// broadcast groups, holding the ids of their shells
+	groups map[string]map[string]struct{}
 
 	ShellProvider
 
+	// Latency returns the round trip of the websocket, used to decide when
+	// local echo predictions are worth sending. Nil disables predictions.
+	Latency func() time.Duration
+
+	// Snippets looks up a saved snippet the client may run. Nil disables
+	// the snippet action.
+	Snippets func(id string) (*snippet.Snippet, error)
+
 	*log.Logger
 	*sync.RWMutex
 }
 
+func newShellService(sp ShellProvider, logger *log.Logger) *ShellService {
+	return &ShellService{
+		id:            uuid.NewString(),
+		ShellProvider: sp,
+		shells:        make(map[string]Shell),
+		sessions:      make(map[string]*session),
+		groups:        make(map[string]map[string]struct{}),
+		Logger:        logger,
+		RWMutex:       &sync.RWMutex{},
+	}
+}
+
 func (s *ShellService) Name() string {
 	return "shell"
 }
@@ -45,6 +92,12 @@ func (s *ShellService) Register(conn *ws.Conn) {
 }
 
 func (s *ShellService) HandleTextMessage(id string, action string, data json.RawMessage) {
+	// broadcasts are addressed to a group rather than a shell
+	if action == actionBroadcast {
+		s.handleBroadcast(id, data)
+		return
+	}
+
 	s.RLock()
 	sh, exists := s.shells[id]
 	s.RUnlock()
@@ -63,7 +116,7 @@ func (s *ShellService) HandleTextMessage(id string, action string, data json.Raw
 			s.Printf("(id: %s) error unmarshalling command payload: %v", id, err)
 			return
 		}
-		if _, err := sh.Write([]byte(command)); err != nil {
+		if err := s.writeCommand(id, sh, command); err != nil {
 			s.Printf("(id: %s) error writing to shell: %v", id, err)
 			// 在前端 shell 里输 `exit` 后，shell 已关闭，但 websocket 连接还没断
 			// 暂时在此处这样处理，可以在用户再次操作时触发重连
@@ -86,8 +139,8 @@ func (s *ShellService) HandleTextMessage(id string, action string, data json.Raw
 			s.Printf("(id: %s) error unmarshalling start payload: %v", id, err)
 			return
 		}
-		if err := s.startShell(id, start.Cwd); err != nil {
-			s.Printf("(id: %s) error starting shell: %v", id, err)
+		if err := s.startShell(id, &start); err != nil {
+			s.handleError(id, actionStart, fmt.Errorf("error starting shell: %w", err))
 			return
 		}
 		s.conn.WriteJSON(&ws.ServiceMessage{
@@ -95,30 +148,148 @@ func (s *ShellService) HandleTextMessage(id string, action string, data json.Raw
 			Id:      id,
 			Action:  actionStart,
 		})
+	case actionBreak:
+		var d breakData
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &d); err != nil {
+				s.Printf("(id: %s) error unmarshalling break payload: %v", id, err)
+				return
+			}
+		}
+		b, ok := shellAs[breaker](sh)
+		if !ok {
+			s.handleError(id, actionBreak, fmt.Errorf("shell does not support BREAK"))
+			return
+		}
+		go func() {
+			if err := b.Break(time.Duration(d.Duration) * time.Millisecond); err != nil {
+				s.handleError(id, actionBreak, err)
+			}
+		}()
+	case actionZmodemFile, actionZmodemChunk, actionZmodemSend, actionZmodemCancel:
+		ss := s.session(id)
+		if ss == nil {
+			return
+		}
+		s.handleZmodem(ss, action, data)
+	case actionExpect, actionExpectCancel:
+		ss := s.session(id)
+		if ss == nil {
+			return
+		}
+		if action == actionExpect {
+			s.handleExpect(ss, data)
+		} else {
+			ss.stopScript()
+		}
+	case actionScrollbackSearch, actionScrollbackExport:
+		if ss := s.session(id); ss != nil {
+			s.handleScrollback(ss, action, data)
+		}
+	case actionTriggerAdd, actionTriggerRemove, actionTriggerList:
+		if ss := s.session(id); ss != nil {
+			s.handleTrigger(ss, action, data)
+		}
+	case actionSnippet:
+		s.handleSnippet(id, sh, data)
+	case actionJoin, actionLeave:
+		var d groupData
+		if err := json.Unmarshal(data, &d); err != nil {
+			s.Printf("(id: %s) error unmarshalling %s payload: %v", id, action, err)
+			return
+		}
+		if action == actionJoin {
+			s.handleJoin(id, d.Group)
+		} else {
+			s.handleLeave(id, d.Group)
+		}
 	case actionTerminate:
-		sh.Close()
+		s.closeShell(id)
+	}
+}
 
-		s.Lock()
-		delete(s.shells, id)
-		s.Unlock()
+// closeShell closes shell id and forgets about it.
+func (s *ShellService) closeShell(id string) {
+	s.Lock()
+	sh, exists := s.shells[id]
+	s.leaveGroups(id)
+	if ss, ok := s.sessions[id]; ok {
+		ss.close()
+		delete(s.sessions, id)
+	}
+	delete(s.shells, id)
+	s.Unlock()
+
+	if exists {
+		sh.Close()
 	}
 }
 
 func (s *ShellService) Cleanup(err error) {
-	for _, sh := range s.shells {
+	// timeouts close shells concurrently
+	s.Lock()
+	shells, sessions := s.shells, s.sessions
+	s.shells = nil
+	s.sessions = nil
+	s.groups = nil
+	s.Unlock()
+
+	for _, sh := range shells {
 		sh.Close()
 	}
-	s.shells = nil
+	for _, ss := range sessions {
+		ss.close()
+	}
 }
 
-func (s *ShellService) startShell(id string, cwd string) error {
-	sh, err := s.ShellProvider.NewShell(cwd)
+func (s *ShellService) startShell(id string, start *startData) error {
+	enc, err := utils.LookupEncoding(start.Encoding)
+	if err != nil {
+		return err
+	}
+
+	release, err := limits.Shells.Acquire(s.id)
 	if err != nil {
 		return err
 	}
 
+	sh, err := s.ShellProvider.NewShell(start.Cwd)
+	if err != nil {
+		release()
+		return err
+	}
+
+	if start.Serial != nil {
+		sp, ok := shellAs[serialPort](sh)
+		if !ok {
+			sh.Close()
+			release()
+			return fmt.Errorf("shell is not attached to a serial port")
+		}
+		if err := sp.Configure(*start.Serial); err != nil {
+			sh.Close()
+			release()
+			return err
+		}
+	}
+
+	if enc != nil {
+		sh = newEncodedShell(sh, enc)
+	}
+
+	ss := newSession(id, sh)
+	ss.release = release
+
 	s.Lock()
+	if s.shells == nil {
+		// the connection closed while the shell started
+		s.Unlock()
+		ss.close()
+		sh.Close()
+		return fmt.Errorf("connection closed")
+	}
 	s.shells[id] = sh
+	s.sessions[id] = ss
 	s.Unlock()
 
 	// 发送 shell 输出
@@ -132,7 +303,44 @@ func (s *ShellService) startShell(id string, cwd string) error {
 			return d
 		},
 	}
-	go io.Copy(writer, sh)
+	go s.pump(ss, writer)
+	go s.predict(ss)
+	go s.watchTimeouts(ss, newTimeoutPolicy(start.IdleTimeout, start.MaxDuration))
 
 	return nil
 }
+
+// writeCommand sends input typed by the client to shell id.
+func (s *ShellService) writeCommand(id string, sh Shell, command commandData) error {
+	if ss := s.session(id); ss != nil {
+		if t := ss.currentTransfer(); t != nil {
+			// keystrokes would corrupt the transfer, but Ctrl-C aborts it
+			if strings.ContainsRune(string(command), 0x03) {
+				s.handleZmodem(ss, actionZmodemCancel, nil)
+			}
+			return nil
+		}
+		ss.touch()
+		ss.triggers.input(time.Now())
+		ss.echo.observeInput([]byte(command))
+	}
+	_, err := sh.Write([]byte(command))
+	return err
+}
+
+func (s *ShellService) handleError(id, action string, err error) {
+	s.Printf("(id: %s) %v", id, err)
+
+	msg := &ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  action,
+		Error:   err.Error(),
+	}
+	// caps come with details the client can show
+	var limitErr *limits.LimitError
+	if errors.As(err, &limitErr) {
+		msg.Data, _ = json.Marshal(limitErr)
+	}
+	s.conn.WriteJSON(msg)
+}
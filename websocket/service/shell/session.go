@@ -0,0 +1,206 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is the state kept for a running shell, next to ShellService.shells.
+type session struct {
+	id    string
+	shell Shell
+
+	echo *echoTracker
+	osc  *oscFilter
+	// nil when disabled
+	scrollback *scrollback
+	triggers   *triggerSet
+
+	// ZMODEM transfers are detected in the output
+	zmodem bool
+	// guards transfer and tokens
+	mu       sync.Mutex
+	transfer *transfer
+	// downloads kept for the client
+	tokens []string
+	// copies of the output for scripts, see subscribe
+	subscribers map[*subscriber]struct{}
+	// stops the script running in the shell
+	cancelScript context.CancelFunc
+
+	started time.Time
+	// frees the slot of the shell in limits.Shells
+	release func()
+	// unix nanoseconds of the last input or output
+	active atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(id string, sh Shell) *session {
+	ss := &session{
+		id:       id,
+		shell:    sh,
+		echo:     &echoTracker{},
+		osc:      &oscFilter{},
+		triggers: &triggerSet{},
+		zmodem:   supportsZmodem(sh),
+		started:  time.Now(),
+		done:     make(chan struct{}),
+	}
+	if scrollbackLines > 0 {
+		ss.scrollback = newScrollback(scrollbackLines)
+	}
+	ss.touch()
+	return ss
+}
+
+// touch records activity for the idle timeout.
+func (ss *session) touch() {
+	ss.active.Store(time.Now().UnixNano())
+}
+
+func (ss *session) lastActive() time.Time {
+	return time.Unix(0, ss.active.Load())
+}
+
+// close stops the goroutines attached to the session and removes its
+// downloads. The shell itself is closed by its owner.
+func (ss *session) close() {
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+		if ss.release != nil {
+			ss.release()
+		}
+
+		ss.mu.Lock()
+		if ss.transfer != nil {
+			ss.transfer.cancel()
+		}
+		tokens := ss.tokens
+		ss.tokens = nil
+		ss.mu.Unlock()
+
+		removeStaged(tokens)
+	})
+}
+
+func (ss *session) setTransfer(t *transfer) {
+	ss.mu.Lock()
+	ss.transfer = t
+	ss.mu.Unlock()
+}
+
+// currentTransfer returns the transfer in progress, or nil.
+func (ss *session) currentTransfer() *transfer {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.transfer
+}
+
+func (ss *session) addToken(token string) {
+	ss.mu.Lock()
+	ss.tokens = append(ss.tokens, token)
+	ss.mu.Unlock()
+}
+
+type subscriber struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+// subscribe returns a channel receiving a copy of the shell output from now
+// on, and a function to stop it.
+func (ss *session) subscribe() (<-chan []byte, func()) {
+	sub := &subscriber{
+		ch:   make(chan []byte, 16),
+		done: make(chan struct{}),
+	}
+
+	ss.mu.Lock()
+	if ss.subscribers == nil {
+		ss.subscribers = make(map[*subscriber]struct{})
+	}
+	ss.subscribers[sub] = struct{}{}
+	ss.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			close(sub.done)
+			ss.mu.Lock()
+			delete(ss.subscribers, sub)
+			ss.mu.Unlock()
+		})
+	}
+}
+
+// publish hands p to the subscribers, waiting for slow ones unless they stop.
+func (ss *session) publish(p []byte) {
+	ss.mu.Lock()
+	subs := make([]*subscriber, 0, len(ss.subscribers))
+	for sub := range ss.subscribers {
+		subs = append(subs, sub)
+	}
+	ss.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- bytes.Clone(p):
+		case <-sub.done:
+		case <-ss.done:
+		}
+	}
+}
+
+// session returns the state of shell id, or nil when there is none.
+func (s *ShellService) session(id string) *session {
+	s.RLock()
+	defer s.RUnlock()
+	return s.sessions[id]
+}
+
+// pump forwards the shell output to w until either side fails.
+func (s *ShellService) pump(ss *session, w io.Writer) {
+	defer ss.close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := ss.shell.Read(buf)
+		if n > 0 {
+			ss.touch()
+			data := buf[:n]
+			if ss.zmodem {
+				if i, direction := detectZmodem(data); i >= 0 {
+					if _, err := w.Write(data[:i]); err != nil {
+						return
+					}
+					data = s.runTransfer(ss, direction, data[i:])
+				}
+			}
+			data, events := ss.osc.filter(data)
+			s.sendOSCEvents(ss.id, events)
+			if fired := ss.triggers.match(data, time.Now()); len(fired) > 0 {
+				s.fireTriggers(ss, fired)
+			}
+			ss.echo.observeOutput(data)
+			if len(data) > 0 {
+				if ss.scrollback != nil {
+					ss.scrollback.Write(data)
+				}
+				ss.publish(data)
+				if _, err := w.Write(data); err != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
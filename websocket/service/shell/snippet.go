@@ -0,0 +1,52 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"webshell/service/snippet"
+	ws "webshell/websocket"
+)
+
+const actionSnippet = "snippet"
+
+type snippetData struct {
+	// Snippet is the id of the saved snippet.
+	Snippet string            `json:"snippet"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// handleSnippet types a saved snippet into shell id.
+func (s *ShellService) handleSnippet(id string, sh Shell, data json.RawMessage) {
+	var d snippetData
+	if err := json.Unmarshal(data, &d); err != nil {
+		s.Printf("(id: %s) error unmarshalling snippet payload: %v", id, err)
+		return
+	}
+
+	if s.Snippets == nil {
+		s.handleError(id, actionSnippet, fmt.Errorf("snippets are not available"))
+		return
+	}
+	sn, err := s.Snippets(d.Snippet)
+	if err != nil {
+		s.handleError(id, actionSnippet, err)
+		return
+	}
+	command, err := snippet.Render(sn.Content, d.Params)
+	if err != nil {
+		s.handleError(id, actionSnippet, err)
+		return
+	}
+
+	if err := s.writeCommand(id, sh, commandData(command)); err != nil {
+		s.handleError(id, actionSnippet, fmt.Errorf("error writing to shell: %w", err))
+		return
+	}
+
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionSnippet,
+	})
+}
@@ -3,7 +3,7 @@ package shell
 import (
 	"io"
 	"log"
-	"sync"
+	"time"
 	ws "webshell/websocket"
 
 	"golang.org/x/crypto/ssh"
@@ -12,11 +12,21 @@ import (
 type sshShell struct {
 	stdinWriter  io.WriteCloser
 	stdoutReader io.Reader
+	client       *ssh.Client
 
 	*ssh.Session
 	*log.Logger
 }
 
+// RTT implements latencyProber with an OpenSSH keepalive request.
+func (s *sshShell) RTT() (time.Duration, error) {
+	start := time.Now()
+	if _, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
 // Close implements Shell.
 func (s *sshShell) Close() error {
 	if err := s.stdinWriter.Close(); err != nil {
@@ -97,6 +107,7 @@ func (s *SSHShellProvider) NewShell(cwd string) (Shell, error) {
 		Session:      session,
 		stdinWriter:  stdinPipe,
 		stdoutReader: combinedOutput,
+		client:       s.Client,
 		Logger:       s.Logger,
 	}
 
@@ -111,10 +122,5 @@ func NewSSHService(client *ssh.Client) ws.Service {
 		Logger: logger,
 	}
 
-	return &ShellService{
-		ShellProvider: sp,
-		shells:        make(map[string]Shell),
-		Logger:        logger,
-		RWMutex:       &sync.RWMutex{},
-	}
+	return newShellService(sp, logger)
 }
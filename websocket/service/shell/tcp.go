@@ -2,17 +2,44 @@ package shell
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
-	"sync"
 	ws "webshell/websocket"
 )
 
+const (
+	// TCPModeRaw sends bytes as they are, apart from line ending translation.
+	TCPModeRaw = "raw"
+	// TCPModeTelnet speaks the telnet protocol (RFC 854).
+	TCPModeTelnet = "telnet"
+)
+
+const (
+	// LineEndingRaw sends the Enter key exactly as the terminal produced it.
+	LineEndingRaw = "raw"
+	// LineEndingLF turns CR and CR LF into LF.
+	LineEndingLF = "lf"
+	// LineEndingCRLF turns a lone CR or LF into CR LF.
+	LineEndingCRLF = "crlf"
+)
+
+// TCPOptions configures how a TCP shell talks to the remote end.
+type TCPOptions struct {
+	// Mode is TCPModeRaw, the default, or TCPModeTelnet.
+	Mode string
+	// LineEnding selects the translation applied to input. When empty, raw
+	// mode uses LineEndingLF and telnet mode follows the NVT rules.
+	LineEnding string
+	// TLS wraps the connection in TLS when set.
+	TLS *tls.Config
+}
+
 type tcpShell struct {
-	conn   net.Conn
-	reader *bufio.Reader
+	conn       net.Conn
+	reader     *bufio.Reader
+	lineEnding string
 	*log.Logger
 }
 
@@ -36,65 +63,109 @@ func (t *tcpShell) Resize(rows int, cols int) error {
 
 // Write implements Shell.
 func (t *tcpShell) Write(p []byte) (n int, err error) {
-	// Debug: Log what we're sending
-	// t.Printf("Sending %d bytes: %q", len(p), string(p))
-
-	// For debugging, let's try different line ending strategies
-	if bytes.Contains(p, []byte{'\r'}) {
-		// If we get CR, try sending just LF
-		processed := bytes.ReplaceAll(p, []byte{'\r'}, []byte{'\n'})
-		t.Printf("Converted CR to LF: %q", string(processed))
-		return t.conn.Write(processed)
+	if _, err := t.conn.Write(translateLineEndings(p, t.lineEnding)); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	// Send as-is for other data
-	return t.conn.Write(p)
+// translateLineEndings rewrites CR, LF and CR LF in p according to mode.
+func translateLineEndings(p []byte, mode string) []byte {
+	if mode != LineEndingLF && mode != LineEndingCRLF {
+		return p
+	}
+
+	buf := make([]byte, 0, len(p)+4)
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if b != '\r' && b != '\n' {
+			buf = append(buf, b)
+			continue
+		}
+		if b == '\r' && i+1 < len(p) && p[i+1] == '\n' {
+			i++
+		}
+		if mode == LineEndingCRLF {
+			buf = append(buf, '\r', '\n')
+		} else {
+			buf = append(buf, '\n')
+		}
+	}
+	return buf
 }
 
 type TCPShellProvider struct {
 	Host string
 	Port int
+	TCPOptions
 	*log.Logger
 }
 
 // NewShell implements ShellProvider.
 func (t *TCPShellProvider) NewShell(cwd string) (Shell, error) {
 	// cwd parameter is ignored for TCP connections
-	address := net.JoinHostPort(t.Host, fmt.Sprintf("%d", t.Port))
-
-	conn, err := net.Dial("tcp", address)
+	shell, err := t.dial()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+		return nil, err
 	}
 
-	t.Printf("Connected to TCP host: %s", address)
+	if t.Mode == TCPModeTelnet {
+		return newTelnetShell(shell), nil
+	}
 
-	shell := &tcpShell{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-		Logger: t.Logger,
+	if shell.lineEnding == "" {
+		shell.lineEnding = LineEndingLF
 	}
 
 	return shell, nil
 }
 
-func NewTCPService(host string, port int) ws.Service {
+func (t *TCPShellProvider) dial() (*tcpShell, error) {
+	address := net.JoinHostPort(t.Host, fmt.Sprintf("%d", t.Port))
+
+	var conn net.Conn
+	var err error
+	if t.TLS != nil {
+		conn, err = tls.Dial("tcp", address, t.TLS)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+
+	t.Printf("Connected to TCP host: %s (mode: %s, tls: %t)", address, t.Mode, t.TLS != nil)
+
+	return &tcpShell{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		lineEnding: t.LineEnding,
+		Logger:     t.Logger,
+	}, nil
+}
+
+func NewTCPService(host string, port int, opts TCPOptions) ws.Service {
 	logger := log.New(log.Writer(), "[tcp-shell] ", log.LstdFlags)
 
 	if port == 0 {
 		port = 23 // Default to telnet port
 	}
 
-	sp := &TCPShellProvider{
-		Host:   host,
-		Port:   port,
-		Logger: logger,
+	// telnet has to be asked for, existing clients expect raw bytes
+	if opts.Mode == "" {
+		opts.Mode = TCPModeRaw
 	}
 
-	return &ShellService{
-		ShellProvider: sp,
-		shells:        make(map[string]Shell),
-		Logger:        logger,
-		RWMutex:       &sync.RWMutex{},
+	if opts.TLS != nil && opts.TLS.InsecureSkipVerify {
+		logger.Printf("Warning: TLS certificate verification disabled for %s", host)
 	}
+
+	sp := &TCPShellProvider{
+		Host:       host,
+		Port:       port,
+		TCPOptions: opts,
+		Logger:     logger,
+	}
+
+	return newShellService(sp, logger)
 }
@@ -0,0 +1,28 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateLineEndings(t *testing.T) {
+	tests := []struct {
+		mode string
+		in   string
+		want string
+	}{
+		{LineEndingRaw, "ls\r\n\r", "ls\r\n\r"},
+		{LineEndingLF, "ls\r", "ls\n"},
+		{LineEndingLF, "a\r\nb\n", "a\nb\n"},
+		{LineEndingCRLF, "ls\r", "ls\r\n"},
+		{LineEndingCRLF, "a\nb\r\n", "a\r\nb\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			got := translateLineEndings([]byte(tt.in), tt.mode)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
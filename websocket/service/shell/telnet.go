@@ -0,0 +1,396 @@
+package shell
+
+import (
+	"sync"
+)
+
+// Telnet commands (RFC 854).
+const (
+	telnetSE   byte = 240
+	telnetNOP  byte = 241
+	telnetBRK  byte = 243
+	telnetSB   byte = 250
+	telnetWILL byte = 251
+	telnetWONT byte = 252
+	telnetDO   byte = 253
+	telnetDONT byte = 254
+	telnetIAC  byte = 255
+)
+
+// Telnet options handled by the client.
+const (
+	optEcho  byte = 1  // RFC 857
+	optSGA   byte = 3  // RFC 858
+	optTTYPE byte = 24 // RFC 1091
+	optNAWS  byte = 31 // RFC 1073
+)
+
+const (
+	ttypeIS   byte = 0
+	ttypeSEND byte = 1
+
+	telnetTerminalType = "XTERM-256COLOR"
+
+	// subnegotiations longer than this are truncated
+	maxSubnegotiation = 512
+)
+
+type telnetState int
+
+const (
+	stateData telnetState = iota
+	stateCR
+	stateIAC
+	stateCommand
+	stateSBOption
+	stateSBData
+	stateSBIAC
+)
+
+// telnetShell speaks the telnet protocol on top of a tcpShell. Option
+// negotiation is answered while reading, so the service only ever sees the
+// data stream.
+type telnetShell struct {
+	*tcpShell
+
+	writeMu sync.Mutex
+
+	// guards everything below
+	mu sync.Mutex
+	// options enabled on our side (WILL) and on the server side (DO)
+	local, remote [256]bool
+	// options we asked for and are waiting on an answer
+	pendingLocal, pendingRemote [256]bool
+	// options we agree to enable when asked
+	supportLocal, supportRemote [256]bool
+	// handlers for subnegotiations, keyed by option
+	subHandlers map[byte]func(data []byte)
+	// called once an option we support is enabled on our side
+	onLocalEnabled map[byte]func()
+
+	rows, cols int
+
+	// parser state, only touched by Read
+	state    telnetState
+	verb     byte
+	sbOption byte
+	sbData   []byte
+	rbuf     []byte
+}
+
+func newTelnetShell(base *tcpShell) *telnetShell {
+	t := &telnetShell{
+		tcpShell:       base,
+		subHandlers:    make(map[byte]func([]byte)),
+		onLocalEnabled: make(map[byte]func()),
+	}
+
+	t.supportLocal[optNAWS] = true
+	t.supportLocal[optTTYPE] = true
+	t.supportLocal[optSGA] = true
+	t.supportRemote[optEcho] = true
+	t.supportRemote[optSGA] = true
+
+	t.subHandlers[optTTYPE] = t.handleTTYPE
+	t.onLocalEnabled[optNAWS] = t.sendNAWS
+
+	return t
+}
+
+// Read implements Shell. Telnet commands are stripped from the stream.
+func (t *telnetShell) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cap(t.rbuf) < len(p) {
+		t.rbuf = make([]byte, len(p))
+	}
+	buf := t.rbuf[:len(p)]
+
+	for {
+		n, err := t.reader.Read(buf)
+		// decoded output is never longer than its input
+		out := t.decode(buf[:n], p)
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+func (t *telnetShell) decode(in, out []byte) int {
+	n := 0
+	for _, b := range in {
+		switch t.state {
+		case stateCR:
+			t.state = stateData
+			// CR NUL is a bare carriage return
+			if b == 0 {
+				continue
+			}
+			fallthrough
+		case stateData:
+			switch b {
+			case telnetIAC:
+				t.state = stateIAC
+			case '\r':
+				out[n] = b
+				n++
+				t.state = stateCR
+			default:
+				out[n] = b
+				n++
+			}
+		case stateIAC:
+			switch b {
+			case telnetIAC:
+				out[n] = b
+				n++
+				t.state = stateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.verb = b
+				t.state = stateCommand
+			case telnetSB:
+				t.state = stateSBOption
+			default:
+				// NOP, GA, DM and friends carry no data for us
+				t.state = stateData
+			}
+		case stateCommand:
+			t.negotiate(t.verb, b)
+			t.state = stateData
+		case stateSBOption:
+			t.sbOption = b
+			t.sbData = t.sbData[:0]
+			t.state = stateSBData
+		case stateSBData:
+			if b == telnetIAC {
+				t.state = stateSBIAC
+			} else if len(t.sbData) < maxSubnegotiation {
+				t.sbData = append(t.sbData, b)
+			}
+		case stateSBIAC:
+			switch b {
+			case telnetSE:
+				t.subnegotiate(t.sbOption, t.sbData)
+				t.state = stateData
+			case telnetIAC:
+				if len(t.sbData) < maxSubnegotiation {
+					t.sbData = append(t.sbData, b)
+				}
+				t.state = stateSBData
+			default:
+				t.state = stateData
+			}
+		}
+	}
+	return n
+}
+
+// negotiate answers an option command, only replying when the option state
+// actually changes so that the two sides cannot loop.
+func (t *telnetShell) negotiate(verb, opt byte) {
+	var reply []byte
+	var enabled func()
+
+	t.mu.Lock()
+	switch verb {
+	case telnetWILL:
+		switch {
+		case t.pendingRemote[opt]:
+			t.pendingRemote[opt] = false
+			t.remote[opt] = true
+		case t.remote[opt]:
+		case t.supportRemote[opt]:
+			t.remote[opt] = true
+			reply = []byte{telnetIAC, telnetDO, opt}
+		default:
+			reply = []byte{telnetIAC, telnetDONT, opt}
+		}
+	case telnetWONT:
+		if t.pendingRemote[opt] {
+			t.pendingRemote[opt] = false
+		} else if t.remote[opt] {
+			t.remote[opt] = false
+			reply = []byte{telnetIAC, telnetDONT, opt}
+		}
+	case telnetDO:
+		switch {
+		case t.pendingLocal[opt]:
+			t.pendingLocal[opt] = false
+			t.local[opt] = true
+			enabled = t.onLocalEnabled[opt]
+		case t.local[opt]:
+		case t.supportLocal[opt]:
+			t.local[opt] = true
+			reply = []byte{telnetIAC, telnetWILL, opt}
+			enabled = t.onLocalEnabled[opt]
+		default:
+			reply = []byte{telnetIAC, telnetWONT, opt}
+		}
+	case telnetDONT:
+		if t.pendingLocal[opt] {
+			t.pendingLocal[opt] = false
+		} else if t.local[opt] {
+			t.local[opt] = false
+			reply = []byte{telnetIAC, telnetWONT, opt}
+		}
+	}
+	t.mu.Unlock()
+
+	if reply != nil {
+		if err := t.writeRaw(reply); err != nil {
+			t.Printf("telnet negotiation error: %v", err)
+			return
+		}
+	}
+	if enabled != nil {
+		enabled()
+	}
+}
+
+// request asks the server to enable an option, on our side for WILL and on
+// its side for DO.
+func (t *telnetShell) request(verb, opt byte) error {
+	t.mu.Lock()
+	switch verb {
+	case telnetWILL:
+		if t.local[opt] || t.pendingLocal[opt] {
+			t.mu.Unlock()
+			return nil
+		}
+		t.pendingLocal[opt] = true
+	case telnetDO:
+		if t.remote[opt] || t.pendingRemote[opt] {
+			t.mu.Unlock()
+			return nil
+		}
+		t.pendingRemote[opt] = true
+	}
+	t.mu.Unlock()
+
+	return t.writeRaw([]byte{telnetIAC, verb, opt})
+}
+
+func (t *telnetShell) subnegotiate(opt byte, data []byte) {
+	t.mu.Lock()
+	handler := t.subHandlers[opt]
+	t.mu.Unlock()
+
+	if handler != nil {
+		handler(data)
+	}
+}
+
+func (t *telnetShell) handleTTYPE(data []byte) {
+	if len(data) == 0 || data[0] != ttypeSEND {
+		return
+	}
+	payload := append([]byte{ttypeIS}, telnetTerminalType...)
+	if err := t.writeSub(optTTYPE, payload); err != nil {
+		t.Printf("telnet TTYPE error: %v", err)
+	}
+}
+
+func (t *telnetShell) sendNAWS() {
+	t.mu.Lock()
+	rows, cols := t.rows, t.cols
+	t.mu.Unlock()
+
+	if rows <= 0 || cols <= 0 {
+		return
+	}
+
+	payload := []byte{byte(cols >> 8), byte(cols), byte(rows >> 8), byte(rows)}
+	if err := t.writeSub(optNAWS, payload); err != nil {
+		t.Printf("telnet NAWS error: %v", err)
+	}
+}
+
+// writeSub sends IAC SB opt <payload> IAC SE, escaping IAC in the payload.
+func (t *telnetShell) writeSub(opt byte, payload []byte) error {
+	msg := make([]byte, 0, len(payload)+6)
+	msg = append(msg, telnetIAC, telnetSB, opt)
+	for _, b := range payload {
+		if b == telnetIAC {
+			msg = append(msg, telnetIAC)
+		}
+		msg = append(msg, b)
+	}
+	msg = append(msg, telnetIAC, telnetSE)
+	return t.writeRaw(msg)
+}
+
+func (t *telnetShell) writeRaw(p []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	_, err := t.conn.Write(p)
+	return err
+}
+
+// Resize implements Shell. The new size is sent with NAWS once the server
+// has agreed to it.
+func (t *telnetShell) Resize(rows int, cols int) error {
+	t.mu.Lock()
+	t.rows, t.cols = rows, cols
+	enabled := t.local[optNAWS]
+	t.mu.Unlock()
+
+	if enabled {
+		t.sendNAWS()
+	}
+	return nil
+}
+
+// Write implements Shell. IAC is escaped and, unless a line ending mode was
+// chosen explicitly, line endings follow the NVT rules: CR LF for a new line
+// and CR NUL for a bare carriage return.
+func (t *telnetShell) Write(p []byte) (int, error) {
+	var buf []byte
+	if t.lineEnding != "" {
+		buf = escapeIAC(translateLineEndings(p, t.lineEnding))
+	} else {
+		buf = encodeNVT(p)
+	}
+
+	if err := t.writeRaw(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func escapeIAC(p []byte) []byte {
+	buf := make([]byte, 0, len(p)+8)
+	for _, b := range p {
+		if b == telnetIAC {
+			buf = append(buf, telnetIAC)
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+func encodeNVT(p []byte) []byte {
+	buf := make([]byte, 0, len(p)+8)
+	for i, b := range p {
+		switch b {
+		case telnetIAC:
+			buf = append(buf, telnetIAC, telnetIAC)
+		case '\r':
+			if i+1 < len(p) && p[i+1] == '\n' {
+				buf = append(buf, '\r')
+			} else {
+				buf = append(buf, '\r', 0)
+			}
+		case '\n':
+			if i > 0 && p[i-1] == '\r' {
+				buf = append(buf, '\n')
+			} else {
+				buf = append(buf, '\r', '\n')
+			}
+		default:
+			buf = append(buf, b)
+		}
+	}
+	return buf
+}
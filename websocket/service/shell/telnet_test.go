@@ -0,0 +1,137 @@
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// telnetPeer records everything the client sends on the server side of a pipe.
+type telnetPeer struct {
+	net.Conn
+	mu       sync.Mutex
+	received []byte
+}
+
+func (p *telnetPeer) drain() {
+	buf := make([]byte, 256)
+	for {
+		n, err := p.Conn.Read(buf)
+		p.mu.Lock()
+		p.received = append(p.received, buf[:n]...)
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *telnetPeer) waitFor(t *testing.T, want []byte) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return bytes.Contains(p.received, want)
+	}, time.Second, 10*time.Millisecond, "peer never received %v", want)
+}
+
+func newTestTelnetShell(t *testing.T) (*telnetShell, *telnetPeer) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	peer := &telnetPeer{Conn: server}
+	go peer.drain()
+
+	sh := newTelnetShell(&tcpShell{
+		conn:   client,
+		reader: bufio.NewReader(client),
+		Logger: log.New(os.Stderr, "[test] ", log.LstdFlags),
+	})
+	return sh, peer
+}
+
+func TestTelnetShell_Negotiation(t *testing.T) {
+	sh, peer := newTestTelnetShell(t)
+	sh.Resize(24, 80)
+
+	go peer.Write([]byte{
+		telnetIAC, telnetDO, optNAWS,
+		telnetIAC, telnetWILL, optEcho,
+		telnetIAC, telnetDO, optTTYPE,
+		telnetIAC, telnetSB, optTTYPE, ttypeSEND, telnetIAC, telnetSE,
+		telnetIAC, telnetDO, 99,
+		'o', 'k',
+	})
+
+	buf := make([]byte, 64)
+	n, err := sh.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(buf[:n]))
+
+	peer.waitFor(t, []byte{telnetIAC, telnetWILL, optNAWS})
+	peer.waitFor(t, []byte{telnetIAC, telnetSB, optNAWS, 0, 80, 0, 24, telnetIAC, telnetSE})
+	peer.waitFor(t, []byte{telnetIAC, telnetDO, optEcho})
+	peer.waitFor(t, []byte{telnetIAC, telnetWILL, optTTYPE})
+	peer.waitFor(t, append(append([]byte{telnetIAC, telnetSB, optTTYPE, ttypeIS}, telnetTerminalType...), telnetIAC, telnetSE))
+	peer.waitFor(t, []byte{telnetIAC, telnetWONT, 99})
+
+	// resizing after NAWS is enabled notifies the server straight away
+	assert.NoError(t, sh.Resize(50, 300))
+	peer.waitFor(t, []byte{telnetIAC, telnetSB, optNAWS, 1, 44, 0, 50, telnetIAC, telnetSE})
+}
+
+func TestTelnetShell_Decode(t *testing.T) {
+	sh, _ := newTestTelnetShell(t)
+
+	out := make([]byte, 64)
+	// split across reads: IAC IAC, CR NUL and a subnegotiation
+	n := sh.decode([]byte{'a', telnetIAC}, out)
+	n += sh.decode([]byte{telnetIAC, 'b', '\r'}, out[n:])
+	n += sh.decode([]byte{0, 'c', '\r', '\n', telnetIAC, telnetSB, 42, 1}, out[n:])
+	n += sh.decode([]byte{2, telnetIAC, telnetSE, 'd'}, out[n:])
+
+	assert.Equal(t, []byte{'a', telnetIAC, 'b', '\r', 'c', '\r', '\n', 'd'}, out[:n])
+}
+
+func TestTelnetShell_Write(t *testing.T) {
+	sh, peer := newTestTelnetShell(t)
+
+	n, err := sh.Write([]byte{'l', 's', '\r', 'x', '\n', telnetIAC, '\r', '\n'})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+
+	peer.waitFor(t, []byte{'l', 's', '\r', 0, 'x', '\r', '\n', telnetIAC, telnetIAC, '\r', '\n'})
+}
+
+func TestTelnetShell_ReadEOF(t *testing.T) {
+	sh, peer := newTestTelnetShell(t)
+
+	go func() {
+		peer.Write([]byte{telnetIAC, telnetNOP})
+		peer.Close()
+	}()
+
+	_, err := sh.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTelnetShell_WriteLineEnding(t *testing.T) {
+	sh, peer := newTestTelnetShell(t)
+	sh.lineEnding = LineEndingCRLF
+
+	_, err := sh.Write([]byte{'l', 's', '\r', telnetIAC})
+	assert.NoError(t, err)
+
+	peer.waitFor(t, []byte{'l', 's', '\r', '\n', telnetIAC, telnetIAC})
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package shell
+
+import "errors"
+
+// EchoEnabled implements echoReporter. Terminal modes cannot be read on this
+// platform, so echo is observed from the output instead.
+func (p *PTYShell) EchoEnabled() (bool, error) {
+	return false, errors.ErrUnsupported
+}
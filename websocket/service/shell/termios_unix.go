@@ -0,0 +1,36 @@
+//go:build linux || darwin
+
+package shell
+
+import "golang.org/x/sys/unix"
+
+// EchoEnabled implements echoReporter by reading the terminal modes of the
+// pty, which the master side shares with the program running on the slave.
+func (p *PTYShell) EchoEnabled() (bool, error) {
+	// SyscallConn keeps the file in non-blocking mode, unlike Fd
+	conn, err := p.File.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	var termios *unix.Termios
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		termios, ioctlErr = unix.IoctlGetTermios(int(fd), ioctlGetTermios)
+	})
+	if err != nil {
+		return false, err
+	}
+	if ioctlErr != nil {
+		return false, ioctlErr
+	}
+
+	if termios.Lflag&unix.ECHO != 0 {
+		return true, nil
+	}
+	if termios.Lflag&unix.ICANON == 0 {
+		// raw mode: line editors such as readline echo by themselves
+		return false, errEchoUnknown
+	}
+	return false, nil
+}
@@ -0,0 +1,114 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// server -> client: the shell is about to be closed, see timeoutData
+	actionTimeout = "timeout"
+
+	timeoutReasonIdle     = "idle"
+	timeoutReasonDuration = "duration"
+
+	timeoutCheckInterval = time.Second
+)
+
+type timeoutData struct {
+	Reason string `json:"reason"`
+	// Remaining is the time left in seconds.
+	Remaining int `json:"remaining"`
+}
+
+// timeoutPolicy limits the life of a shell. Zero values disable a limit.
+type timeoutPolicy struct {
+	idle        time.Duration
+	maxDuration time.Duration
+}
+
+// newTimeoutPolicy applies the minutes asked for on start, which may only
+// tighten the server limits.
+func newTimeoutPolicy(idleMinutes, maxMinutes int) timeoutPolicy {
+	return timeoutPolicy{
+		idle:        tighter(shellIdleTimeout, time.Duration(idleMinutes)*time.Minute),
+		maxDuration: tighter(shellMaxDuration, time.Duration(maxMinutes)*time.Minute),
+	}
+}
+
+func tighter(limit, asked time.Duration) time.Duration {
+	if asked > 0 && (limit <= 0 || asked < limit) {
+		return asked
+	}
+	return limit
+}
+
+// watchTimeouts closes the shell of ss once it has been idle or alive for
+// too long, warning the client beforehand.
+func (s *ShellService) watchTimeouts(ss *session, policy timeoutPolicy) {
+	if policy.idle <= 0 && policy.maxDuration <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(timeoutCheckInterval)
+	defer ticker.Stop()
+
+	var warned time.Time // the deadline already warned about
+	for {
+		select {
+		case <-ss.done:
+			return
+		case now := <-ticker.C:
+			reason, deadline := policy.deadline(ss, now)
+			if deadline.IsZero() {
+				continue
+			}
+
+			remaining := deadline.Sub(now)
+			if remaining <= 0 {
+				limit := policy.idle
+				if reason == timeoutReasonDuration {
+					limit = policy.maxDuration
+				}
+				s.Printf("(id: %s) closing shell, %s limit of %v reached", ss.id, reason, limit)
+				s.closeShell(ss.id)
+				s.handleError(ss.id, actionTerminate, fmt.Errorf("shell closed: %s limit of %v reached", reason, limit))
+				return
+			}
+			if remaining <= shellTimeoutWarning && !warned.Equal(deadline) {
+				warned = deadline
+				s.sendTimeout(ss.id, &timeoutData{Reason: reason, Remaining: int(remaining.Round(time.Second).Seconds())})
+			}
+		}
+	}
+}
+
+// deadline returns the earliest limit of ss.
+func (p timeoutPolicy) deadline(ss *session, now time.Time) (reason string, deadline time.Time) {
+	if p.idle > 0 {
+		reason, deadline = timeoutReasonIdle, ss.lastActive().Add(p.idle)
+	}
+	if p.maxDuration > 0 {
+		if d := ss.started.Add(p.maxDuration); deadline.IsZero() || d.Before(deadline) {
+			reason, deadline = timeoutReasonDuration, d
+		}
+	}
+	return reason, deadline
+}
+
+func (s *ShellService) sendTimeout(id string, d *timeoutData) {
+	r, err := json.Marshal(d)
+	if err != nil {
+		s.Printf("(id: %s) error marshalling timeout data: %v", id, err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionTimeout,
+		Data:    r,
+	})
+}
@@ -0,0 +1,63 @@
+package shell
+
+import (
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTighter(t *testing.T) {
+	assert.Equal(t, 10*time.Minute, tighter(0, 10*time.Minute))
+	assert.Equal(t, 5*time.Minute, tighter(5*time.Minute, 10*time.Minute))
+	assert.Equal(t, 5*time.Minute, tighter(10*time.Minute, 5*time.Minute))
+	assert.Equal(t, 10*time.Minute, tighter(10*time.Minute, 0))
+}
+
+func TestTimeoutPolicy_Deadline(t *testing.T) {
+	ss := newSession("test-1", &mockShell{})
+	now := time.Now()
+	ss.started = now.Add(-50 * time.Minute)
+	ss.active.Store(now.Add(-5 * time.Minute).UnixNano())
+
+	p := timeoutPolicy{idle: 30 * time.Minute, maxDuration: time.Hour}
+	reason, deadline := p.deadline(ss, now)
+	assert.Equal(t, timeoutReasonDuration, reason)
+	assert.WithinDuration(t, now.Add(10*time.Minute), deadline, time.Second)
+
+	// activity pushes the idle deadline back, but not the duration one
+	p.maxDuration = 0
+	reason, deadline = p.deadline(ss, now)
+	assert.Equal(t, timeoutReasonIdle, reason)
+	assert.WithinDuration(t, now.Add(25*time.Minute), deadline, time.Second)
+
+	_, deadline = timeoutPolicy{}.deadline(ss, now)
+	assert.True(t, deadline.IsZero())
+}
+
+func TestShellService_CleanupWhileClosing(t *testing.T) {
+	service := newShellService(nil, log.New(io.Discard, "", 0))
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		service.shells[id] = &mockShell{}
+		service.sessions[id] = newSession(id, service.shells[id])
+	}
+
+	// timeouts close shells while the connection goes away
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			service.closeShell(id)
+		}(strconv.Itoa(i))
+	}
+	service.Cleanup(nil)
+	wg.Wait()
+	assert.Nil(t, service.shells)
+	assert.Nil(t, service.sessions)
+}
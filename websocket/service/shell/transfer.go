@@ -0,0 +1,354 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"webshell/service/downloader"
+	ws "webshell/websocket"
+)
+
+const (
+	// server -> client: progress of a transfer, see zmodemData
+	actionZmodem = "zmodem"
+	// client -> server, while `rz` waits: stage a file, add data to it, then
+	// start sending the staged files
+	actionZmodemFile  = "zmodem_file"
+	actionZmodemChunk = "zmodem_chunk"
+	actionZmodemSend  = "zmodem_send"
+	// client -> server: abort the transfer in either direction
+	actionZmodemCancel = "zmodem_cancel"
+
+	// `sz` on the remote side, files go to the browser
+	zmodemDownload = "download"
+	// `rz` on the remote side, files come from the browser
+	zmodemUpload = "upload"
+
+	zmodemStateStart = "start"
+	zmodemStateFile  = "file"
+	zmodemStateEnd   = "end"
+)
+
+type zmodemData struct {
+	State     string `json:"state"`
+	Direction string `json:"direction"`
+	// Token names the received files for /shell/zmodem/:token/download.
+	Token string       `json:"token,omitempty"`
+	Files []zmodemFile `json:"files,omitempty"`
+}
+
+// staging directories of finished downloads by token
+var staged = struct {
+	sync.RWMutex
+	dirs map[string]string
+}{dirs: make(map[string]string)}
+
+// ZmodemDownloader returns a downloader for the files received by the
+// transfer token.
+func ZmodemDownloader(token string) (downloader.Downloader, bool) {
+	staged.RLock()
+	dir, ok := staged.dirs[token]
+	staged.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return downloader.NewLocalDownloader(dir), true
+}
+
+// transfer is a ZMODEM transfer running on a session.
+type transfer struct {
+	direction string
+	token     string
+	dir       string
+
+	// files staged by the client for an upload
+	mu    sync.Mutex
+	file  *os.File
+	paths []string
+
+	start      chan struct{}
+	startOnce  sync.Once
+	canceled   chan struct{}
+	cancelOnce sync.Once
+}
+
+func newTransfer(direction string) (*transfer, error) {
+	dir, err := os.MkdirTemp("", "webshell-zmodem-")
+	if err != nil {
+		return nil, err
+	}
+	return &transfer{
+		direction: direction,
+		token:     uuid.NewString(),
+		dir:       dir,
+		start:     make(chan struct{}),
+		canceled:  make(chan struct{}),
+	}, nil
+}
+
+func (t *transfer) cancel() {
+	t.cancelOnce.Do(func() { close(t.canceled) })
+}
+
+// stage creates a file for the data the client is about to upload.
+func (t *transfer) stage(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file != nil {
+		t.file.Close()
+	}
+	f, err := createUnique(t.dir, parseZmodemFileInfo([]byte(name)).Name)
+	if err != nil {
+		return err
+	}
+	t.file = f
+	t.paths = append(t.paths, f.Name())
+	return nil
+}
+
+func (t *transfer) write(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return fmt.Errorf("no file staged")
+	}
+	_, err := t.file.Write(p)
+	return err
+}
+
+// send closes the staged file and lets the transfer start.
+func (t *transfer) send() {
+	t.mu.Lock()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	t.mu.Unlock()
+
+	t.startOnce.Do(func() { close(t.start) })
+}
+
+// release removes the staging directory unless it holds files for the
+// client to download.
+func (t *transfer) release(keep bool) {
+	t.mu.Lock()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	t.mu.Unlock()
+
+	if keep {
+		staged.Lock()
+		staged.dirs[t.token] = t.dir
+		staged.Unlock()
+		return
+	}
+	os.RemoveAll(t.dir)
+}
+
+// removeStaged deletes the downloads kept for tokens.
+func removeStaged(tokens []string) {
+	staged.Lock()
+	defer staged.Unlock()
+
+	for _, token := range tokens {
+		if dir, ok := staged.dirs[token]; ok {
+			os.RemoveAll(dir)
+			delete(staged.dirs, token)
+		}
+	}
+}
+
+// supportsZmodem reports whether the output of sh is passed through
+// unchanged, which ZMODEM needs. Telnet and transcoded shells rewrite the
+// stream.
+func supportsZmodem(sh Shell) bool {
+	switch sh.(type) {
+	case *PTYShell, *sshShell:
+		return true
+	}
+	return false
+}
+
+// detectZmodem looks for the header `sz` or `rz` sends when started.
+func detectZmodem(p []byte) (int, string) {
+	if i := bytes.Index(p, zmodemSendSignature); i >= 0 {
+		return i, zmodemDownload
+	}
+	if i := bytes.Index(p, zmodemReceiveSignature); i >= 0 {
+		return i, zmodemUpload
+	}
+	return -1, ""
+}
+
+// cancelReader makes a transfer fail at its next read once canceled. What
+// that read returned is kept for the terminal.
+type cancelReader struct {
+	r        io.Reader
+	canceled <-chan struct{}
+	stash    []byte
+	// called on every read, a transfer keeps the shell active
+	onRead func()
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.canceled:
+		return 0, errZmodemCanceled
+	default:
+	}
+
+	n, err := c.r.Read(p)
+	if c.onRead != nil {
+		c.onRead()
+	}
+
+	select {
+	case <-c.canceled:
+		c.stash = append(c.stash, p[:n]...)
+		return 0, errZmodemCanceled
+	default:
+	}
+	return n, err
+}
+
+// runTransfer takes over the shell stream from pump until the transfer that
+// starts at initial is over, and returns the output read past its end.
+func (s *ShellService) runTransfer(ss *session, direction string, initial []byte) []byte {
+	t, err := newTransfer(direction)
+	if err != nil {
+		s.handleError(ss.id, actionZmodem, fmt.Errorf("error starting zmodem transfer: %w", err))
+		// let the other side time out
+		return nil
+	}
+
+	ss.setTransfer(t)
+	defer ss.setTransfer(nil)
+
+	r := &cancelReader{
+		r:        io.MultiReader(bytes.NewReader(bytes.Clone(initial)), ss.shell),
+		canceled: t.canceled,
+		onRead:   ss.touch,
+	}
+	z := newZmodemConn(r, ss.shell)
+
+	s.sendZmodem(ss.id, &zmodemData{State: zmodemStateStart, Direction: direction})
+	onFile := func(f zmodemFile) {
+		s.sendZmodem(ss.id, &zmodemData{State: zmodemStateFile, Direction: direction, Files: []zmodemFile{f}})
+	}
+
+	var files []zmodemFile
+	switch direction {
+	case zmodemDownload:
+		files, err = z.receive(t.dir, onFile)
+	case zmodemUpload:
+		err = s.upload(ss, t, z, onFile)
+	}
+
+	keep := direction == zmodemDownload && err == nil && len(files) > 0
+	t.release(keep)
+
+	if err != nil {
+		z.abort()
+		s.handleError(ss.id, actionZmodem, fmt.Errorf("zmodem transfer failed: %w", err))
+	} else {
+		d := &zmodemData{State: zmodemStateEnd, Direction: direction, Files: files}
+		if keep {
+			d.Token = t.token
+			ss.addToken(t.token)
+		}
+		s.sendZmodem(ss.id, d)
+	}
+
+	return append(bytes.Clone(z.rest()), r.stash...)
+}
+
+// upload waits for the client to stage its files, then sends them to `rz`.
+func (s *ShellService) upload(ss *session, t *transfer, z *zmodemConn, onFile func(zmodemFile)) error {
+	rinit, err := z.readHeader()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-t.start:
+	case <-t.canceled:
+		return errZmodemCanceled
+	case <-ss.done:
+		return errZmodemCanceled
+	}
+
+	t.mu.Lock()
+	paths := t.paths
+	t.mu.Unlock()
+
+	return z.send(rinit, paths, onFile)
+}
+
+// handleZmodem handles the client side of a transfer.
+func (s *ShellService) handleZmodem(ss *session, action string, data json.RawMessage) {
+	// the binary message of a chunk must be taken in any case
+	var chunk []byte
+	if action == actionZmodemChunk {
+		ch := make(chan []byte, 1)
+		s.conn.BinaryChan <- ch
+		chunk = <-ch
+	}
+
+	t := ss.currentTransfer()
+	if t == nil {
+		s.handleError(ss.id, action, fmt.Errorf("no zmodem transfer in progress"))
+		return
+	}
+
+	switch action {
+	case actionZmodemFile:
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			s.Printf("(id: %s) error unmarshalling zmodem file payload: %v", ss.id, err)
+			return
+		}
+		if t.direction != zmodemUpload {
+			s.handleError(ss.id, action, fmt.Errorf("remote side is not receiving files"))
+			return
+		}
+		if err := t.stage(name); err != nil {
+			s.handleError(ss.id, action, err)
+			return
+		}
+	case actionZmodemChunk:
+		if err := t.write(chunk); err != nil {
+			s.handleError(ss.id, action, err)
+			return
+		}
+	case actionZmodemSend:
+		t.send()
+	case actionZmodemCancel:
+		t.cancel()
+		// make the remote side give up too, which also wakes up the reader
+		ss.shell.Write(zmodemAbortSequence)
+	}
+}
+
+func (s *ShellService) sendZmodem(id string, d *zmodemData) {
+	r, err := json.Marshal(d)
+	if err != nil {
+		s.Printf("(id: %s) error marshalling zmodem data: %v", id, err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      id,
+		Action:  actionZmodem,
+		Data:    r,
+	})
+}
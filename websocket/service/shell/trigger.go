@@ -0,0 +1,332 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	ws "webshell/websocket"
+)
+
+const (
+	// client -> server: data is a Trigger, the reply carries it with its id
+	actionTriggerAdd = "trigger_add"
+	// client -> server: data is the id of the trigger to remove
+	actionTriggerRemove = "trigger_remove"
+	// client -> server: the reply lists the triggers of the shell
+	actionTriggerList = "trigger_list"
+	// server -> client: a trigger matched, see triggerData
+	actionTrigger = "trigger"
+
+	// a trigger fires at most once in this interval
+	triggerCooldown = time.Second
+	// output of the current line kept for matches spanning reads
+	maxTriggerCarry = 4 * 1024
+	webhookTimeout  = 5 * time.Second
+)
+
+// Trigger watches the output of a shell for Pattern.
+type Trigger struct {
+	Id      string `json:"id,omitempty"`
+	Pattern string `json:"pattern"`
+	// MinElapsed, in milliseconds, only lets the trigger fire that long
+	// after the last input, and once per input. With a prompt as Pattern it
+	// reports the end of long commands.
+	MinElapsed int `json:"minElapsed,omitempty"`
+	// Webhook receives a POST of triggerData on each match. Only local
+	// addresses are allowed.
+	Webhook string `json:"webhook,omitempty"`
+	// Log writes matches to the server log.
+	Log bool `json:"log,omitempty"`
+}
+
+type triggerData struct {
+	Trigger string    `json:"trigger"`
+	Shell   string    `json:"shell,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+type activeTrigger struct {
+	Trigger
+	re        *regexp.Regexp
+	lastFired time.Time
+	// input time the trigger last fired for, see MinElapsed
+	firedFor int64
+}
+
+// triggerSet matches the triggers of a session against its output, without
+// escape sequences. Matches do not span lines.
+type triggerSet struct {
+	mu       sync.Mutex
+	triggers []*activeTrigger
+	parser   ansiParser
+	// text of the current line already matched against
+	carry []byte
+	// unix nanoseconds of the last input
+	lastInput int64
+}
+
+func (ts *triggerSet) add(t Trigger) (Trigger, error) {
+	if t.Pattern == "" {
+		return t, fmt.Errorf("trigger has no pattern")
+	}
+	re, err := regexp.Compile(t.Pattern)
+	if err != nil {
+		return t, err
+	}
+	if t.Webhook != "" {
+		if err := checkWebhook(t.Webhook); err != nil {
+			return t, err
+		}
+	}
+	if t.Id == "" {
+		t.Id = uuid.NewString()
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, at := range ts.triggers {
+		if at.Id == t.Id {
+			return t, fmt.Errorf("trigger %s already exists", t.Id)
+		}
+	}
+	ts.triggers = append(ts.triggers, &activeTrigger{Trigger: t, re: re})
+	return t, nil
+}
+
+func (ts *triggerSet) remove(id string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	n := len(ts.triggers)
+	ts.triggers = slices.DeleteFunc(ts.triggers, func(at *activeTrigger) bool { return at.Id == id })
+	return len(ts.triggers) < n
+}
+
+func (ts *triggerSet) list() []Trigger {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	list := make([]Trigger, len(ts.triggers))
+	for i, at := range ts.triggers {
+		list[i] = at.Trigger
+	}
+	return list
+}
+
+func (ts *triggerSet) input(now time.Time) {
+	ts.mu.Lock()
+	ts.lastInput = now.UnixNano()
+	ts.mu.Unlock()
+}
+
+// match returns the triggers fired by output p.
+func (ts *triggerSet) match(p []byte, now time.Time) []triggerData {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.triggers) == 0 {
+		return nil
+	}
+
+	var text []byte
+	ts.parser.feed(p, func(b byte) {
+		if b == '\n' || b == '\t' || b >= 0x20 && b != 0x7f {
+			text = append(text, b)
+		}
+	}, nil)
+	if len(text) == 0 {
+		return nil
+	}
+
+	var fired []triggerData
+	carried := len(ts.carry)
+	buf := append(ts.carry, text...)
+	for len(buf) > 0 {
+		line := buf
+		end := bytes.IndexByte(buf, '\n')
+		if end >= 0 {
+			line = buf[:end]
+		}
+		for _, at := range ts.triggers {
+			for _, loc := range at.re.FindAllIndex(line, -1) {
+				// matches within the carry were seen with the last read
+				if loc[1] <= carried || loc[1] == loc[0] {
+					continue
+				}
+				if ts.fire(at, now) {
+					fired = append(fired, triggerData{Trigger: at.Id, Text: string(line[loc[0]:loc[1]]), Time: now})
+				}
+			}
+		}
+		if end < 0 {
+			break
+		}
+		buf = buf[end+1:]
+		carried = max(carried-end-1, 0)
+	}
+
+	if end := bytes.LastIndexByte(buf, '\n'); end >= 0 {
+		buf = buf[end+1:]
+	}
+	if len(buf) > maxTriggerCarry {
+		buf = buf[len(buf)-maxTriggerCarry:]
+	}
+	ts.carry = bytes.Clone(buf)
+	return fired
+}
+
+func (ts *triggerSet) fire(at *activeTrigger, now time.Time) bool {
+	if now.Sub(at.lastFired) < triggerCooldown {
+		return false
+	}
+	if at.MinElapsed > 0 {
+		if ts.lastInput == 0 || at.firedFor == ts.lastInput {
+			return false
+		}
+		if now.Sub(time.Unix(0, ts.lastInput)) < time.Duration(at.MinElapsed)*time.Millisecond {
+			return false
+		}
+		at.firedFor = ts.lastInput
+	}
+	at.lastFired = now
+	return true
+}
+
+func (ts *triggerSet) trigger(id string) (Trigger, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, at := range ts.triggers {
+		if at.Id == id {
+			return at.Trigger, true
+		}
+	}
+	return Trigger{}, false
+}
+
+// checkWebhook only lets triggers call services on the server itself.
+func checkWebhook(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook must be an http or https url")
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("webhook must point to localhost")
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	// a redirect could leave localhost
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// fireTriggers reports the matches of shell id to the client, the log and
+// the webhooks.
+func (s *ShellService) fireTriggers(ss *session, fired []triggerData) {
+	for _, d := range fired {
+		t, ok := ss.triggers.trigger(d.Trigger)
+		if !ok {
+			continue
+		}
+		if t.Log {
+			s.Printf("(id: %s) trigger %s matched: %q", ss.id, t.Id, d.Text)
+		}
+		if t.Webhook != "" {
+			go s.callWebhook(t.Webhook, triggerData{Trigger: d.Trigger, Shell: ss.id, Text: d.Text, Time: d.Time})
+		}
+
+		r, err := json.Marshal(d)
+		if err != nil {
+			s.Printf("(id: %s) error marshalling trigger data: %v", ss.id, err)
+			continue
+		}
+		s.conn.WriteJSON(&ws.ServiceMessage{
+			Service: s.Name(),
+			Id:      ss.id,
+			Action:  actionTrigger,
+			Data:    r,
+		})
+	}
+}
+
+func (s *ShellService) callWebhook(webhook string, d triggerData) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	resp, err := webhookClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.Printf("(id: %s) error calling trigger webhook: %v", d.Shell, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		s.Printf("(id: %s) trigger webhook returned %s", d.Shell, resp.Status)
+	}
+}
+
+// handleTrigger manages the triggers of a shell. They last as long as it.
+func (s *ShellService) handleTrigger(ss *session, action string, data json.RawMessage) {
+	var reply any
+	switch action {
+	case actionTriggerAdd:
+		var t Trigger
+		if err := json.Unmarshal(data, &t); err != nil {
+			s.Printf("(id: %s) error unmarshalling trigger payload: %v", ss.id, err)
+			return
+		}
+		t, err := ss.triggers.add(t)
+		if err != nil {
+			s.handleError(ss.id, action, fmt.Errorf("error adding trigger: %w", err))
+			return
+		}
+		reply = t
+	case actionTriggerRemove:
+		var id string
+		if err := json.Unmarshal(data, &id); err != nil {
+			s.Printf("(id: %s) error unmarshalling trigger payload: %v", ss.id, err)
+			return
+		}
+		if !ss.triggers.remove(id) {
+			s.handleError(ss.id, action, fmt.Errorf("trigger %s not found", id))
+			return
+		}
+		reply = id
+	case actionTriggerList:
+		reply = ss.triggers.list()
+	}
+
+	r, err := json.Marshal(reply)
+	if err != nil {
+		s.Printf("(id: %s) error marshalling trigger reply: %v", ss.id, err)
+		return
+	}
+	s.conn.WriteJSON(&ws.ServiceMessage{
+		Service: s.Name(),
+		Id:      ss.id,
+		Action:  action,
+		Data:    r,
+	})
+}
@@ -0,0 +1,80 @@
+package shell
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTriggerMatch(t *testing.T) {
+	ts := &triggerSet{}
+	_, err := ts.add(Trigger{Id: "err", Pattern: `ERROR|panic:`})
+	require.NoError(t, err)
+
+	now := time.Now()
+	fired := ts.match([]byte("ok\r\n\x1b[31mERR"), now)
+	assert.Empty(t, fired)
+
+	// the match spans reads and escape sequences
+	fired = ts.match([]byte("OR\x1b[0m: disk full\r\n"), now)
+	require.Len(t, fired, 1)
+	assert.Equal(t, "err", fired[0].Trigger)
+	assert.Equal(t, "ERROR", fired[0].Text)
+
+	// within the cooldown
+	assert.Empty(t, ts.match([]byte("panic: again\n"), now.Add(100*time.Millisecond)))
+
+	fired = ts.match([]byte("panic: again\n"), now.Add(2*time.Second))
+	require.Len(t, fired, 1)
+	assert.Equal(t, "panic:", fired[0].Text)
+
+	// a partial line already matched is not reported again
+	later := now.Add(4 * time.Second)
+	require.Len(t, ts.match([]byte("ERROR "), later), 1)
+	assert.Empty(t, ts.match([]byte("more"), later.Add(2*time.Second)))
+
+	assert.True(t, ts.remove("err"))
+	assert.False(t, ts.remove("err"))
+	assert.Empty(t, ts.match([]byte("\nERROR\n"), later.Add(4*time.Second)))
+}
+
+func TestTriggerMinElapsed(t *testing.T) {
+	ts := &triggerSet{}
+	_, err := ts.add(Trigger{Id: "done", Pattern: `\$ $`, MinElapsed: 5000})
+	require.NoError(t, err)
+
+	start := time.Now()
+	ts.input(start)
+	// a quick command
+	assert.Empty(t, ts.match([]byte("\r\nuser@host:~$ "), start.Add(time.Second)))
+
+	ts.input(start.Add(2 * time.Second))
+	fired := ts.match([]byte("\r\nuser@host:~$ "), start.Add(10*time.Second))
+	require.Len(t, fired, 1)
+	assert.Equal(t, "$ ", fired[0].Text)
+
+	// once per input
+	assert.Empty(t, ts.match([]byte("\r\nuser@host:~$ "), start.Add(20*time.Second)))
+}
+
+func TestTriggerAdd(t *testing.T) {
+	ts := &triggerSet{}
+
+	tr, err := ts.add(Trigger{Pattern: "x", Webhook: "http://127.0.0.1:9000/hook"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, tr.Id)
+	assert.Equal(t, []Trigger{tr}, ts.list())
+
+	_, err = ts.add(Trigger{Id: tr.Id, Pattern: "y"})
+	assert.Error(t, err)
+	_, err = ts.add(Trigger{Pattern: "("})
+	assert.Error(t, err)
+	_, err = ts.add(Trigger{})
+	assert.Error(t, err)
+	_, err = ts.add(Trigger{Pattern: "x", Webhook: "http://example.com/hook"})
+	assert.Error(t, err)
+	_, err = ts.add(Trigger{Pattern: "x", Webhook: "http://localhost/hook"})
+	assert.NoError(t, err)
+}
@@ -10,3 +10,19 @@ type Shell interface {
 	io.ReadWriteCloser
 	Resize(rows, cols int) error
 }
+
+// shellAs looks through shell wrappers for one implementing T.
+func shellAs[T any](sh Shell) (T, bool) {
+	for sh != nil {
+		if t, ok := sh.(T); ok {
+			return t, true
+		}
+		w, ok := sh.(interface{ Unwrap() Shell })
+		if !ok {
+			break
+		}
+		sh = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,779 @@
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ZMODEM framing characters.
+const (
+	zPAD   byte = '*'
+	zDLE   byte = 0x18
+	zBIN   byte = 'A'
+	zHEX   byte = 'B'
+	zBIN32 byte = 'C'
+
+	zCRCE byte = 'h' // end of frame, header follows
+	zCRCG byte = 'i' // frame continues nonstop
+	zCRCQ byte = 'j' // frame continues, ZACK expected
+	zCRCW byte = 'k' // end of frame, ZACK expected
+	zRUB0 byte = 'l' // translates to 0x7f
+	zRUB1 byte = 'm' // translates to 0xff
+
+	xON  byte = 0x11
+	xOFF byte = 0x13
+)
+
+// ZMODEM frame types.
+const (
+	zRQINIT byte = iota
+	zRINIT
+	zSINIT
+	zACK
+	zFILE
+	zSKIP
+	zNAK
+	zABORT
+	zFIN
+	zRPOS
+	zDATA
+	zEOF
+	zFERR
+	zCRC
+	zCHALLENGE
+	zCOMPL
+	zCAN
+)
+
+// ZRINIT capability flags, sent in ZF0.
+const (
+	zCANFDX  byte = 0x01
+	zCANOVIO byte = 0x02
+	zCANFC32 byte = 0x20
+)
+
+const (
+	// ZFILE conversion option for binary transfers, sent in ZF0.
+	zCBIN byte = 1
+
+	zmodemBlockSize = 1024
+	// the largest subpacket accepted from the other side
+	zmodemMaxSubpacket = 8 * 1024
+	// garbage skipped while looking for a header before giving up
+	zmodemMaxGarbage = 64 * 1024
+)
+
+var (
+	// ZRQINIT, sent by `sz` before it offers files.
+	zmodemSendSignature = []byte("**\x18B00")
+	// ZRINIT, sent by `rz` while it waits for files.
+	zmodemReceiveSignature = []byte("**\x18B01")
+
+	// 8 CAN followed by 8 backspaces aborts a transfer on the other side.
+	zmodemAbortSequence = append(bytes.Repeat([]byte{zDLE}, 8), bytes.Repeat([]byte{'\b'}, 8)...)
+
+	errZmodemCanceled = errors.New("zmodem transfer canceled")
+	errZmodemBadCRC   = errors.New("zmodem crc mismatch")
+)
+
+// zmodemHeader is a decoded ZMODEM header. data holds ZP0..ZP3, which is
+// either a little-endian file position or the flags ZF3..ZF0.
+type zmodemHeader struct {
+	typ  byte
+	data [4]byte
+}
+
+func (h zmodemHeader) pos() int64 {
+	return int64(binary.LittleEndian.Uint32(h.data[:]))
+}
+
+func posHeader(typ byte, pos int64) zmodemHeader {
+	h := zmodemHeader{typ: typ}
+	binary.LittleEndian.PutUint32(h.data[:], uint32(pos))
+	return h
+}
+
+func flagsHeader(typ, zf0 byte) zmodemHeader {
+	return zmodemHeader{typ: typ, data: [4]byte{0, 0, 0, zf0}}
+}
+
+// zmodemFile is a file offered or received during a transfer.
+type zmodemFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// crc16 is the CRC-16/XMODEM used by ZMODEM.
+func crc16(crc uint16, p []byte) uint16 {
+	for _, b := range p {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// zmodemConn speaks ZMODEM over the raw byte stream of a shell.
+type zmodemConn struct {
+	r *bufio.Reader
+	w io.Writer
+
+	// use 32 bit CRCs for data sent, as agreed in ZRINIT
+	crc32 bool
+	// the last data subpacket read used a 32 bit CRC
+	rxCRC32 bool
+}
+
+func newZmodemConn(r io.Reader, w io.Writer) *zmodemConn {
+	return &zmodemConn{r: bufio.NewReaderSize(r, 32*1024), w: w}
+}
+
+func zdleNeedsEscape(b, prev byte) bool {
+	switch b {
+	case zDLE, 0x10, 0x90, xON, 0x91, xOFF, 0x93:
+		return true
+	case '\r', 0x8d:
+		// CR after @ would be taken for a telnet escape by some networks
+		return prev&0x7f == '@'
+	}
+	return false
+}
+
+func zdleEscape(dst, p []byte) []byte {
+	var prev byte
+	for _, b := range p {
+		if zdleNeedsEscape(b, prev) {
+			dst = append(dst, zDLE, b^0x40)
+		} else {
+			dst = append(dst, b)
+		}
+		prev = b
+	}
+	return dst
+}
+
+func (z *zmodemConn) writeHexHeader(h zmodemHeader) error {
+	raw := append([]byte{h.typ}, h.data[:]...)
+	raw = binary.BigEndian.AppendUint16(raw, crc16(0, raw))
+
+	frame := []byte{zPAD, zPAD, zDLE, zHEX}
+	frame = append(frame, hex.EncodeToString(raw)...)
+	frame = append(frame, '\r', 0x8a)
+	if h.typ != zACK && h.typ != zFIN {
+		frame = append(frame, xON)
+	}
+	_, err := z.w.Write(frame)
+	return err
+}
+
+func (z *zmodemConn) writeBinaryHeader(h zmodemHeader) error {
+	raw := append([]byte{h.typ}, h.data[:]...)
+
+	frame := []byte{zPAD, zDLE, zBIN}
+	if z.crc32 {
+		frame[2] = zBIN32
+		raw = binary.LittleEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+	} else {
+		raw = binary.BigEndian.AppendUint16(raw, crc16(0, raw))
+	}
+	_, err := z.w.Write(zdleEscape(frame, raw))
+	return err
+}
+
+func (z *zmodemConn) writeSubpacket(p []byte, end byte) error {
+	frame := zdleEscape(make([]byte, 0, len(p)+len(p)/8+16), p)
+	frame = append(frame, zDLE, end)
+
+	var crc []byte
+	if z.crc32 {
+		sum := crc32.Update(crc32.ChecksumIEEE(p), crc32.IEEETable, []byte{end})
+		crc = binary.LittleEndian.AppendUint32(nil, sum)
+	} else {
+		crc = binary.BigEndian.AppendUint16(nil, crc16(crc16(0, p), []byte{end}))
+	}
+	frame = zdleEscape(frame, crc)
+	_, err := z.w.Write(frame)
+	return err
+}
+
+func (z *zmodemConn) abort() error {
+	_, err := z.w.Write(zmodemAbortSequence)
+	return err
+}
+
+// readZDLE reads one byte of ZDLE encoded data. end is set when the byte is
+// a subpacket terminator rather than data.
+func (z *zmodemConn) readZDLE() (b byte, end bool, err error) {
+	for {
+		b, err = z.r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		switch b {
+		case xON, xOFF, xON | 0x80, xOFF | 0x80:
+			// flow control is not part of the data
+			continue
+		case zDLE:
+		default:
+			return b, false, nil
+		}
+
+		cans := 1
+		for {
+			b, err = z.r.ReadByte()
+			if err != nil {
+				return 0, false, err
+			}
+			if b != zDLE {
+				break
+			}
+			if cans++; cans >= 5 {
+				return 0, false, errZmodemCanceled
+			}
+		}
+		switch {
+		case b == zCRCE || b == zCRCG || b == zCRCQ || b == zCRCW:
+			return b, true, nil
+		case b == zRUB0:
+			return 0x7f, false, nil
+		case b == zRUB1:
+			return 0xff, false, nil
+		case b&0x60 == 0x40:
+			return b ^ 0x40, false, nil
+		}
+		// anything else is line noise, keep reading
+	}
+}
+
+// readHeader skips to the next header and decodes it.
+func (z *zmodemConn) readHeader() (zmodemHeader, error) {
+	var h zmodemHeader
+
+	garbage, cans := 0, 0
+	for {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return h, err
+		}
+		if b == zDLE {
+			if cans++; cans >= 5 {
+				return h, errZmodemCanceled
+			}
+		} else {
+			cans = 0
+		}
+		if b != zPAD {
+			if garbage++; garbage > zmodemMaxGarbage {
+				return h, fmt.Errorf("zmodem: no header found")
+			}
+			continue
+		}
+
+		// one or more ZPAD, then ZDLE and the format
+		for b == zPAD {
+			if b, err = z.r.ReadByte(); err != nil {
+				return h, err
+			}
+		}
+		if b != zDLE {
+			continue
+		}
+		format, err := z.r.ReadByte()
+		if err != nil {
+			return h, err
+		}
+
+		switch format {
+		case zHEX:
+			h, err = z.readHexHeader()
+		case zBIN:
+			h, err = z.readBinaryHeader(false)
+		case zBIN32:
+			h, err = z.readBinaryHeader(true)
+		default:
+			continue
+		}
+		if errors.Is(err, errZmodemBadCRC) {
+			continue
+		}
+		return h, err
+	}
+}
+
+func (z *zmodemConn) readHexHeader() (zmodemHeader, error) {
+	var h zmodemHeader
+
+	digits := make([]byte, 14)
+	if _, err := io.ReadFull(z.r, digits); err != nil {
+		return h, err
+	}
+	raw := make([]byte, 7)
+	if _, err := hex.Decode(raw, bytes.ToLower(digits)); err != nil {
+		return h, errZmodemBadCRC
+	}
+	if crc16(0, raw[:5]) != binary.BigEndian.Uint16(raw[5:]) {
+		return h, errZmodemBadCRC
+	}
+
+	h.typ = raw[0]
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+func (z *zmodemConn) readBinaryHeader(use32 bool) (zmodemHeader, error) {
+	var h zmodemHeader
+
+	n := 7
+	if use32 {
+		n = 9
+	}
+	raw := make([]byte, n)
+	for i := range raw {
+		b, end, err := z.readZDLE()
+		if err != nil {
+			return h, err
+		}
+		if end {
+			return h, errZmodemBadCRC
+		}
+		raw[i] = b
+	}
+
+	if use32 {
+		if crc32.ChecksumIEEE(raw[:5]) != binary.LittleEndian.Uint32(raw[5:]) {
+			return h, errZmodemBadCRC
+		}
+	} else if crc16(0, raw[:5]) != binary.BigEndian.Uint16(raw[5:]) {
+		return h, errZmodemBadCRC
+	}
+
+	z.rxCRC32 = use32
+	h.typ = raw[0]
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+// readSubpacket reads one data subpacket following a binary header, using
+// the CRC width of that header.
+func (z *zmodemConn) readSubpacket() (data []byte, end byte, err error) {
+	for {
+		b, isEnd, err := z.readZDLE()
+		if err != nil {
+			return nil, 0, err
+		}
+		if isEnd {
+			end = b
+			break
+		}
+		if len(data) >= zmodemMaxSubpacket {
+			return nil, 0, errZmodemBadCRC
+		}
+		data = append(data, b)
+	}
+
+	n := 2
+	if z.rxCRC32 {
+		n = 4
+	}
+	crc := make([]byte, n)
+	for i := range crc {
+		b, isEnd, err := z.readZDLE()
+		if err != nil {
+			return nil, 0, err
+		}
+		if isEnd {
+			return nil, 0, errZmodemBadCRC
+		}
+		crc[i] = b
+	}
+
+	if z.rxCRC32 {
+		sum := crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end})
+		if sum != binary.LittleEndian.Uint32(crc) {
+			return nil, 0, errZmodemBadCRC
+		}
+	} else if crc16(crc16(0, data), []byte{end}) != binary.BigEndian.Uint16(crc) {
+		return nil, 0, errZmodemBadCRC
+	}
+	return data, end, nil
+}
+
+// finish consumes the "OO" that ends a session, leaving anything else for the
+// terminal.
+func (z *zmodemConn) finish() {
+	for n := 0; n < 2; {
+		if z.r.Buffered() == 0 {
+			return
+		}
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 'O':
+			n++
+		case '\r', '\n', 0x8a, 0x8d, xON:
+		default:
+			z.r.UnreadByte()
+			return
+		}
+	}
+}
+
+// rest returns what was read past the end of the transfer.
+func (z *zmodemConn) rest() []byte {
+	p, _ := z.r.Peek(z.r.Buffered())
+	return p
+}
+
+// receive accepts the files offered by `sz` and stores them in dir. It
+// returns the files that were received completely.
+func (z *zmodemConn) receive(dir string, onFile func(zmodemFile)) ([]zmodemFile, error) {
+	var (
+		files   []zmodemFile
+		current *zmodemFile
+		f       *os.File
+		written int64
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	rinit := flagsHeader(zRINIT, zCANFDX|zCANOVIO|zCANFC32)
+	if err := z.writeHexHeader(rinit); err != nil {
+		return files, err
+	}
+
+	for {
+		h, err := z.readHeader()
+		if err != nil {
+			return files, err
+		}
+
+		switch h.typ {
+		case zRQINIT:
+			if err := z.writeHexHeader(rinit); err != nil {
+				return files, err
+			}
+		case zSINIT:
+			// the attention string is of no use without a real tty
+			if _, _, err := z.readSubpacket(); err != nil {
+				return files, err
+			}
+			if err := z.writeHexHeader(posHeader(zACK, 0)); err != nil {
+				return files, err
+			}
+		case zFILE:
+			data, _, err := z.readSubpacket()
+			if errors.Is(err, errZmodemBadCRC) {
+				if err := z.writeHexHeader(posHeader(zNAK, 0)); err != nil {
+					return files, err
+				}
+				continue
+			} else if err != nil {
+				return files, err
+			}
+			info := parseZmodemFileInfo(data)
+			if f != nil {
+				f.Close()
+			}
+			if f, err = createUnique(dir, info.Name); err != nil {
+				z.writeHexHeader(posHeader(zFERR, 0))
+				return files, err
+			}
+			info.Name = filepath.Base(f.Name())
+			current, written = &info, 0
+			if err := z.writeHexHeader(posHeader(zRPOS, 0)); err != nil {
+				return files, err
+			}
+		case zDATA:
+			if f == nil {
+				if err := z.writeHexHeader(posHeader(zRINIT, 0)); err != nil {
+					return files, err
+				}
+				continue
+			}
+			if h.pos() != written {
+				if err := z.writeHexHeader(posHeader(zRPOS, written)); err != nil {
+					return files, err
+				}
+				continue
+			}
+			if err := z.receiveData(f, &written); err != nil {
+				return files, err
+			}
+		case zEOF:
+			if f == nil || h.pos() != written {
+				continue
+			}
+			if err := f.Close(); err != nil {
+				f = nil
+				return files, err
+			}
+			f = nil
+			current.Size = written
+			files = append(files, *current)
+			if onFile != nil {
+				onFile(*current)
+			}
+			if err := z.writeHexHeader(rinit); err != nil {
+				return files, err
+			}
+		case zFIN:
+			if err := z.writeHexHeader(posHeader(zFIN, 0)); err != nil {
+				return files, err
+			}
+			z.finish()
+			return files, nil
+		case zCAN, zABORT, zFERR:
+			return files, errZmodemCanceled
+		}
+	}
+}
+
+// receiveData reads the subpackets of a ZDATA frame into f.
+func (z *zmodemConn) receiveData(f *os.File, written *int64) error {
+	for {
+		data, end, err := z.readSubpacket()
+		if errors.Is(err, errZmodemBadCRC) {
+			// ask the sender to go back, then resync on its next header
+			return z.writeHexHeader(posHeader(zRPOS, *written))
+		} else if err != nil {
+			return err
+		}
+
+		n, err := f.Write(data)
+		*written += int64(n)
+		if err != nil {
+			z.writeHexHeader(posHeader(zFERR, *written))
+			return err
+		}
+
+		switch end {
+		case zCRCW:
+			if err := z.writeHexHeader(posHeader(zACK, *written)); err != nil {
+				return err
+			}
+			return nil
+		case zCRCQ:
+			if err := z.writeHexHeader(posHeader(zACK, *written)); err != nil {
+				return err
+			}
+		case zCRCE:
+			return nil
+		}
+	}
+}
+
+// send offers paths to `rz`, which has already sent rinit.
+func (z *zmodemConn) send(rinit zmodemHeader, paths []string, onFile func(zmodemFile)) error {
+	z.crc32 = rinit.data[3]&zCANFC32 != 0
+
+	var total int64
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			total += info.Size()
+		}
+	}
+
+	for i, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		file := zmodemFile{Name: filepath.Base(p), Size: info.Size()}
+
+		sent, err := z.sendFile(p, info, len(paths)-i, total)
+		if err != nil {
+			return err
+		}
+		total -= info.Size()
+		if sent && onFile != nil {
+			onFile(file)
+		}
+	}
+
+	if err := z.writeHexHeader(posHeader(zFIN, 0)); err != nil {
+		return err
+	}
+	for {
+		h, err := z.readHeader()
+		if err != nil {
+			return err
+		}
+		if h.typ == zFIN {
+			break
+		}
+		if h.typ == zCAN || h.typ == zABORT {
+			return errZmodemCanceled
+		}
+	}
+	_, err := z.w.Write([]byte("OO"))
+	return err
+}
+
+// sendFile transfers one file and reports whether the receiver took it.
+func (z *zmodemConn) sendFile(path string, info os.FileInfo, remaining int, total int64) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// name NUL "size mtime mode serial files-left bytes-left" NUL
+	meta := []byte(filepath.Base(path))
+	meta = append(meta, 0)
+	meta = fmt.Appendf(meta, "%d %o %o 0 %d %d", info.Size(), info.ModTime().Unix(), info.Mode().Perm()|0o100000, remaining, total)
+	meta = append(meta, 0)
+
+	offer := func() error {
+		if err := z.writeBinaryHeader(flagsHeader(zFILE, zCBIN)); err != nil {
+			return err
+		}
+		return z.writeSubpacket(meta, zCRCW)
+	}
+	if err := offer(); err != nil {
+		return false, err
+	}
+
+	for {
+		h, err := z.readHeader()
+		if err != nil {
+			return false, err
+		}
+
+		switch h.typ {
+		case zRINIT:
+			// left over from before the offer
+		case zNAK:
+			if err := offer(); err != nil {
+				return false, err
+			}
+		case zSKIP:
+			return false, nil
+		case zCRC:
+			sum, err := fileCRC32(f)
+			if err != nil {
+				return false, err
+			}
+			if err := z.writeHexHeader(posHeader(zCRC, int64(sum))); err != nil {
+				return false, err
+			}
+		case zRPOS:
+			if err := z.sendData(f, h.pos(), info.Size()); err != nil {
+				return false, err
+			}
+			return true, nil
+		case zCAN, zABORT, zFIN, zFERR:
+			return false, errZmodemCanceled
+		}
+	}
+}
+
+// sendData streams f from pos, then sends ZEOF and waits for the receiver to
+// take it, going back whenever it asks with ZRPOS.
+func (z *zmodemConn) sendData(f *os.File, pos, size int64) error {
+	buf := make([]byte, zmodemBlockSize)
+	for {
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		if err := z.writeBinaryHeader(posHeader(zDATA, pos)); err != nil {
+			return err
+		}
+
+		for end := zCRCG; end != zCRCE; {
+			n, err := io.ReadFull(f, buf)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+			if pos += int64(n); pos >= size {
+				end = zCRCE
+			}
+			if err := z.writeSubpacket(buf[:n], end); err != nil {
+				return err
+			}
+		}
+
+		if err := z.writeBinaryHeader(posHeader(zEOF, size)); err != nil {
+			return err
+		}
+
+		resend := false
+		for !resend {
+			h, err := z.readHeader()
+			if err != nil {
+				return err
+			}
+			switch h.typ {
+			case zRINIT, zSKIP:
+				return nil
+			case zRPOS:
+				pos, resend = h.pos(), true
+			case zCAN, zABORT, zFERR:
+				return errZmodemCanceled
+			}
+		}
+	}
+}
+
+func fileCRC32(f *os.File) (uint32, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// parseZmodemFileInfo decodes the ZFILE subpacket. Only the name and size
+// are used; the name is reduced to its base so it cannot escape the staging
+// directory.
+func parseZmodemFileInfo(data []byte) zmodemFile {
+	name, rest, _ := bytes.Cut(data, []byte{0})
+	info := zmodemFile{Name: filepath.Base(filepath.Clean("/" + string(name)))}
+	if info.Name == "/" || info.Name == "." {
+		info.Name = "file"
+	}
+
+	rest, _, _ = bytes.Cut(rest, []byte{0})
+	if fields := strings.Fields(string(rest)); len(fields) > 0 {
+		info.Size, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	return info
+}
+
+// createUnique creates name in dir, adding a number when it is taken.
+func createUnique(dir, name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+	}
+}
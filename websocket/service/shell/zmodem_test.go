@@ -0,0 +1,95 @@
+package shell
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC16(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16(0, []byte("123456789")))
+}
+
+func TestDetectZmodem(t *testing.T) {
+	i, direction := detectZmodem([]byte("rz\r**\x18B00000000000000\r\x8a\x11"))
+	assert.Equal(t, 3, i)
+	assert.Equal(t, zmodemDownload, direction)
+
+	i, direction = detectZmodem([]byte("rz waiting to receive.**\x18B0100000023be50\r\x8a\x11"))
+	assert.Equal(t, 22, i)
+	assert.Equal(t, zmodemUpload, direction)
+
+	i, _ = detectZmodem([]byte("plain output"))
+	assert.Equal(t, -1, i)
+}
+
+func TestParseZmodemFileInfo(t *testing.T) {
+	info := parseZmodemFileInfo([]byte("../../etc/passwd\x00123 14536754 100644 0 1 123\x00"))
+	assert.Equal(t, "passwd", info.Name)
+	assert.Equal(t, int64(123), info.Size)
+
+	info = parseZmodemFileInfo([]byte("\x00"))
+	assert.Equal(t, "file", info.Name)
+}
+
+func TestZmodemTransfer(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		crc32 bool
+	}{
+		{"crc16", false},
+		{"crc32", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			dst := t.TempDir()
+
+			// every byte value, spanning several subpackets
+			var content []byte
+			for i := 0; i < 5000; i++ {
+				content = append(content, byte(i*7))
+			}
+			paths := []string{filepath.Join(src, "data.bin"), filepath.Join(src, "empty.txt")}
+			assert.NoError(t, os.WriteFile(paths[0], content, 0o644))
+			assert.NoError(t, os.WriteFile(paths[1], nil, 0o644))
+
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			sendErr := make(chan error, 1)
+			go func() {
+				sender := newZmodemConn(a, a)
+				rinit, err := sender.readHeader()
+				if err != nil {
+					sendErr <- err
+					return
+				}
+				if !tc.crc32 {
+					rinit.data[3] &^= zCANFC32
+				}
+				sendErr <- sender.send(rinit, paths, nil)
+			}()
+
+			receiver := newZmodemConn(b, b)
+			var seen []zmodemFile
+			files, err := receiver.receive(dst, func(f zmodemFile) { seen = append(seen, f) })
+			assert.NoError(t, err)
+			// the pipe is unbuffered, take the final "OO" off the sender
+			go io.Copy(io.Discard, b)
+			assert.NoError(t, <-sendErr)
+
+			assert.Equal(t, []zmodemFile{{"data.bin", 5000}, {"empty.txt", 0}}, files)
+			assert.Equal(t, files, seen)
+
+			got, err := os.ReadFile(filepath.Join(dst, "data.bin"))
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(content, got))
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package upload
+
+import (
+	"io"
+	"os"
+
+	"webshell/service/sandbox"
+)
+
+// jailBackend checks every path given to an uploadBackend against a jail.
+// New uploadBackend methods must be added here too.
+type jailBackend struct {
+	backend uploadBackend
+	jail    *sandbox.Jail
+}
+
+func newJailBackend(backend uploadBackend, jail *sandbox.Jail) uploadBackend {
+	return &jailBackend{backend: backend, jail: jail}
+}
+
+func (j *jailBackend) Stat(path string) (os.FileInfo, error) {
+	if err := j.jail.Check(path); err != nil {
+		return nil, err
+	}
+	return j.backend.Stat(path)
+}
+
+func (j *jailBackend) DeletePath(path string) error {
+	if err := j.jail.Check(path); err != nil {
+		return err
+	}
+	return j.backend.DeletePath(path)
+}
+
+func (j *jailBackend) MkdirAll(path string) error {
+	if err := j.jail.Check(path); err != nil {
+		return err
+	}
+	return j.backend.MkdirAll(path)
+}
+
+func (j *jailBackend) OpenFile(path string) (io.WriteCloser, error) {
+	if err := j.jail.Check(path); err != nil {
+		return nil, err
+	}
+	return j.backend.OpenFile(path)
+}
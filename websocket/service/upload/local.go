@@ -3,6 +3,7 @@ package upload
 import (
 	"io"
 	"os"
+	"webshell/service/sandbox"
 	ws "webshell/websocket"
 )
 
@@ -29,6 +30,6 @@ func (l *localBackend) OpenFile(path string) (io.WriteCloser, error) {
 
 func NewLocalService() ws.Service {
 	s := newServiceBase()
-	s.backend = &localBackend{}
+	s.backend = newJailBackend(&localBackend{}, sandbox.Local)
 	return s
 }
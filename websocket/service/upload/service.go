@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"webshell/service/sandbox"
 	ws "webshell/websocket"
 )
 
@@ -198,6 +200,11 @@ func (s *UploadService) handleStartSession(id string, data json.RawMessage) {
 	}
 
 	_, err := s.backend.Stat(id)
+	var outsideErr *sandbox.OutsideRootError
+	if errors.As(err, &outsideErr) {
+		s.handleError(id, actionStartSession, err)
+		return
+	}
 
 	// File exists, request frontend confirmation
 	if d.Policy == "" && err == nil {
@@ -436,18 +443,25 @@ func (s *UploadService) writeChunkData(meta *chunkMeta, data []byte) {
 func (s *UploadService) handleError(id, action string, err error) {
 	s.Println(err)
 
-	s.conn.WriteJSON(&ws.ServiceMessage{
+	msg := &ws.ServiceMessage{
 		Service: s.Name(),
 		Id:      id,
 		Action:  action,
 		Error:   err.Error(),
-	})
+	}
+	// paths outside the roots come with a code the client can tell apart
+	var outsideErr *sandbox.OutsideRootError
+	if errors.As(err, &outsideErr) {
+		msg.Data, _ = json.Marshal(outsideErr)
+	}
+	s.conn.WriteJSON(msg)
 
 	s.RLock()
 	ss := s.sessions[id]
 	s.RUnlock()
 
-	if ss.file != nil {
+	// mkdir and start_session fail without a session
+	if ss != nil && ss.file != nil {
 		ss.Lock()
 		ss.file.Close()
 		ss.Unlock()
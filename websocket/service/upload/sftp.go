@@ -3,6 +3,7 @@ package upload
 import (
 	"io"
 	"os"
+	"webshell/service/sandbox"
 	ws "webshell/websocket"
 
 	"github.com/pkg/sftp"
@@ -36,8 +37,9 @@ func NewSFTPBackend(client *sftp.Client) uploadBackend {
 	return &sftpBackend{client: client}
 }
 
-func NewSFTPService(client *sftp.Client) ws.Service {
+// NewSFTPService stores uploads through client, within the roots of jail.
+func NewSFTPService(client *sftp.Client, jail *sandbox.Jail) ws.Service {
 	s := newServiceBase()
-	s.backend = NewSFTPBackend(client)
+	s.backend = newJailBackend(NewSFTPBackend(client), jail)
 	return s
 }